@@ -0,0 +1,141 @@
+package adapters
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func SummaryExists(videoID string) bool {
+	_, err := os.Stat(fmt.Sprintf("%s/%s.md", Paths.Summaries, videoID))
+	return err == nil
+}
+
+func TranscriptionExists(videoID string) bool {
+	_, err := os.Stat(fmt.Sprintf("%s/%s.json", Paths.Transcriptions, videoID))
+	return err == nil
+}
+
+// Removes every file the pipeline and chat have produced for a video: summaries, transcription,
+// chat history, and anything left behind in the downloads directory
+func DeleteVideoArtifacts(videoID string) error {
+	paths := []string{
+		fmt.Sprintf("%s/%s.md", Paths.Summaries, videoID),
+		blurbsPath(videoID),
+		summaryCacheKeyPath(videoID),
+		summarySectionsPath(videoID),
+		fmt.Sprintf("%s/%s.json", Paths.Transcriptions, videoID),
+		fmt.Sprintf("%s/%s.json", Paths.Chats, videoID),
+	}
+
+	for _, p := range paths {
+		if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	if err := os.RemoveAll(summaryVersionsDir(videoID)); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(rangeSummaryDir(videoID)); err != nil {
+		return err
+	}
+
+	return removeDownloads(videoID)
+}
+
+// Removes <id>.* files and the <id>/ chunk directory from Paths.Downloads
+func removeDownloads(videoID string) error {
+	entries, err := os.ReadDir(Paths.Downloads)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		name := e.Name()
+		if name != videoID && !strings.HasPrefix(name, videoID+".") {
+			continue
+		}
+
+		if err := os.RemoveAll(filepath.Join(Paths.Downloads, name)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Clears what a crash leaves in Paths.Downloads: audio chunks from a killed chunkAudio, and the files of
+// any video that never got a transcription, which a retry might otherwise pick up half-written.
+// Saved chunk transcriptions are kept so the retry can still skip those chunks, and summaries and transcriptions
+// are left alone. Only safe before the pipeline starts. Returns how many entries went
+func CleanupDownloads() (int, error) {
+	entries, err := os.ReadDir(Paths.Downloads)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, e := range entries {
+		name := e.Name()
+		videoID, _, _ := strings.Cut(name, ".")
+
+		if e.IsDir() && !TranscriptionExists(videoID) {
+			n, err := cleanupChunkDir(filepath.Join(Paths.Downloads, name))
+			removed += n
+			if err != nil {
+				return removed, err
+			}
+			continue
+		}
+
+		if !e.IsDir() && TranscriptionExists(videoID) {
+			continue
+		}
+
+		if err := os.RemoveAll(filepath.Join(Paths.Downloads, name)); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+
+	return removed, nil
+}
+
+// Removes everything in a chunk directory but the chunk results, and the directory itself once it's empty
+func cleanupChunkDir(dir string) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	removed, kept := 0, 0
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasPrefix(e.Name(), "chunk-") && filepath.Ext(e.Name()) == ".json" {
+			kept++
+			continue
+		}
+
+		if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+
+	if kept == 0 {
+		if err := os.Remove(dir); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+
+	return removed, nil
+}
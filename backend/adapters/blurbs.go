@@ -0,0 +1,91 @@
+package adapters
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Blurb kinds a job can ask for, and what each should look like
+var BlurbKinds = map[string]string{
+	"tweet":               "a single tweet under 280 characters",
+	"youtube_description": "a YouTube video description of 2-3 short paragraphs",
+	"linkedin":            "a LinkedIn post of about 100 words in a professional tone",
+}
+
+func blurbsPath(videoID string) string {
+	return fmt.Sprintf("%s/%s.blurbs.json", Paths.Summaries, videoID)
+}
+
+func ValidateBlurbKinds(kinds []string) error {
+	for _, k := range kinds {
+		if _, ok := BlurbKinds[k]; !ok {
+			return fmt.Errorf("unknown blurb kind %q", k)
+		}
+	}
+	return nil
+}
+
+// Writes every requested kind of blurb in one Groq call, derived from the finished summary,
+// and stores them as <Paths.Summaries>/<videoID>.blurbs.json
+func GenerateBlurbs(ctx context.Context, videoID string, model string, summary string, kinds []string) error {
+	wanted := make([]string, 0, len(kinds))
+	for _, k := range kinds {
+		wanted = append(wanted, fmt.Sprintf("- %q: %s", k, BlurbKinds[k]))
+	}
+
+	reqData := GroqSummarizationRequest{
+		Messages: []Message{
+			{
+				Content: "You write short promotional blurbs for videos based on their summary. DO NOT USE EMOJIS. Respond with a JSON object mapping each requested key to its blurb as a plain string, and nothing else.",
+				Role:    "system",
+			},
+			{
+				Content: fmt.Sprintf("Write these blurbs:\n%s\n\nHere is the summary:\n%s", strings.Join(wanted, "\n"), summary),
+				Role:    "user",
+			},
+		},
+		Model:          model,
+		ResponseFormat: map[string]string{"type": "json_object"},
+	}
+
+	responseData, err := chatCompletion(ctx, reqData)
+	if err != nil {
+		return err
+	}
+
+	var blurbs map[string]string
+	if err := json.Unmarshal([]byte(responseData.Choices[0].Message.Content), &blurbs); err != nil {
+		return fmt.Errorf("blurbs response was not a JSON object: %w", err)
+	}
+
+	// Only keep what was asked for, in case the model got creative
+	out := make(map[string]string, len(kinds))
+	for _, k := range kinds {
+		out[k] = blurbs[k]
+	}
+
+	data, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(blurbsPath(videoID), data, 0644)
+}
+
+// Returns an error satisfying os.IsNotExist if no blurbs were generated for the video
+func ReadBlurbs(videoID string) (map[string]string, error) {
+	data, err := os.ReadFile(blurbsPath(videoID))
+	if err != nil {
+		return nil, err
+	}
+
+	var blurbs map[string]string
+	if err := json.Unmarshal(data, &blurbs); err != nil {
+		return nil, err
+	}
+
+	return blurbs, nil
+}
@@ -0,0 +1,49 @@
+package adapters
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Skip Groq when a summary is regenerated from exactly the same transcript and parameters. Jobs can opt out with force
+var SummaryCaching = true
+
+func summaryCacheKeyPath(videoID string) string {
+	return fmt.Sprintf("%s/%s.cachekey", Paths.Summaries, videoID)
+}
+
+// Covers everything that goes into the Groq calls: the model, the prompt, and the transcript as it was chunked.
+// The chunks already reflect trimming, speaker labels and the token budget, so changing any of those misses
+func summaryCacheKey(model string, prompt string, chunks []string) string {
+	h := sha256.New()
+	h.Write([]byte(model))
+	h.Write([]byte{0})
+	h.Write([]byte(prompt))
+	for _, c := range chunks {
+		h.Write([]byte{0})
+		h.Write([]byte(c))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// The existing summary, if it was made from the same inputs as key
+func cachedSummary(videoID string, key string) (string, bool) {
+	stored, err := os.ReadFile(summaryCacheKeyPath(videoID))
+	if err != nil || strings.TrimSpace(string(stored)) != key {
+		return "", false
+	}
+
+	summary, err := os.ReadFile(fmt.Sprintf("%s/%s.md", Paths.Summaries, videoID))
+	if err != nil {
+		return "", false
+	}
+
+	return string(summary), true
+}
+
+func saveSummaryCacheKey(videoID string, key string) error {
+	return os.WriteFile(summaryCacheKeyPath(videoID), []byte(key), 0644)
+}
@@ -1,14 +1,13 @@
 package adapters
 
 import (
-	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
-	"strings"
 )
 
 type ChatMessage struct {
@@ -28,10 +27,23 @@ type GroqStreamResponse struct {
 			Content string `json:"content"`
 		} `json:"delta"`
 	} `json:"choices"`
+
+	// Set instead of Choices when the completion fails partway through
+	Error *groqErrorBody `json:"error"`
+}
+
+// Lets people chat about videos that were never summarized or transcribed, which is just a general chat. Off by default
+var AllowOpenChat = false
+
+var ErrNoVideoContext = errors.New("summarize this video first")
+
+// Whether there's anything about the video to ground a chat in
+func HasVideoContext(videoID string) bool {
+	return SummaryExists(videoID) || TranscriptionExists(videoID)
 }
 
 func loadSummary(videoID string) (string, error) {
-	summaryPath := fmt.Sprintf("%s/%s.md", SummariesPath, videoID)
+	summaryPath := fmt.Sprintf("%s/%s.md", Paths.Summaries, videoID)
 
 	if _, err := os.Stat(summaryPath); os.IsNotExist(err) {
 		return "", nil // No summary available
@@ -45,8 +57,39 @@ func loadSummary(videoID string) (string, error) {
 	return string(data), nil
 }
 
+// What the chat is grounded in: the summary, or the transcript when there's no summary, cut down to what fits in
+// the same budget as a summary chunk so the history and answer still have room. Empty when there's neither
+func loadVideoContext(videoID string, model string, systemPrompt string) (string, error) {
+	summary, err := loadSummary(videoID)
+	if err != nil {
+		return "", err
+	}
+	if summary != "" {
+		return "Here is the summary of the video:\n\n" + summary, nil
+	}
+
+	script, err := ReadTranscription(videoID)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	chunks := createTranscriptSegments(script, chunkTokenBudget(model, systemPrompt, MaxTokens))
+	if len(chunks) == 0 {
+		return "", nil
+	}
+
+	transcript := "Here is the transcript of the video:\n\n" + chunks[0]
+	if len(chunks) > 1 {
+		transcript += "\n(The transcript is cut off here, the rest of the video isn't included)"
+	}
+	return transcript, nil
+}
+
 func loadChatHistory(videoID string) ([]ChatMessage, error) {
-	chatPath := fmt.Sprintf("./content/chats/%s.json", videoID)
+	chatPath := fmt.Sprintf("%s/%s.json", Paths.Chats, videoID)
 
 	if _, err := os.Stat(chatPath); os.IsNotExist(err) {
 		return []ChatMessage{}, nil
@@ -65,15 +108,21 @@ func loadChatHistory(videoID string) ([]ChatMessage, error) {
 	return history, nil
 }
 
-func SendChatMessage(ctx context.Context, videoID, message string, onProgress func(string)) error {
+// An empty model uses the chat model from settings
+func SendChatMessage(ctx context.Context, videoID, message, model string, onProgress func(string)) error {
+	if model == "" {
+		model = GetChatModel()
+	}
+
 	// Load chat history
 	history, err := loadChatHistory(videoID)
 	if err != nil {
 		return err
 	}
 
-	// Load summary
-	summary, err := loadSummary(videoID)
+	systemPrompt := "You are a smart and chill person answering questions about the video. By default your response should be super short and concise UNLESS EXPLICITLY ASKED to do something that requires a lot more text"
+
+	videoContext, err := loadVideoContext(videoID, model, systemPrompt)
 	if err != nil {
 		return err
 	}
@@ -81,15 +130,15 @@ func SendChatMessage(ctx context.Context, videoID, message string, onProgress fu
 	// Build complete message context
 	messages := []ChatMessage{
 		{
-			Content: "You are a smart and chill person answering questions about the video. By default your response should be super short and concise UNLESS EXPLICITLY ASKED to do something that requires a lot more text",
+			Content: systemPrompt,
 			Role:    "system",
 		},
 	}
 
-	// Add summary context if available
-	if summary != "" {
+	// Add the summary or transcript if available
+	if videoContext != "" {
 		messages = append(messages, ChatMessage{
-			Content: "Here is the summary of the video:\n\n" + summary,
+			Content: videoContext,
 			Role:    "system",
 		})
 	}
@@ -106,7 +155,7 @@ func SendChatMessage(ctx context.Context, videoID, message string, onProgress fu
 	reqBody := &bytes.Buffer{}
 	reqData := GroqChatRequest{
 		Messages: messages,
-		Model:    GetChatModel(),
+		Model:    model,
 		Stream:   true,
 	}
 
@@ -119,49 +168,26 @@ func SendChatMessage(ctx context.Context, videoID, message string, onProgress fu
 		return err
 	}
 
-	request.Header.Add("Authorization", fmt.Sprintf("Bearer %s", apiKey))
 	request.Header.Add("Content-Type", "application/json")
 
-	client := &http.Client{}
-	response, err := client.Do(request)
+	response, err := doGroqRequest(request)
 	if err != nil {
 		return err
 	}
 	defer response.Body.Close()
 
 	// Parse streaming response
-	scanner := bufio.NewScanner(response.Body)
-	for scanner.Scan() {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		default:
-			line := scanner.Text()
-
-			// Skip empty lines and non-data lines
-			if !strings.HasPrefix(line, "data: ") {
-				continue
-			}
-
-			// Check for stream termination
-			if strings.Contains(line, "[DONE]") {
-				break
-			}
-
-			// Extract JSON from data line
-			jsonData := strings.TrimPrefix(line, "data: ")
-
-			var streamResp GroqStreamResponse
-			if err := json.Unmarshal([]byte(jsonData), &streamResp); err != nil {
-				continue // Skip malformed chunks
-			}
-
-			// Extract content and call progress callback
-			if len(streamResp.Choices) > 0 && streamResp.Choices[0].Delta.Content != "" {
-				onProgress(streamResp.Choices[0].Delta.Content)
-			}
-		}
-	}
-
-	return scanner.Err()
+	received := false
+	err = readGroqStream(ctx, response.Body, func(delta string) {
+		received = true
+		onProgress(delta)
+	})
+	if err != nil {
+		return err
+	}
+
+	if !received {
+		return fmt.Errorf("%w: the stream ended without any content", ErrEmptyCompletion)
+	}
+	return nil
 }
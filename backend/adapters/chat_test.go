@@ -0,0 +1,92 @@
+package adapters
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Content directories under a temp dir for the rest of the test
+func useTempContent(t *testing.T) {
+	t.Helper()
+
+	old := Paths
+	t.Cleanup(func() { Paths = old })
+
+	Paths = NewContentPaths(t.TempDir())
+	for _, dir := range []string{Paths.Downloads, Paths.Transcriptions, Paths.Summaries, Paths.Chats} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func writeTestTranscription(t *testing.T, videoID string, segments []Segment) {
+	t.Helper()
+
+	data, err := json.Marshal(segments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(Paths.Transcriptions, videoID+".json"), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSendChatMessageUsesTranscriptWithoutSummary(t *testing.T) {
+	useTempContent(t)
+
+	const videoID = "dQw4w9WgXcQ"
+	writeTestTranscription(t, videoID, []Segment{
+		{Start: 0, End: 4, Text: "never gonna give you up"},
+		{Start: 4, End: 8, Text: "never gonna let you down"},
+	})
+
+	var sent GroqChatRequest
+	stubGroq(t, func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&sent)
+		writeStream(w, "ok")
+	})
+
+	if err := SendChatMessage(context.Background(), videoID, "what is this song?", "model", func(string) {}); err != nil {
+		t.Fatal(err)
+	}
+
+	var system []string
+	for _, m := range sent.Messages {
+		if m.Role == "system" {
+			system = append(system, m.Content)
+		}
+	}
+	if len(system) != 2 || !strings.Contains(system[1], "never gonna let you down") {
+		t.Fatalf("transcript missing from the system messages: %q", system)
+	}
+}
+
+func TestLoadVideoContextTruncatesTranscript(t *testing.T) {
+	useTempContent(t)
+
+	const videoID = "dQw4w9WgXcQ"
+	segments := make([]Segment, 0)
+	for i := range 5000 {
+		segments = append(segments, Segment{Start: float64(i), End: float64(i + 1), Text: fmt.Sprintf("line number %d of a very long video", i)})
+	}
+	writeTestTranscription(t, videoID, segments)
+
+	videoContext, err := loadVideoContext(videoID, "unknown-model", "prompt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tokens := estimateTokens(videoContext); tokens > DefaultModelTokenLimit/2 {
+		t.Errorf("context is %d tokens, more than half of a %d token window", tokens, DefaultModelTokenLimit)
+	}
+	if !strings.Contains(videoContext, "line number 0 ") || !strings.Contains(videoContext, "cut off") {
+		t.Error("expected the start of the transcript and a note that it was cut off")
+	}
+}
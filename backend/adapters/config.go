@@ -1,17 +1,28 @@
 package adapters
 
 import (
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
 	"go-yt-sum/settings"
 )
 
+const defaultGroqBaseURL = "https://api.groq.com/openai/v1"
+
 var (
-	groqTranscriptionUrl = "https://api.groq.com/openai/v1/audio/transcriptions"
-	groqSummarizationUrl = "https://api.groq.com/openai/v1/chat/completions"
-	groqModelsUrl        = "https://api.groq.com/openai/v1/models"
+	groqTranscriptionUrl = defaultGroqBaseURL + "/audio/transcriptions"
+	groqSummarizationUrl = defaultGroqBaseURL + "/chat/completions"
+	groqModelsUrl        = defaultGroqBaseURL + "/models"
+
+	// Every call to Groq, the diarization service and WEBHOOK_URL goes out through this client. See SetGroqClient.
+	// Per-request webhooks are the exception, they go through requestWebhookClient
+	httpClient = &http.Client{}
 
-	DownloadsPath      = "./content/downloads"
-	TranscriptionsPath = "./content/transcriptions"
-	SummariesPath      = "./content/summaries"
+	// Where everything the server stores lives. Replaced from CONTENT_DIR at startup
+	Paths = NewContentPaths("./content")
 
 	audioType = "mp3"
 
@@ -20,13 +31,65 @@ var (
 	apiKey       string
 
 	settingsMgr *settings.SettingsManager
+
+	// Set from main once LOG_FORMAT is known
+	Logger = slog.Default()
+
+	// Upper bound on transcription uploads in flight to Groq at once, across all transcription workers
+	MaxTranscriptionRequests = 4
+	transcriptionSlots       = make(chan struct{}, MaxTranscriptionRequests)
 )
 
+// Every file and directory the server stores data in, all under one root
+type ContentPaths struct {
+	Root string
+
+	Downloads      string
+	Transcriptions string
+	Summaries      string
+	Chats          string
+
+	DB       string
+	Jobs     string
+	Settings string
+
+	// Layout version marker, see RunMigrations
+	Version string
+}
+
+func NewContentPaths(root string) ContentPaths {
+	return ContentPaths{
+		Root: root,
+
+		Downloads:      filepath.Join(root, "downloads"),
+		Transcriptions: filepath.Join(root, "transcriptions"),
+		Summaries:      filepath.Join(root, "summaries"),
+		Chats:          filepath.Join(root, "chats"),
+
+		DB:       filepath.Join(root, "db.json"),
+		Jobs:     filepath.Join(root, "jobs.json"),
+		Settings: filepath.Join(root, "settings.json"),
+
+		Version: filepath.Join(root, ".version"),
+	}
+}
+
 // Init initializes the adapters package with environment variables
 func Init(ytdlpBin, groqAPIKey string, sm *settings.SettingsManager) {
 	ytdlpBinPath = ytdlpBin
 	apiKey = groqAPIKey
 	settingsMgr = sm
+	transcriptionSlots = make(chan struct{}, max(MaxTranscriptionRequests, 1))
+}
+
+// Creates every directory the pipeline reads from or writes to, so first use on a fresh install doesn't fail
+func EnsureContentDirs() error {
+	for _, dir := range []string{Paths.Downloads, Paths.Transcriptions, Paths.Summaries, Paths.Chats} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func GetSummarizationModel() string {
@@ -58,4 +121,68 @@ func GetModelsURL() string {
 	return groqModelsUrl
 }
 
+// Sends every Groq call, and the other calls sharing httpClient, through client. Groq calls go to baseURL instead
+// of the real API, e.g. an httptest.Server. An empty baseURL keeps the current one
+func SetGroqClient(client *http.Client, baseURL string) {
+	httpClient = client
+
+	if baseURL != "" {
+		baseURL = strings.TrimRight(baseURL, "/")
+		groqTranscriptionUrl = baseURL + "/audio/transcriptions"
+		groqSummarizationUrl = baseURL + "/chat/completions"
+		groqModelsUrl = baseURL + "/models"
+	}
+}
+
 var systemPrompt = "You are a summarizer agent. First, based on the content type, decide what method of organizing the data would be most helpful for the user. For example, if it's informative, summarize as a tutorial. If it's a funny video, describe what happens. If it's a course, create sections and summarize those sections etc. Use markdown, BUT DO NOT INCLUDE ```markdown```. Then, summarize the video in that way. DO NOT USE EMOJIS. If you are given a current summary, simply extend it to include the new data as instructed. Part of your input is [H:MM:SS] timestamps. Include those when referencing anything from the transcription"
+
+// Shared tail of every prompt style, so extending a summary chunk by chunk works the same whatever the style
+const summaryPromptRules = " Use markdown, BUT DO NOT INCLUDE ```markdown```. DO NOT USE EMOJIS. If you are given a current summary, simply extend it to include the new data as instructed. Part of your input is [H:MM:SS] timestamps. Include those when referencing anything from the transcription"
+
+// System prompts a job can pick with its style. Unknown styles are rejected
+var SummaryStyles = map[string]string{
+	"tutorial": systemPrompt,
+	"bullets":  "You are a summarizer agent. Summarize the video as terse bullet points grouped under a few short headings. One idea per bullet, no filler, no prose paragraphs." + summaryPromptRules,
+	"timeline": "You are a summarizer agent. Summarize the video as a timeline: one short entry per moment where the topic or action changes, in the order they happen, each starting with its timestamp." + summaryPromptRules,
+	"eli5":     "You are a summarizer agent. Explain what the video says as if to a curious ten year old: short sentences, everyday words, and a simple comparison wherever an idea is hard. Don't leave out anything important just because it's complicated." + summaryPromptRules,
+	"academic": "You are a summarizer agent. Write a formal, precise summary of the video as an academic abstract followed by sections for its main arguments, the evidence given for them, and any limitations or open questions it raises." + summaryPromptRules,
+	"detailed": "You are a summarizer agent. Write a thorough summary of the video in sections that follow its structure. Keep the important details, examples, numbers and reasoning, not just the conclusions." + summaryPromptRules,
+}
+
+// Used when a job doesn't pick a style
+var DefaultSummaryStyle = "tutorial"
+
+type summaryLength struct {
+	// Appended to the system prompt
+	prompt string
+	// Multiplies MaxTokens. Short summaries take bigger chunks, so there are fewer extend calls for them to grow in
+	chunkScale float64
+	// Whether a summary built from more than one chunk gets a final pass to condense it
+	condense bool
+}
+
+// Summary lengths a job can pick. Unknown lengths are rejected, and no length means medium
+var SummaryLengths = map[string]summaryLength{
+	"short":  {prompt: " Keep the summary short: a few paragraphs at most, however long the video is. When extending it, fold the new material into what's there instead of adding to its length.", chunkScale: 2, condense: true},
+	"medium": {chunkScale: 1},
+	"long":   {prompt: " Be thorough: go through the video section by section, each under its own heading, and keep the details, examples and numbers, not just the conclusions.", chunkScale: 0.5},
+}
+
+// Rewrites a short summary that was extended chunk by chunk, since every extend call makes it longer
+var condenseSummaryPrompt = "You are an editor. You are given a summary of a video that has grown too long. Condense it into a few paragraphs that still cover the whole video: keep its title, its most important points and the [H:MM:SS] timestamps that go with them, and drop repetition and minor details. Use markdown, BUT DO NOT INCLUDE ```markdown```. DO NOT USE EMOJIS. Reply with only the condensed summary."
+
+// Videos at or under this many seconds skip the chunked pipeline and get a single brief summary. 0 disables it
+var ShortVideoSeconds = 180
+
+// Videos longer than this are rejected before any audio is downloaded. 0 allows any length
+var MaxVideoSeconds = 0
+
+// Appended to the prompt when the transcript has speaker labels
+var speakerAttributionPrompt = " Lines are prefixed with the speaker who said them. Attribute claims and opinions to their speaker where it matters, and refer to speakers by their label."
+
+// Transcripts with fewer segments or words than this aren't worth a Groq call, so the raw transcript is
+// stored as the summary instead. 0 disables either check
+var MinSummarySegments = 3
+var MinSummaryWords = 25
+
+var ShortSummaryPrompt = "You are a summarizer agent. The video is short, so keep the summary short too: summarize it in at most 3 sentences. DO NOT USE EMOJIS. Do not use headings. Never write more than the transcript itself contains."
@@ -0,0 +1,113 @@
+package adapters
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// Assigns a speaker to each segment of a transcript. Groq doesn't diarize, so this is where an external
+// service or a local model can be plugged in
+type Diarizer interface {
+	// Returns the segments with Speaker filled in wherever the speaker could be told
+	Diarize(ctx context.Context, audioPath string, segments []Segment) ([]Segment, error)
+}
+
+// Nil means no diarization, which is the default. Set from DIARIZATION_URL, or replace with any other implementation
+var ActiveDiarizer Diarizer = nil
+
+// A speaker turn as reported by a diarization service
+type SpeakerTurn struct {
+	Start   float64 `json:"start"`
+	End     float64 `json:"end"`
+	Speaker string  `json:"speaker"`
+}
+
+// Uploads the audio as multipart "file" to URL and expects a JSON array of SpeakerTurn back
+type HTTPDiarizer struct {
+	URL string
+}
+
+func (d HTTPDiarizer) Diarize(ctx context.Context, audioPath string, segments []Segment) ([]Segment, error) {
+	audioFile, err := os.Open(audioPath)
+	if err != nil {
+		return nil, err
+	}
+	defer audioFile.Close()
+
+	reqBody := &bytes.Buffer{}
+	writer := multipart.NewWriter(reqBody)
+
+	part, err := writer.CreateFormFile("file", filepath.Base(audioPath))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(part, audioFile); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, "POST", d.URL, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", writer.FormDataContentType())
+
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return nil, fmt.Errorf("diarization service returned %d", response.StatusCode)
+	}
+
+	var turns []SpeakerTurn
+	if err := json.NewDecoder(response.Body).Decode(&turns); err != nil {
+		return nil, err
+	}
+
+	return assignSpeakers(segments, turns), nil
+}
+
+// Gives each segment the speaker whose turns overlap it the most. Segments no turn touches stay unlabelled
+func assignSpeakers(segments []Segment, turns []SpeakerTurn) []Segment {
+	for i, s := range segments {
+		overlaps := make(map[string]float64)
+		best := ""
+
+		for _, t := range turns {
+			overlap := min(s.End, t.End) - max(s.Start, t.Start)
+			if overlap <= 0 {
+				continue
+			}
+
+			overlaps[t.Speaker] += overlap
+			if best == "" || overlaps[t.Speaker] > overlaps[best] {
+				best = t.Speaker
+			}
+		}
+
+		segments[i].Speaker = best
+	}
+
+	return segments
+}
+
+func hasSpeakers(script []Segment) bool {
+	for _, s := range script {
+		if s.Speaker != "" {
+			return true
+		}
+	}
+	return false
+}
@@ -3,12 +3,13 @@ package adapters
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 	"os"
 	"path/filepath"
 	"strings"
 	"time"
+	"unicode"
 
 	"go-yt-sum/db"
 	"go-yt-sum/job"
@@ -21,6 +22,12 @@ type Segment struct {
 	Start float64 `json:"start"`
 	End   float64 `json:"end"`
 	Text  string  `json:"text"`
+
+	// Whisper's estimate that the segment isn't speech. Always 0 for captions
+	NoSpeechProb float64 `json:"no_speech_prob,omitempty"`
+
+	// Only set when a Diarizer is configured
+	Speaker string `json:"speaker,omitempty"`
 }
 
 func formatSubtitle(start float64, end float64, text string) string {
@@ -41,6 +48,62 @@ func FindNumOverlappingRunes(a, b string) int {
 	return 0
 }
 
+// When set, rolling captions that only differ in case, punctuation or spacing still count as overlapping.
+// Turn off to require an exact rune match
+var NormalizeCaptionOverlap = true
+
+// Like FindNumOverlappingRunes, but compares case-insensitively and ignores punctuation and spacing.
+// The overlap has to start and end on word boundaries, and is returned as a count of a's original runes
+func FindNumOverlappingRunesNormalized(a, b string) int {
+	ra := []rune(a)
+	nb := normalizeCaption(b)
+
+	for i := range ra {
+		if i > 0 && !unicode.IsSpace(ra[i-1]) {
+			continue
+		}
+
+		na := normalizeCaption(string(ra[i:]))
+		if na == "" || !strings.HasPrefix(nb, na) {
+			continue
+		}
+
+		// Don't let "cat" swallow the start of "cathedral"
+		if len(nb) == len(na) || nb[len(na)] == ' ' {
+			return len(ra) - i
+		}
+	}
+	return 0
+}
+
+func normalizeCaption(s string) string {
+	var sb strings.Builder
+	for _, r := range strings.ToLower(s) {
+		if unicode.IsPunct(r) {
+			continue
+		}
+		sb.WriteRune(r)
+	}
+	return strings.Join(strings.Fields(sb.String()), " ")
+}
+
+func findCaptionOverlap(prev, next string) int {
+	if NormalizeCaptionOverlap {
+		return FindNumOverlappingRunesNormalized(prev, next)
+	}
+	return FindNumOverlappingRunes(prev, next)
+}
+
+// Whether inner appears in outer as whole words. Follows NormalizeCaptionOverlap like findCaptionOverlap
+func captionContains(outer, inner string) bool {
+	if !NormalizeCaptionOverlap {
+		return strings.Contains(outer, inner)
+	}
+
+	ni := normalizeCaption(inner)
+	return ni == "" || strings.Contains(" "+normalizeCaption(outer)+" ", " "+ni+" ")
+}
+
 func findFirstByVideoID(dir, id string) (string, error) {
 	entries, err := os.ReadDir(dir)
 	if err != nil {
@@ -79,21 +142,35 @@ func formatVTT(path, videoID string) error {
 	for _, seg := range s.Items {
 		start := seg.StartAt.Seconds()
 		end := seg.EndAt.Seconds()
-		txt := seg.String()
+		// Cues are often two lines, one segment is one line of transcript
+		lines := make([]string, 0, len(seg.Lines))
+		for _, l := range seg.Lines {
+			lines = append(lines, l.String())
+		}
+		txt := strings.Join(strings.Fields(strings.Join(lines, " ")), " ")
 		if txt == "" || int64(start) == int64(end) {
 			continue
 		}
 
-		// Dedepulication.
+		// Dedepulication. YouTube's auto-subs scroll: each cue repeats the line before it and adds a new one
 		if len(segments) > 0 {
 			prevIdx := len(segments) - 1
-			k := FindNumOverlappingRunes(segments[prevIdx].Text, txt)
-			r := []rune(segments[prevIdx].Text)
+			prev := &segments[prevIdx]
 
-			if k > len(r) {
+			switch {
+			case captionContains(txt, prev.Text):
+				// The previous cue was just the start of this one. Keep its start time so nothing goes missing
+				start = prev.Start
 				segments = segments[:prevIdx]
-			} else if k > 0 {
-				segments[prevIdx].Text = string(r[:len(r)-k])
+			case captionContains(prev.Text, txt):
+				// Nothing new in this cue
+				prev.End = max(prev.End, end)
+				continue
+			default:
+				if k := findCaptionOverlap(prev.Text, txt); k > 0 {
+					r := []rune(prev.Text)
+					prev.Text = strings.TrimSpace(string(r[:len(r)-k]))
+				}
 			}
 		}
 
@@ -104,10 +181,9 @@ func formatVTT(path, videoID string) error {
 		})
 	}
 
+	outPath := fmt.Sprintf("%s/%s.json", Paths.Transcriptions, videoID)
 
-	outPath := fmt.Sprintf("%s/%s.json", TranscriptionsPath, videoID)
-
-	if  err := os.MkdirAll(filepath.Dir(outPath), 0o755); err != nil {
+	if err := os.MkdirAll(filepath.Dir(outPath), 0o755); err != nil {
 		return fmt.Errorf("mkdir err")
 	}
 
@@ -124,35 +200,126 @@ func formatVTT(path, videoID string) error {
 }
 
 func extractVideoMeta(videoID string, progress func(func(j *job.SummaryJob))) error {
-	meta, err := readVideoEntryFromInfoJSON(DownloadsPath, videoID)
+	meta, err := readVideoEntryFromInfoJSON(Paths.Downloads, videoID)
 	if err != nil {
 		return fmt.Errorf("read info.json: %w", err)
 	}
 
 	progress(func(j *job.SummaryJob) {
 		j.Progress.VideoMeta = &db.VideoEntry{
-			VideoID:           meta.VideoID,
+			// info.json has the extractor's own ID, which for other sites isn't the job key
+			VideoID:           videoID,
 			VideoThumbnailURL: meta.VideoThumbnailURL,
 			VideoName:         meta.VideoName,
 			CreatorName:       meta.CreatorName,
 			Length:            meta.Length,
 			UploadDate:        meta.UploadDate,
+			SourceURL:         j.Options.SourceURL,
 		}
 	})
 
 	return nil
 }
 
-func DownloadVideo(videoID string, progress func(func(j *job.SummaryJob))) (bool, error) {
-	filePath := fmt.Sprintf("%s/%s.%s", DownloadsPath, videoID, audioType)
+// The job is failed with status rejected_too_long instead of failed when DownloadVideo returns this
+var ErrVideoTooLong = errors.New("video is too long")
+
+// Checks the duration in the info.json against MaxVideoSeconds. Videos without a known duration, like some livestreams, get through
+func checkVideoLength(videoID string) error {
+	if MaxVideoSeconds <= 0 {
+		return nil
+	}
+
+	meta, err := readVideoEntryFromInfoJSON(Paths.Downloads, videoID)
+	if err != nil {
+		return fmt.Errorf("read info.json: %w", err)
+	}
+
+	if meta.Length > float64(MaxVideoSeconds) {
+		return fmt.Errorf("%w: %s is %s long, the limit is %s", ErrVideoTooLong, videoID, fmtHMS(int64(meta.Length)), fmtHMS(int64(MaxVideoSeconds)))
+	}
+	return nil
+}
+
+// Runs the command against the video at url, retrying transient failures. The job's progress shows which attempt
+// it's on while it retries
+func runYtdlp(ctx context.Context, dl *ytdlp.Command, videoID string, url string, progress func(func(j *job.SummaryJob))) error {
+	retried := false
+	err := retryDownload(ctx, videoID, func() error {
+		_, err := withNetworkOptions(dl).Run(ctx, url)
+		return err
+	}, func(attempt int, attempts int) {
+		retried = true
+		progress(func(j *job.SummaryJob) {
+			j.Progress.DownloadAttempt = attempt
+			j.Progress.DownloadAttempts = attempts
+		})
+	})
+
+	if retried && err == nil {
+		progress(func(j *job.SummaryJob) {
+			j.Progress.DownloadAttempt = 0
+			j.Progress.DownloadAttempts = 0
+		})
+	}
+
+	return explainDownloadError(videoID, err)
+}
+
+var (
+	// Netscape format cookies file handed to yt-dlp, so it can get at age-restricted videos. From YTDLP_COOKIES_FILE
+	YtdlpCookiesFile = ""
+	// Proxy yt-dlp connects through, for region-locked videos. From HTTP_PROXY, which Go's own HTTP client honours too
+	YtdlpProxy = ""
+)
+
+func withNetworkOptions(dl *ytdlp.Command) *ytdlp.Command {
+	if YtdlpCookiesFile != "" {
+		dl = dl.Cookies(YtdlpCookiesFile)
+	}
+	if YtdlpProxy != "" {
+		dl = dl.Proxy(YtdlpProxy)
+	}
+	return dl
+}
+
+// yt-dlp's own message for these doesn't say what the server operator can do about it
+func explainDownloadError(videoID string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	msg := strings.ToLower(err.Error())
+
+	switch {
+	case strings.Contains(msg, "sign in to confirm your age") && YtdlpCookiesFile == "":
+		return fmt.Errorf("%s is age-restricted, set YTDLP_COOKIES_FILE to cookies from a signed in account to download it: %w", videoID, err)
+	case strings.Contains(msg, "sign in to confirm your age"):
+		return fmt.Errorf("%s is age-restricted and the cookies in %s didn't get past the age check, they may have expired: %w", videoID, YtdlpCookiesFile, err)
+	case strings.Contains(msg, "not available in your country") && YtdlpProxy == "":
+		return fmt.Errorf("%s is region-locked, set HTTP_PROXY to a proxy in a region where it's available: %w", videoID, err)
+	}
+
+	return err
+}
+
+func DownloadVideo(ctx context.Context, videoID string, opts job.JobOptions, progress func(func(j *job.SummaryJob))) (bool, error) {
+	filePath := fmt.Sprintf("%s/%s.%s", Paths.Downloads, videoID, audioType)
 
 	if _, err := os.Stat(filePath); err == nil {
-		log.Printf("%s has already been downloaded. Skipping step.", videoID)
+		Logger.Info("already downloaded, skipping step", "video_id", videoID, "stage", "download")
+		// Audio only gets downloaded when there were no captions to use
+		progress(func(j *job.SummaryJob) {
+			j.Progress.HadCaptions = false
+		})
 		return false, nil
 	}
 
+	// A stream that's being waited out keeps saying so while it's checked again
 	progress(func(j *job.SummaryJob) {
-		j.Status = "checking_for_captions"
+		if j.Status != "waiting_for_stream" {
+			j.Status = "checking_for_captions"
+		}
 	})
 
 	// Trigger captions + info.json generation (without downloading media)
@@ -160,8 +327,8 @@ func DownloadVideo(videoID string, progress func(func(j *job.SummaryJob))) (bool
 		WriteAutoSubs().
 		WriteSubs().
 		SkipDownload().
-		Output(fmt.Sprintf("%s/%s.%%(ext)s", DownloadsPath, videoID)).
-		SubLangs("en,en.*").
+		Output(fmt.Sprintf("%s/%s.%%(ext)s", Paths.Downloads, videoID)).
+		SubLangs(subLangsFor(opts)).
 		ConvertSubs("vtt").
 		Quiet().
 		WriteInfoJSON().
@@ -169,52 +336,70 @@ func DownloadVideo(videoID string, progress func(func(j *job.SummaryJob))) (bool
 		Impersonate("chrome").
 		SetExecutable(ytdlpBinPath)
 
-	_, err := dl.Run(context.Background(), fmt.Sprintf("https://www.youtube.com/watch?v=%s", videoID))
+	if err := runYtdlp(ctx, dl, videoID, sourceURLFor(videoID, opts), progress); err != nil {
+		return false, err
+	}
 
-	if err != nil {
+	// Checked after writing the info.json, so a stream that's checked again also picks up the captions it may
+	// only get once it's over
+	if err := checkStreamEnded(videoID, progress); err != nil {
 		return false, err
 	}
 
-	rawPath, err := findFirstByVideoID(DownloadsPath, videoID)
+	if err := checkVideoLength(videoID); err != nil {
+		return false, err
+	}
+
+	rawPath, err := findFirstByVideoID(Paths.Downloads, videoID)
 
 	if err != nil {
 		return false, err
 	}
 
+	source := "captions"
 	if rawPath == "" {
-		return false, fmt.Errorf("Captions should have been available")
+		source = "audio"
 	}
+	Logger.Info("picked the transcript source", "video_id", videoID, "stage", "download", "source", source, "language", languageFor(opts))
 
-	// If auto-generated transcriptions aren't available, download and extract audio then send to transcriber stage
+	// If auto-generated transcriptions aren't available in the language, download and extract audio then send to transcriber stage
 	// Otherwise we can just format the VTT file and send straight to summarization
-	fmt.Println(rawPath)
 	if rawPath == "" {
 		progress(func(j *job.SummaryJob) {
 			j.Status = "downloading_audio"
+			j.Progress.HadCaptions = false
 		})
 
 		dl := ytdlp.New().
-			Output(fmt.Sprintf("%s/%s.%%(ext)s", DownloadsPath, videoID)).
+			Output(fmt.Sprintf("%s/%s.%%(ext)s", Paths.Downloads, videoID)).
 			ExtractAudio().
-			AudioFormat("mp3").
+			AudioFormat(audioType).
 			ProgressFunc(250*time.Millisecond, func(up ytdlp.ProgressUpdate) {
 				progress(func(j *job.SummaryJob) {
 					j.Progress.PercentageString = up.PercentString()
+					j.Progress.DownloadETA = up.ETA()
 
 					if up.Status == "finished" {
 						j.Status = "extracting_audio"
 					}
 				})
-			}).Quiet().WriteInfoJSON().LimitRate("1M")
+			}).Quiet().WriteInfoJSON().LimitRate("1M").
+			SetExecutable(ytdlpBinPath)
 
-		if _, err = dl.Run(context.Background(), fmt.Sprintf("https://www.youtube.com/watch?v=%s", videoID)); err != nil {
+		if err := runYtdlp(ctx, dl, videoID, sourceURLFor(videoID, opts), progress); err != nil {
 			return false, err
 		}
 
+		// yt-dlp can succeed without producing audio, e.g. for a video with no audio track
+		if _, err := os.Stat(filePath); err != nil {
+			return false, fmt.Errorf("%s has no %s captions and no audio to transcribe", videoID, languageFor(opts))
+		}
+
 		extractVideoMeta(videoID, progress)
 	} else {
 		progress(func(j *job.SummaryJob) {
 			j.Status = "downloaded_captions"
+			j.Progress.HadCaptions = true
 		})
 
 		extractVideoMeta(videoID, progress)
@@ -231,7 +416,7 @@ func DownloadVideo(videoID string, progress func(func(j *job.SummaryJob))) (bool
 
 // --- helpers ---
 
-// readVideoEntryFromInfoJSON loads <DownloadsPath>/<videoID>.info.json produced by yt-dlp
+// readVideoEntryFromInfoJSON loads <Paths.Downloads>/<videoID>.info.json produced by yt-dlp
 // and maps the subset of fields we care about into db.VideoEntry.
 func readVideoEntryFromInfoJSON(baseDir, videoID string) (db.VideoEntry, error) {
 	path := filepath.Join(baseDir, fmt.Sprintf("%s.info.json", videoID))
@@ -241,45 +426,111 @@ func readVideoEntryFromInfoJSON(baseDir, videoID string) (db.VideoEntry, error)
 		return db.VideoEntry{}, err
 	}
 
+	return parseInfoJSON(data)
+}
+
+// Extractors differ in what they fill in, and YouTube itself leaves fields out: livestreams have no duration
+// and premieres no upload_date. Each field falls back to the next best one yt-dlp has, and is left empty
+// (or 0 for the length) when there's none
+func parseInfoJSON(data []byte) (db.VideoEntry, error) {
 	var info struct {
 		ID         string  `json:"id"`
 		Title      *string `json:"title"`
 		Uploader   *string `json:"uploader"`
-		Duration   *int64  `json:"duration"`
-		UploadDate *string `json:"upload_date"` // "YYYYMMDD"
-		Thumbnail  *string `json:"thumbnail"`
-		Thumbnails []struct {
-			URL string `json:"url"`
-		} `json:"thumbnails"`
+		Channel    *string `json:"channel"`
+		UploaderID *string `json:"uploader_id"`
+		// Whole seconds from YouTube, fractional from some other extractors
+		Duration         *float64        `json:"duration"`
+		UploadDate       *string         `json:"upload_date"`  // "YYYYMMDD"
+		ReleaseDate      *string         `json:"release_date"` // "YYYYMMDD"
+		Timestamp        *float64        `json:"timestamp"`
+		ReleaseTimestamp *float64        `json:"release_timestamp"`
+		Thumbnail        *string         `json:"thumbnail"`
+		Thumbnails       []infoThumbnail `json:"thumbnails"`
 	}
 
 	if err := json.Unmarshal(data, &info); err != nil {
 		return db.VideoEntry{}, err
 	}
 
-	thumb := ""
-	if info.Thumbnail != nil {
-		thumb = *info.Thumbnail
+	thumb := bestThumbnail(info.Thumbnails)
+	if thumb == "" {
+		thumb = deref(info.Thumbnail)
 	}
-	if thumb == "" && len(info.Thumbnails) > 0 {
-		thumb = info.Thumbnails[len(info.Thumbnails)-1].URL
+
+	upload := firstNonEmpty(deref(info.UploadDate), deref(info.ReleaseDate))
+	if upload != "" {
+		upload = formatYYYYMMDD(upload)
+	} else if ts := firstPositive(info.Timestamp, info.ReleaseTimestamp); ts > 0 {
+		upload = time.Unix(int64(ts), 0).UTC().Format("2006-01-02")
 	}
 
-	upload := ""
-	if info.UploadDate != nil {
-		upload = formatYYYYMMDD(*info.UploadDate)
+	length := 0.0
+	if info.Duration != nil && *info.Duration > 0 {
+		length = *info.Duration
 	}
 
 	return db.VideoEntry{
 		VideoID:           info.ID,
 		VideoThumbnailURL: thumb,
 		VideoName:         deref(info.Title),
-		CreatorName:       deref(info.Uploader),
-		Length:            float64(derefInt(info.Duration)),
+		CreatorName:       firstNonEmpty(deref(info.Uploader), deref(info.Channel), deref(info.UploaderID)),
+		Length:            length,
 		UploadDate:        upload,
 	}, nil
 }
 
+type infoThumbnail struct {
+	URL        string `json:"url"`
+	Width      int    `json:"width"`
+	Height     int    `json:"height"`
+	Preference int    `json:"preference"`
+}
+
+// The largest thumbnail by area, then by yt-dlp's preference. yt-dlp lists them worst first,
+// so among thumbnails without sizes the last one wins. Empty if none have a URL
+func bestThumbnail(thumbnails []infoThumbnail) string {
+	best := -1
+	for i, t := range thumbnails {
+		if t.URL == "" {
+			continue
+		}
+		if best < 0 {
+			best = i
+			continue
+		}
+
+		b := thumbnails[best]
+		area, bestArea := t.Width*t.Height, b.Width*b.Height
+		if area > bestArea || (area == bestArea && t.Preference >= b.Preference) {
+			best = i
+		}
+	}
+
+	if best < 0 {
+		return ""
+	}
+	return thumbnails[best].URL
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func firstPositive(values ...*float64) float64 {
+	for _, v := range values {
+		if v != nil && *v > 0 {
+			return *v
+		}
+	}
+	return 0
+}
+
 func formatYYYYMMDD(s string) string {
 	if len(s) == 8 {
 		return s[0:4] + "-" + s[4:6] + "-" + s[6:8]
@@ -293,10 +544,3 @@ func deref(p *string) string {
 	}
 	return *p
 }
-
-func derefInt(p *int64) int64 {
-	if p == nil {
-		return 0
-	}
-	return *p
-}
@@ -0,0 +1,198 @@
+package adapters
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go-yt-sum/db"
+)
+
+func TestParseInfoJSON(t *testing.T) {
+	tests := []struct {
+		fixture string
+		want    db.VideoEntry
+	}{
+		{
+			fixture: "music_video.info.json",
+			want: db.VideoEntry{
+				VideoID:           "dQw4w9WgXcQ",
+				VideoThumbnailURL: "https://i.ytimg.com/vi/dQw4w9WgXcQ/maxresdefault.jpg",
+				VideoName:         "Rick Astley - Never Gonna Give You Up (Official Music Video)",
+				CreatorName:       "Rick Astley",
+				Length:            213,
+				UploadDate:        "2009-10-25",
+			},
+		},
+		{
+			// No duration or upload_date while on air, and the uploader only as a channel
+			fixture: "livestream.info.json",
+			want: db.VideoEntry{
+				VideoID:           "jfKfPfyJRdk",
+				VideoThumbnailURL: "https://i.ytimg.com/vi/jfKfPfyJRdk/maxresdefault_live.jpg",
+				VideoName:         "lofi hip hop radio 📚 beats to relax/study to",
+				CreatorName:       "Lofi Girl",
+				Length:            0,
+				UploadDate:        "2023-07-14",
+			},
+		},
+		{
+			// No thumbnails list, a release_date instead of upload_date, and only a handle for the uploader
+			fixture: "short.info.json",
+			want: db.VideoEntry{
+				VideoID:           "x4Qz8bJk2Lw",
+				VideoThumbnailURL: "https://i.ytimg.com/vi/x4Qz8bJk2Lw/oar2.jpg",
+				VideoName:         "How cats land on their feet #shorts",
+				CreatorName:       "@physicsbites",
+				Length:            41.5,
+				UploadDate:        "2024-03-11",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("testdata", "info", tt.fixture))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := parseInfoJSON(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("parseInfoJSON(%s)\n got  %+v\n want %+v", tt.fixture, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseInfoJSONMissingFields(t *testing.T) {
+	got, err := parseInfoJSON([]byte(`{"id": "abc", "title": null, "duration": null}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != (db.VideoEntry{VideoID: "abc"}) {
+		t.Errorf("parseInfoJSON with nothing but an ID = %+v", got)
+	}
+
+	if _, err := parseInfoJSON([]byte(`{"id": `)); err == nil {
+		t.Error("expected an error for truncated JSON")
+	}
+}
+
+// Runs formatVTT over the captions and reads back the segments it wrote
+func captionSegments(t *testing.T, vtt string) []Segment {
+	t.Helper()
+	useTempContent(t)
+
+	path := filepath.Join(Paths.Downloads, "dQw4w9WgXcQ.en.vtt")
+	if err := os.WriteFile(path, []byte(vtt), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := formatVTT(path, "dQw4w9WgXcQ"); err != nil {
+		t.Fatal(err)
+	}
+
+	segments, err := ReadTranscription("dQw4w9WgXcQ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return segments
+}
+
+// Rolling auto-captions where each cue repeats the line before it, but with its case or punctuation changed
+const rollingCaptions = `WEBVTT
+
+00:00:01.000 --> 00:00:03.000
+so today we're going to
+
+00:00:03.000 --> 00:00:05.000
+So today we're going to  
+talk about gradient descent
+
+00:00:05.000 --> 00:00:07.000
+talk about gradient descent.
+and why it works
+`
+
+func TestFormatVTTMergesNearDuplicateCaptions(t *testing.T) {
+	segments := captionSegments(t, rollingCaptions)
+
+	want := []Segment{
+		{Start: 1, End: 5, Text: "So today we're going to"},
+		{Start: 5, End: 7, Text: "talk about gradient descent. and why it works"},
+	}
+	if len(segments) != len(want) {
+		t.Fatalf("got %d segments %+v, want %d", len(segments), segments, len(want))
+	}
+	for i := range want {
+		if segments[i] != want[i] {
+			t.Errorf("segment %d = %+v, want %+v", i, segments[i], want[i])
+		}
+	}
+}
+
+func TestFormatVTTExactOverlap(t *testing.T) {
+	old := NormalizeCaptionOverlap
+	NormalizeCaptionOverlap = false
+	defer func() { NormalizeCaptionOverlap = old }()
+
+	// Without normalizing, the change of case and the full stop keep every cue apart
+	segments := captionSegments(t, rollingCaptions)
+	if len(segments) != 3 {
+		t.Errorf("got %d segments %+v, want all 3 cues kept", len(segments), segments)
+	}
+}
+
+func TestFindNumOverlappingRunesNormalized(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"we're going to Talk", "talk about it", len("Talk")},
+		{"Hello, world!", "hello world and more", len("Hello, world!")},
+		{"and so on ", "So on and so forth", len("so on ")},
+		// Only whole words overlap
+		{"the cat", "cathedral", 0},
+		{"nothing shared", "at all", 0},
+	}
+
+	for _, tt := range tests {
+		if got := FindNumOverlappingRunesNormalized(tt.a, tt.b); got != tt.want {
+			t.Errorf("FindNumOverlappingRunesNormalized(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+// A YouTube auto-caption file as yt-dlp saves it: every cue repeats the line before it above the new one, with
+// word timings inline, and a 10ms cue holding just the finished line between them
+func TestFormatVTTScrollingAutoCaptions(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "captions", "rolling.en.vtt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	segments := captionSegments(t, string(data))
+
+	lyrics := []string{
+		"we're no strangers to love",
+		"you know the rules and so do I",
+		"a full commitment's what I'm thinking of",
+		"you wouldn't get this from any other guy",
+	}
+
+	texts := make([]string, len(segments))
+	for i, s := range segments {
+		texts[i] = s.Text
+		if i > 0 && s.Start < segments[i-1].End {
+			t.Errorf("segment %d starts at %v, before the one before it ends at %v", i, s.Start, segments[i-1].End)
+		}
+	}
+
+	// Each line turns up exactly once, in order
+	if got, want := strings.Join(texts, " "), strings.Join(lyrics, " "); got != want {
+		t.Errorf("transcript = %q\nwant %q", got, want)
+	}
+}
@@ -0,0 +1,124 @@
+package adapters
+
+import (
+	"errors"
+	"math"
+
+	"go-yt-sum/job"
+)
+
+var ErrNothingToEstimate = errors.New("video has no transcript and no known duration to estimate from")
+
+// Rough transcript size for videos that haven't been transcribed yet: speech runs at about 150 words a minute,
+// or about 3 tokens a second, and the timestamps on every few seconds of lines roughly double that
+var estimatedTranscriptTokensPerSecond = 6.0
+
+// Rough size of the running summary each extendSummary call reads and rewrites
+var estimatedSummaryTokens = 1_000
+
+// What summarizing a video is expected to take, worked out without calling Groq
+type SummaryEstimate struct {
+	// Audio chunks sent to the transcription model. 0 once there's a transcript
+	TranscriptionChunks int `json:"transcription_chunks"`
+	// Summarization calls, counting the condensing pass of short summaries
+	SummaryChunks int `json:"summary_chunks"`
+	// Tokens sent to and received from the summarization model across every call
+	EstimatedTokens int `json:"estimated_tokens"`
+	// "transcript" if the existing transcript was chunked, "duration" if it was guessed from the video's length
+	BasedOn string `json:"based_on"`
+}
+
+// Estimates from the transcript if there is one, and from length, in seconds, otherwise. A length of 0 is unknown
+func EstimateSummary(videoID string, opts job.JobOptions, length float64) (SummaryEstimate, error) {
+	if TranscriptionExists(videoID) {
+		script, err := ReadTranscription(videoID)
+		if err != nil {
+			return SummaryEstimate{}, err
+		}
+		return estimateFromTranscript(script, opts), nil
+	}
+
+	if length <= 0 {
+		return SummaryEstimate{}, ErrNothingToEstimate
+	}
+	return estimateFromLength(length, opts), nil
+}
+
+func estimateFromTranscript(script []Segment, opts job.JobOptions) SummaryEstimate {
+	estimate := SummaryEstimate{BasedOn: "transcript"}
+
+	if TrimNonSpeech {
+		script = trimNonSpeech(script)
+	}
+	if opts.HasRange() {
+		script = segmentsInRange(script, opts.StartSeconds, opts.EndSeconds)
+	}
+	// Too little to summarize is stored as is, without calling Groq
+	if len(script) == 0 || isSparseTranscript(script) {
+		return estimate
+	}
+
+	plan := planSummary(script, opts)
+	promptTokens := estimateTokens(plan.prompt)
+
+	for i, chunk := range plan.chunks {
+		estimate.EstimatedTokens += promptTokens + estimateTokens(chunk) + estimatedSummaryTokens
+		// Every call after the first reads the summary so far too
+		if i > 0 {
+			estimate.EstimatedTokens += estimatedSummaryTokens
+		}
+	}
+	estimate.SummaryChunks = len(plan.chunks)
+
+	if plan.condense {
+		estimate.SummaryChunks++
+		estimate.EstimatedTokens += estimateTokens(condenseSummaryPrompt) + 2*estimatedSummaryTokens
+	}
+
+	return estimate
+}
+
+// Same sums as estimateFromTranscript, with the transcript's size guessed from the video's length
+func estimateFromLength(length float64, opts job.JobOptions) SummaryEstimate {
+	estimate := SummaryEstimate{BasedOn: "duration"}
+
+	if opts.HasRange() {
+		end := length
+		if opts.EndSeconds > 0 {
+			end = min(opts.EndSeconds, length)
+		}
+		length = max(end-opts.StartSeconds, 0)
+	}
+
+	estimate.TranscriptionChunks = int(math.Ceil(length / float64(TranscribeChunkSeconds)))
+
+	model := summarizationModelFor(opts)
+	prompt := summaryPromptFor(opts)
+	summaryLength := summaryLengthFor(opts)
+	// Short videos are summarized in one go, as isShortTranscript would have it
+	short := ShortVideoSeconds > 0 && length <= float64(ShortVideoSeconds) && opts.Style == ""
+	if short {
+		prompt = ShortSummaryPrompt
+	}
+	prompt += summaryLength.prompt + sectionsPrompt(opts.Sections) + languagePrompt(opts)
+
+	transcriptTokens := int(length * estimatedTranscriptTokensPerSecond)
+	budget := max(int(float64(chunkTokenBudget(model, prompt, int(float64(MaxTokens)*summaryLength.chunkScale)))*TokenSafetyMargin), 1)
+
+	// Every chunk after the first repeats the overlap, so only the rest of it is new transcript
+	chunks := 1
+	if !short && transcriptTokens > budget {
+		step := budget - min(max(SummaryChunkOverlap, 0), budget/2)
+		chunks = 1 + (transcriptTokens-budget+step-1)/step
+	}
+
+	estimate.SummaryChunks = chunks
+	estimate.EstimatedTokens = transcriptTokens + chunks*(estimateTokens(prompt)+estimatedSummaryTokens) + (chunks-1)*estimatedSummaryTokens
+
+	if summaryLength.condense && chunks > 1 {
+		estimate.SummaryChunks++
+		estimate.EstimatedTokens += estimateTokens(condenseSummaryPrompt) + 2*estimatedSummaryTokens
+	}
+
+	return estimate
+}
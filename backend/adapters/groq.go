@@ -0,0 +1,310 @@
+package adapters
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Returned instead of sending a request when Init was never given a Groq API key
+var ErrMissingAPIKey = errors.New("no Groq API key configured, set GROQ_API_KEY")
+
+// Groq answered without error status but with nothing to use, e.g. an empty choices array
+var ErrEmptyCompletion = errors.New("groq returned no completion")
+
+// Longest stretch of an unexpected response body quoted in an error
+const maxQuotedBody = 200
+
+// Adds the Groq API key to the request, and refuses to let it go out unauthenticated
+func authorize(request *http.Request) error {
+	if apiKey == "" {
+		return ErrMissingAPIKey
+	}
+	request.Header.Add("Authorization", fmt.Sprintf("Bearer %s", apiKey))
+	return nil
+}
+
+// Authorizes and sends the request. Non-2xx responses are read and closed, and come back as a *GroqAPIError,
+// or a *RateLimitError for 429s. Otherwise the caller owns the response body
+func doGroqRequest(request *http.Request) (*http.Response, error) {
+	if err := authorize(request); err != nil {
+		return nil, err
+	}
+
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		return response, nil
+	}
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	apiErr := newGroqAPIError(response.StatusCode, body)
+	if response.StatusCode == http.StatusTooManyRequests {
+		return nil, &RateLimitError{RetryAfter: parseRetryAfter(response.Header.Get("Retry-After")), Err: apiErr}
+	}
+	return nil, apiErr
+}
+
+// Asks Groq for its model list, for the frontend's model pickers and the health check. Unlike doGroqRequest any status
+// comes back as a response, for callers that pass it on. The caller closes the body
+func ListModels(ctx context.Context) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(ctx, "GET", groqModelsUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := authorize(request); err != nil {
+		return nil, err
+	}
+	return httpClient.Do(request)
+}
+
+// Sends a non-streaming chat completion request and decodes the response. When err is nil there's at least one choice
+func chatCompletion(ctx context.Context, reqData GroqSummarizationRequest) (*GroqSummarizationResponse, error) {
+	reqBody := &bytes.Buffer{}
+	if err := json.NewEncoder(reqBody).Encode(reqData); err != nil {
+		return nil, err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, "POST", groqSummarizationUrl, reqBody)
+	if err != nil {
+		return nil, err
+	}
+
+	request.Header.Add("Content-Type", "application/json")
+
+	response, err := doGroqRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	rawResponseData, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var responseData GroqSummarizationResponse
+	if err := json.Unmarshal(rawResponseData, &responseData); err != nil {
+		return nil, fmt.Errorf("couldn't decode groq response %q: %w", quoteBody(string(rawResponseData)), err)
+	}
+
+	if len(responseData.Choices) == 0 {
+		// Error objects sometimes come back with a 200 too
+		return nil, fmt.Errorf("%w: %s", ErrEmptyCompletion, quoteBody(newGroqAPIError(response.StatusCode, rawResponseData).Message))
+	}
+
+	return &responseData, nil
+}
+
+// Cuts a response body down to something that fits in an error message
+func quoteBody(body string) string {
+	if len(body) > maxQuotedBody {
+		return body[:maxQuotedBody] + "..."
+	}
+	return body
+}
+
+// Like chatCompletion, but streams the response, calling onPartial with everything received so far after every token.
+// Returns the full response
+func streamChatCompletion(ctx context.Context, reqData GroqSummarizationRequest, onPartial func(soFar string)) (string, error) {
+	reqData.Stream = true
+
+	reqBody := &bytes.Buffer{}
+	if err := json.NewEncoder(reqBody).Encode(reqData); err != nil {
+		return "", err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, "POST", groqSummarizationUrl, reqBody)
+	if err != nil {
+		return "", err
+	}
+
+	request.Header.Add("Content-Type", "application/json")
+
+	response, err := doGroqRequest(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	var content strings.Builder
+	err = readGroqStream(ctx, response.Body, func(delta string) {
+		content.WriteString(delta)
+		onPartial(content.String())
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if content.Len() == 0 {
+		return "", fmt.Errorf("%w: the stream ended without any content", ErrEmptyCompletion)
+	}
+
+	return content.String(), nil
+}
+
+// Reads a streamed completion, calling onDelta with each piece of content as it arrives, until Groq sends [DONE]
+// or closes the stream. Lines are read whole however long they are, and an event's data lines are joined
+// as the SSE spec says. Events that aren't valid JSON are skipped, and an error event ends the stream with its message
+func readGroqStream(ctx context.Context, body io.Reader, onDelta func(delta string)) error {
+	reader := bufio.NewReader(body)
+	var data strings.Builder
+	hasData := false
+
+	// Returns true once the stream is done, with an error if Groq sent one
+	dispatch := func() (bool, error) {
+		if !hasData {
+			return false, nil
+		}
+		payload := data.String()
+		data.Reset()
+		hasData = false
+
+		if payload == "[DONE]" {
+			return true, nil
+		}
+
+		var streamResp GroqStreamResponse
+		if err := json.Unmarshal([]byte(payload), &streamResp); err != nil {
+			return false, nil // Skip malformed chunks
+		}
+
+		if streamResp.Error != nil {
+			return true, fmt.Errorf("groq stream failed: %s", streamResp.Error.Message)
+		}
+
+		if len(streamResp.Choices) > 0 && streamResp.Choices[0].Delta.Content != "" {
+			onDelta(streamResp.Choices[0].Delta.Content)
+		}
+		return false, nil
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		line, readErr := reader.ReadString('\n')
+		if readErr != nil && readErr != io.EOF {
+			return readErr
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		switch {
+		case line == "":
+			// A blank line ends the event
+			if done, err := dispatch(); done {
+				return err
+			}
+		case strings.HasPrefix(line, "data:"):
+			if hasData {
+				data.WriteByte('\n')
+			}
+			data.WriteString(strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+			hasData = true
+		}
+		// Anything else is a comment or a field we don't use
+
+		if readErr == io.EOF {
+			_, err := dispatch()
+			return err
+		}
+	}
+}
+
+// A non-2xx response from Groq, decoded from its error body when possible
+type GroqAPIError struct {
+	StatusCode int
+	Code       string
+	Type       string
+	Message    string
+}
+
+func (e *GroqAPIError) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("groq returned %d (%s): %s", e.StatusCode, e.Code, e.Message)
+	}
+	return fmt.Sprintf("groq returned %d: %s", e.StatusCode, e.Message)
+}
+
+// The error object Groq sends in place of a completion
+type groqErrorBody struct {
+	Message string `json:"message"`
+	Type    string `json:"type"`
+	Code    string `json:"code"`
+}
+
+func newGroqAPIError(statusCode int, body []byte) *GroqAPIError {
+	var payload struct {
+		Error groqErrorBody `json:"error"`
+	}
+
+	apiErr := &GroqAPIError{StatusCode: statusCode}
+
+	if err := json.Unmarshal(body, &payload); err != nil || payload.Error.Message == "" {
+		apiErr.Message = string(body)
+		return apiErr
+	}
+
+	apiErr.Code = payload.Error.Code
+	apiErr.Type = payload.Error.Type
+	apiErr.Message = payload.Error.Message
+	return apiErr
+}
+
+// Groq is rate limiting us. RetryAfter is how long it asked us to wait, 0 if it didn't say
+type RateLimitError struct {
+	RetryAfter time.Duration
+	Err        *GroqAPIError
+}
+
+func (e *RateLimitError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("%s (retry after %s)", e.Err.Error(), e.RetryAfter)
+	}
+	return e.Err.Error()
+}
+
+func (e *RateLimitError) Unwrap() error {
+	return e.Err
+}
+
+// Retry-After is either a number of seconds or an HTTP date
+func parseRetryAfter(header string) time.Duration {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return 0
+	}
+
+	if secs, err := strconv.ParseFloat(header, 64); err == nil && secs > 0 {
+		return time.Duration(secs * float64(time.Second))
+	}
+
+	if at, err := http.ParseTime(header); err == nil {
+		return max(time.Until(at), 0)
+	}
+
+	return 0
+}
+
+// The request plus the prompt didn't fit in the model's context window
+func isContextLengthExceeded(err error) bool {
+	var apiErr *GroqAPIError
+	return errors.As(err, &apiErr) && apiErr.Code == "context_length_exceeded"
+}
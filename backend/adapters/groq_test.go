@@ -0,0 +1,160 @@
+package adapters
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// Points every Groq call at handler for the rest of the test, with an API key set
+func stubGroq(t *testing.T, handler http.HandlerFunc) {
+	t.Helper()
+
+	server := httptest.NewServer(handler)
+	oldClient, oldKey := httpClient, apiKey
+	oldTranscription, oldSummarization, oldModels := groqTranscriptionUrl, groqSummarizationUrl, groqModelsUrl
+
+	t.Cleanup(func() {
+		server.Close()
+		httpClient, apiKey = oldClient, oldKey
+		groqTranscriptionUrl, groqSummarizationUrl, groqModelsUrl = oldTranscription, oldSummarization, oldModels
+	})
+
+	apiKey = "test-key"
+	SetGroqClient(server.Client(), server.URL)
+}
+
+// A non-streaming chat completion answering with content
+func writeCompletion(w http.ResponseWriter, content string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"choices": [{"index": 0, "message": {"role": "assistant", "content": "` + content + `"}}]}`))
+}
+
+// A streamed chat completion sending each of deltas in turn
+func writeStream(w http.ResponseWriter, deltas ...string) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	for _, d := range deltas {
+		fmt.Fprintf(w, "data: {\"choices\": [{\"delta\": {\"content\": %q}}]}\n\n", d)
+	}
+	fmt.Fprint(w, "data: [DONE]\n\n")
+}
+
+func TestSendChatMessageStreamsTokens(t *testing.T) {
+	useTempContent(t)
+
+	var sawKey string
+	stubGroq(t, func(w http.ResponseWriter, r *http.Request) {
+		sawKey = r.Header.Get("Authorization")
+		writeStream(w, "Never", " gonna", " give", " you up")
+	})
+
+	var tokens []string
+	err := SendChatMessage(context.Background(), "dQw4w9WgXcQ", "what's the chorus?", "model", func(token string) {
+		tokens = append(tokens, token)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"Never", " gonna", " give", " you up"}; !slices.Equal(tokens, want) {
+		t.Errorf("onProgress got %q, want %q", tokens, want)
+	}
+	if sawKey != "Bearer test-key" {
+		t.Errorf("request went out with Authorization %q", sawKey)
+	}
+}
+
+func TestStreamChatCompletionReportsSoFar(t *testing.T) {
+	stubGroq(t, func(w http.ResponseWriter, r *http.Request) {
+		writeStream(w, "# Sum", "mary")
+	})
+
+	var partials []string
+	content, err := streamChatCompletion(context.Background(), GroqSummarizationRequest{Model: "model"}, func(soFar string) {
+		partials = append(partials, soFar)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if content != "# Summary" || !slices.Equal(partials, []string{"# Sum", "# Summary"}) {
+		t.Errorf("content %q, partials %q", content, partials)
+	}
+}
+
+// bufio.Scanner's default limit is 64KB, a single delta can be longer than that
+func TestReadGroqStreamOversizedLine(t *testing.T) {
+	big := strings.Repeat("x", 100*1024)
+	stream := fmt.Sprintf("data: {\"choices\": [{\"delta\": {\"content\": %q}}]}\n\ndata: {\"choices\": [{\"delta\": {\"content\": \"!\"}}]}\n\ndata: [DONE]\n\n", big)
+
+	var got strings.Builder
+	if err := readGroqStream(context.Background(), strings.NewReader(stream), func(delta string) { got.WriteString(delta) }); err != nil {
+		t.Fatal(err)
+	}
+	if got.String() != big+"!" {
+		t.Errorf("got %d bytes of content, want %d", got.Len(), len(big)+1)
+	}
+}
+
+func TestReadGroqStream(t *testing.T) {
+	tests := []struct {
+		name    string
+		stream  string
+		want    string
+		wantErr bool
+	}{
+		{"done ends the stream", "data: {\"choices\": [{\"delta\": {\"content\": \"a\"}}]}\n\ndata: [DONE]\n\ndata: {\"choices\": [{\"delta\": {\"content\": \"b\"}}]}\n\n", "a", false},
+		{"multi-line data is joined", "data: {\"choices\": [{\"delta\":\ndata: {\"content\": \"a\"}}]}\n\n", "a", false},
+		{"comments and malformed events are skipped", ": keepalive\n\ndata: {nope\n\ndata: {\"choices\": [{\"delta\": {\"content\": \"a\"}}]}\n\n", "a", false},
+		{"no trailing blank line", "data: {\"choices\": [{\"delta\": {\"content\": \"a\"}}]}", "a", false},
+		{"error event", "data: {\"choices\": [{\"delta\": {\"content\": \"a\"}}]}\n\ndata: {\"error\": {\"message\": \"overloaded\"}}\n\n", "a", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got strings.Builder
+			err := readGroqStream(context.Background(), strings.NewReader(tt.stream), func(delta string) { got.WriteString(delta) })
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error: %v", err, tt.wantErr)
+			}
+			if got.String() != tt.want {
+				t.Errorf("content = %q, want %q", got.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestChatCompletionErrorShapedResponse(t *testing.T) {
+	stubGroq(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"error": {"message": "model is overloaded", "type": "server_error"}, "choices": []}`))
+	})
+
+	_, err := chatCompletion(context.Background(), GroqSummarizationRequest{Model: "model"})
+	if !errors.Is(err, ErrEmptyCompletion) {
+		t.Fatalf("err = %v, want ErrEmptyCompletion", err)
+	}
+	if !strings.Contains(err.Error(), "model is overloaded") {
+		t.Errorf("error %q doesn't carry Groq's message", err)
+	}
+
+	// Summaries index Choices[0], which must not panic
+	if _, err := extendSummary(context.Background(), "model", "prompt", "section", "", nil); !errors.Is(err, ErrEmptyCompletion) {
+		t.Errorf("extendSummary err = %v, want ErrEmptyCompletion", err)
+	}
+}
+
+func TestStreamChatCompletionEmptyStream(t *testing.T) {
+	stubGroq(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("data: [DONE]\n\n"))
+	})
+
+	if _, err := streamChatCompletion(context.Background(), GroqSummarizationRequest{Model: "model"}, func(string) {}); !errors.Is(err, ErrEmptyCompletion) {
+		t.Errorf("err = %v, want ErrEmptyCompletion", err)
+	}
+}
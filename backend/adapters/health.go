@@ -0,0 +1,82 @@
+package adapters
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+type HealthCheck struct {
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type HealthReport struct {
+	OK     bool                   `json:"ok"`
+	Checks map[string]HealthCheck `json:"checks"`
+}
+
+// Every check here is a hard dependency: if one fails, jobs will fail at some stage
+func CheckHealth(ctx context.Context) HealthReport {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	report := HealthReport{
+		OK: true,
+		Checks: map[string]HealthCheck{
+			"ytdlp":    checkYtdlp(ctx),
+			"ffmpeg":   checkOnPath("ffmpeg"),
+			"ffprobe":  checkOnPath("ffprobe"),
+			"groq_key": checkAPIKey(),
+			"groq_api": checkGroqReachable(ctx),
+		},
+	}
+
+	for _, c := range report.Checks {
+		if !c.OK {
+			report.OK = false
+		}
+	}
+
+	return report
+}
+
+func checkYtdlp(ctx context.Context) HealthCheck {
+	out, err := exec.CommandContext(ctx, ytdlpBinPath, "--version").Output()
+	if err != nil {
+		return HealthCheck{Detail: fmt.Sprintf("running %q: %s", ytdlpBinPath, err)}
+	}
+	return HealthCheck{OK: true, Detail: strings.TrimSpace(string(out))}
+}
+
+func checkOnPath(bin string) HealthCheck {
+	path, err := exec.LookPath(bin)
+	if err != nil {
+		return HealthCheck{Detail: err.Error()}
+	}
+	return HealthCheck{OK: true, Detail: path}
+}
+
+func checkAPIKey() HealthCheck {
+	if apiKey == "" {
+		return HealthCheck{Detail: "GROQ_API_KEY is not set"}
+	}
+	return HealthCheck{OK: true}
+}
+
+// Listing models is the cheapest authenticated call Groq has
+func checkGroqReachable(ctx context.Context) HealthCheck {
+	response, err := ListModels(ctx)
+	if err != nil {
+		return HealthCheck{Detail: err.Error()}
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return HealthCheck{Detail: fmt.Sprintf("%s returned %s", groqModelsUrl, response.Status)}
+	}
+	return HealthCheck{OK: true}
+}
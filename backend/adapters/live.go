@@ -0,0 +1,117 @@
+package adapters
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go-yt-sum/job"
+)
+
+// The job is failed with status rejected_live instead of failed when DownloadVideo returns this
+var ErrStillLive = errors.New("video is a livestream that hasn't ended")
+
+// Under the wait policy DownloadVideo returns this for a stream that hasn't ended yet. The job isn't failed: the
+// pipeline sends it back to the download stage after LiveStreamPollInterval, which checks again
+var ErrStreamNotEnded = errors.New("video is a livestream that hasn't ended yet, checking again later")
+
+var (
+	// What happens to a video whose stream hasn't ended: "reject" fails the job straight away, "wait" checks
+	// again every LiveStreamPollInterval until it has, for up to LiveStreamMaxWait. From LIVE_STREAM_POLICY
+	LiveStreamPolicy = "reject"
+	// From LIVE_STREAM_POLL_SECONDS
+	LiveStreamPollInterval = 5 * time.Minute
+	// From LIVE_STREAM_MAX_WAIT_SECONDS
+	LiveStreamMaxWait = 12 * time.Hour
+)
+
+var LiveStreamPolicies = []string{"reject", "wait"}
+
+// yt-dlp's live_status for the info.json. Older yt-dlp versions and some extractors only set is_live and was_live,
+// so those stand in when it's missing
+func parseLiveStatus(data []byte) (string, error) {
+	var info struct {
+		LiveStatus string `json:"live_status"`
+		IsLive     *bool  `json:"is_live"`
+		WasLive    *bool  `json:"was_live"`
+	}
+
+	if err := json.Unmarshal(data, &info); err != nil {
+		return "", err
+	}
+
+	switch {
+	case info.LiveStatus != "":
+		return info.LiveStatus, nil
+	case info.IsLive != nil && *info.IsLive:
+		return "is_live", nil
+	case info.WasLive != nil && *info.WasLive:
+		return "was_live", nil
+	}
+	return "not_live", nil
+}
+
+// Streams that are on air, haven't started, or ended so recently that the VOD is still being processed have no
+// fixed length yet, and their audio comes out truncated or broken. Empty when the video can be downloaded
+func unfinishedStreamReason(liveStatus string) string {
+	switch liveStatus {
+	case "is_live":
+		return "still live"
+	case "is_upcoming":
+		return "a stream that hasn't started"
+	case "post_live":
+		return "a stream that ended too recently for its recording to be ready"
+	}
+	return ""
+}
+
+func readLiveStatus(videoID string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(Paths.Downloads, fmt.Sprintf("%s.info.json", videoID)))
+	if err != nil {
+		return "", fmt.Errorf("read info.json: %w", err)
+	}
+	return parseLiveStatus(data)
+}
+
+// Checks the video's info.json for a stream that hasn't ended. Under the reject policy that's ErrStillLive straight
+// away. Under the wait policy it's ErrStreamNotEnded, and the job stays in waiting_for_stream, until the stream has
+// ended or LiveStreamMaxWait has passed since the first check found it unfinished
+func checkStreamEnded(videoID string, progress func(func(j *job.SummaryJob))) error {
+	liveStatus, err := readLiveStatus(videoID)
+	if err != nil {
+		return err
+	}
+
+	reason := unfinishedStreamReason(liveStatus)
+	if reason == "" {
+		progress(func(j *job.SummaryJob) {
+			if j.Status == "waiting_for_stream" {
+				j.Status = "checking_for_captions"
+			}
+		})
+		return nil
+	}
+	if LiveStreamPolicy != "wait" {
+		return fmt.Errorf("%w: %s is %s", ErrStillLive, videoID, reason)
+	}
+
+	var since time.Time
+	progress(func(j *job.SummaryJob) {
+		if j.Progress.StreamWaitStartedAt.IsZero() {
+			j.Progress.StreamWaitStartedAt = time.Now()
+		}
+		since = j.Progress.StreamWaitStartedAt
+		j.Status = "waiting_for_stream"
+	})
+
+	if time.Since(since) > LiveStreamMaxWait {
+		return fmt.Errorf("%w: %s is still %s after waiting %s", ErrStillLive, videoID, reason, LiveStreamMaxWait)
+	}
+
+	Logger.Info("video is an unfinished stream, waiting for it to end", "video_id", videoID, "stage", "download",
+		"live_status", liveStatus, "poll_interval", LiveStreamPollInterval, "max_wait", LiveStreamMaxWait)
+	return fmt.Errorf("%w: %s is %s", ErrStreamNotEnded, videoID, reason)
+}
@@ -0,0 +1,90 @@
+package adapters
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go-yt-sum/job"
+)
+
+func TestParseLiveStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		info string
+		want string
+	}{
+		{"live_status wins", `{"live_status": "is_upcoming", "is_live": false}`, "is_upcoming"},
+		{"ended stream", `{"live_status": "was_live"}`, "was_live"},
+		{"recording still processing", `{"live_status": "post_live"}`, "post_live"},
+		{"is_live without live_status", `{"is_live": true, "was_live": false}`, "is_live"},
+		{"was_live without live_status", `{"is_live": false, "was_live": true}`, "was_live"},
+		{"is_live false", `{"is_live": false}`, "not_live"},
+		{"no live fields", `{"title": "A regular upload", "duration": 212}`, "not_live"},
+		{"null is_live", `{"is_live": null}`, "not_live"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseLiveStatus([]byte(tt.info))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("parseLiveStatus(%s) = %q, want %q", tt.info, got, tt.want)
+			}
+		})
+	}
+
+	if _, err := parseLiveStatus([]byte(`{"is_live": `)); err == nil {
+		t.Error("expected an error for truncated JSON")
+	}
+}
+
+func TestCheckStreamEndedWaitPolicy(t *testing.T) {
+	oldDownloads, oldPolicy, oldMaxWait := Paths.Downloads, LiveStreamPolicy, LiveStreamMaxWait
+	defer func() { Paths.Downloads, LiveStreamPolicy, LiveStreamMaxWait = oldDownloads, oldPolicy, oldMaxWait }()
+
+	Paths.Downloads = t.TempDir()
+	LiveStreamPolicy = "wait"
+	LiveStreamMaxWait = time.Hour
+
+	const videoID = "dQw4w9WgXcQ"
+	writeInfo := func(info string) {
+		if err := os.WriteFile(filepath.Join(Paths.Downloads, videoID+".info.json"), []byte(info), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	j := &job.SummaryJob{VideoID: videoID, Status: "checking_for_captions"}
+	progress := func(update func(j *job.SummaryJob)) { update(j) }
+
+	writeInfo(`{"live_status": "is_upcoming"}`)
+	if err := checkStreamEnded(videoID, progress); !errors.Is(err, ErrStreamNotEnded) {
+		t.Fatalf("upcoming stream: got %v, want ErrStreamNotEnded", err)
+	}
+	if j.Status != "waiting_for_stream" || j.Progress.StreamWaitStartedAt.IsZero() {
+		t.Fatalf("job should be waiting_for_stream with a start time, got %q at %v", j.Status, j.Progress.StreamWaitStartedAt)
+	}
+
+	j.Progress.StreamWaitStartedAt = time.Now().Add(-2 * time.Hour)
+	if err := checkStreamEnded(videoID, progress); !errors.Is(err, ErrStillLive) {
+		t.Fatalf("stream past LiveStreamMaxWait: got %v, want ErrStillLive", err)
+	}
+
+	writeInfo(`{"live_status": "was_live"}`)
+	if err := checkStreamEnded(videoID, progress); err != nil {
+		t.Fatalf("ended stream: %v", err)
+	}
+	if j.Status != "checking_for_captions" {
+		t.Errorf("status after the stream ended = %q", j.Status)
+	}
+
+	LiveStreamPolicy = "reject"
+	writeInfo(`{"is_live": true}`)
+	if err := checkStreamEnded(videoID, progress); !errors.Is(err, ErrStillLive) {
+		t.Errorf("reject policy: got %v, want ErrStillLive", err)
+	}
+}
@@ -0,0 +1,82 @@
+package adapters
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var atxHeading = regexp.MustCompile(`^ {0,3}(#{1,6})[ \t]+(.*?)(?:[ \t]+#+)?[ \t]*$`)
+
+type heading struct {
+	line  int
+	level int
+	text  string
+}
+
+// Fixes the heading hierarchy models sometimes produce: the first heading becomes the only # title, and no
+// heading is more than one level deeper than the one it sits under, so `#` then `###` becomes `#` then `##`.
+// Headings inside fenced code blocks are left alone.
+func NormalizeHeadings(md string) string {
+	lines := strings.Split(md, "\n")
+	headings := findHeadings(lines)
+	if len(headings) == 0 {
+		return md
+	}
+
+	// Original levels of the headings currently "open" above the one being looked at, and what they were renumbered to
+	var origStack, newStack []int
+
+	for i, h := range headings {
+		level := 0
+
+		if i == 0 {
+			level = 1
+		} else {
+			for len(origStack) > 0 && origStack[len(origStack)-1] >= h.level {
+				origStack = origStack[:len(origStack)-1]
+				newStack = newStack[:len(newStack)-1]
+			}
+
+			// Anything not nested under another section sits directly under the title
+			level = 2
+			if len(newStack) > 0 {
+				level = min(newStack[len(newStack)-1]+1, 6)
+			}
+
+			origStack = append(origStack, h.level)
+			newStack = append(newStack, level)
+		}
+
+		lines[h.line] = fmt.Sprintf("%s %s", strings.Repeat("#", level), h.text)
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func findHeadings(lines []string) []heading {
+	headings := make([]heading, 0)
+	fence := ""
+
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+
+		if fence != "" {
+			if strings.HasPrefix(trimmed, fence) {
+				fence = ""
+			}
+			continue
+		}
+
+		if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+			fence = trimmed[:3]
+			continue
+		}
+
+		if m := atxHeading.FindStringSubmatch(line); m != nil {
+			headings = append(headings, heading{line: i, level: len(m[1]), text: m[2]})
+		}
+	}
+
+	return headings
+}
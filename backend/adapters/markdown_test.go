@@ -0,0 +1,55 @@
+package adapters
+
+import "testing"
+
+func TestNormalizeHeadings(t *testing.T) {
+	tests := []struct {
+		name string
+		md   string
+		want string
+	}{
+		{
+			"skipped level under the title",
+			"# Title\n### A\ntext\n### B",
+			"# Title\n## A\ntext\n## B",
+		},
+		{
+			"first heading becomes the title",
+			"## Intro\n#### Detail\n## Next",
+			"# Intro\n## Detail\n## Next",
+		},
+		{
+			"second title goes under the first",
+			"# A\nintro\n# B",
+			"# A\nintro\n## B",
+		},
+		{
+			"deep jump nests one level down",
+			"# T\n## S\n##### D\n## S2\n### x",
+			"# T\n## S\n### D\n## S2\n### x",
+		},
+		{
+			"closing hashes dropped",
+			"# T ##\n### H ###",
+			"# T\n## H",
+		},
+		{
+			"fenced code left alone",
+			"# T\n```\n### not a heading\n```\n### H",
+			"# T\n```\n### not a heading\n```\n## H",
+		},
+		{
+			"no headings",
+			"just a paragraph\n\n- and a list",
+			"just a paragraph\n\n- and a list",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NormalizeHeadings(tt.md); got != tt.want {
+				t.Errorf("NormalizeHeadings(%q) = %q, want %q", tt.md, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package adapters
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// A change to the on-disk layout of Paths.Root. Migrations must be safe to run again on a layout
+// they've already been applied to, since a crash can land between applying one and recording it
+type migration struct {
+	name  string
+	apply func() error
+}
+
+// In order. Migration i brings the layout from version i to version i+1, so never reorder or remove entries, only append
+var migrations = []migration{
+	{name: "archive existing summaries as version 1", apply: seedSummaryVersions},
+}
+
+// The version of the layout on disk. Content from before versioning has no marker and is version 0
+func readLayoutVersion() (int, error) {
+	data, err := os.ReadFile(Paths.Version)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	v, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, fmt.Errorf("%s is corrupt: %w", Paths.Version, err)
+	}
+	return v, nil
+}
+
+func writeLayoutVersion(v int) error {
+	tmp := Paths.Version + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.Itoa(v)), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, Paths.Version)
+}
+
+// Brings Paths.Root up to the layout this build expects, recording progress after each step.
+// Refuses to start on a layout newer than it knows, rather than misreading it
+func RunMigrations() error {
+	if err := os.MkdirAll(Paths.Root, 0o755); err != nil {
+		return err
+	}
+
+	current, err := readLayoutVersion()
+	if err != nil {
+		return err
+	}
+
+	if current > len(migrations) {
+		return fmt.Errorf("content layout is version %d but this build only knows up to %d, refusing to touch it", current, len(migrations))
+	}
+
+	for v := current; v < len(migrations); v++ {
+		m := migrations[v]
+		Logger.Info("migrating content layout", "version", v+1, "migration", m.name)
+
+		if err := m.apply(); err != nil {
+			return fmt.Errorf("migration to version %d (%s) failed: %w", v+1, m.name, err)
+		}
+		if err := writeLayoutVersion(v + 1); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Summaries written before versioning existed have no history, so there's nothing to diff them against
+func seedSummaryVersions() error {
+	entries, err := os.ReadDir(Paths.Summaries)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".md") {
+			continue
+		}
+		videoID := strings.TrimSuffix(e.Name(), ".md")
+
+		latest, err := LatestSummaryVersion(videoID)
+		if err != nil {
+			return err
+		}
+		if latest > 0 {
+			continue
+		}
+
+		summary, err := os.ReadFile(filepath.Join(Paths.Summaries, e.Name()))
+		if err != nil {
+			return err
+		}
+		if err := saveSummaryVersion(videoID, string(summary)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
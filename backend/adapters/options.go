@@ -0,0 +1,196 @@
+package adapters
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+
+	"go-yt-sum/job"
+)
+
+// Models a request may pick for transcription. Summarization and chat models are allowed if they're in ModelTokenLimits,
+// since those are the only ones we know how to chunk for.
+var AllowedTranscriptionModels = []string{
+	"whisper-large-v3",
+	"whisper-large-v3-turbo",
+}
+
+var videoIDRe = regexp.MustCompile(`^[A-Za-z0-9_-]{11}$`)
+
+var languageRe = regexp.MustCompile(`^[a-z]{2}$`)
+
+// Video IDs end up in file paths and yt-dlp URLs, so only canonical 11 character YouTube IDs get through
+func ValidateVideoID(videoID string) bool {
+	return videoIDRe.MatchString(videoID)
+}
+
+func IsAllowedChatModel(model string) bool {
+	_, ok := ModelTokenLimits[model]
+	return ok
+}
+
+func IsAllowedTranscriptionModel(model string) bool {
+	return slices.Contains(AllowedTranscriptionModels, model)
+}
+
+// Rejects per-request overrides we don't support, so arbitrary strings never reach Groq
+func ValidateJobOptions(opts job.JobOptions) error {
+	if opts.SummarizationModel != "" && !IsAllowedChatModel(opts.SummarizationModel) {
+		return fmt.Errorf("summarization model %q is not allowed", opts.SummarizationModel)
+	}
+
+	if opts.TranscriptionModel != "" && !IsAllowedTranscriptionModel(opts.TranscriptionModel) {
+		return fmt.Errorf("transcription model %q is not allowed", opts.TranscriptionModel)
+	}
+
+	if opts.Language != "" && opts.Language != "auto" && !languageRe.MatchString(opts.Language) {
+		return fmt.Errorf("language %q must be a two letter ISO 639-1 code or auto", opts.Language)
+	}
+
+	if _, ok := SummaryStyles[opts.Style]; opts.Style != "" && !ok {
+		return fmt.Errorf("unknown summary style %q", opts.Style)
+	}
+
+	if _, ok := SummaryLengths[opts.Length]; opts.Length != "" && !ok {
+		return fmt.Errorf("summary length %q must be short, medium or long", opts.Length)
+	}
+
+	if opts.StartSeconds < 0 || opts.EndSeconds < 0 {
+		return fmt.Errorf("start_seconds and end_seconds can't be negative")
+	}
+	if opts.EndSeconds > 0 && opts.StartSeconds >= opts.EndSeconds {
+		return fmt.Errorf("start_seconds must be before end_seconds")
+	}
+
+	if err := ValidateSections(opts.Sections); err != nil {
+		return err
+	}
+
+	if err := ValidateBlurbKinds(opts.Blurbs); err != nil {
+		return err
+	}
+
+	if opts.WebhookURL != "" {
+		u, err := url.Parse(opts.WebhookURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("webhook url %q must be an absolute http(s) url", opts.WebhookURL)
+		}
+	}
+
+	return nil
+}
+
+// Limits on requested sections, so they stay headings rather than a second prompt
+const (
+	maxSections      = 12
+	maxSectionLength = 60
+)
+
+func ValidateSections(sections []string) error {
+	if len(sections) > maxSections {
+		return fmt.Errorf("at most %d sections can be requested", maxSections)
+	}
+
+	seen := make(map[string]bool)
+	for _, s := range sections {
+		title := strings.TrimSpace(s)
+
+		if title == "" {
+			return fmt.Errorf("section titles can't be empty")
+		}
+		if len(title) > maxSectionLength {
+			return fmt.Errorf("section %q is longer than %d characters", title, maxSectionLength)
+		}
+		if strings.ContainsAny(title, "\r\n#") {
+			return fmt.Errorf("section %q can't contain newlines or #", title)
+		}
+		if seen[strings.ToLower(title)] {
+			return fmt.Errorf("section %q is requested twice", title)
+		}
+		seen[strings.ToLower(title)] = true
+	}
+
+	return nil
+}
+
+// Tells the model to use exactly the requested sections. Empty when none were requested
+func sectionsPrompt(sections []string) string {
+	if len(sections) == 0 {
+		return ""
+	}
+
+	titles := make([]string, len(sections))
+	for i, s := range sections {
+		titles[i] = fmt.Sprintf("%d. %s", i+1, strings.TrimSpace(s))
+	}
+
+	return " Ignore any other instructions about structure. Start with a single # title for the video, then write exactly these sections, in this order, each as a ## heading with exactly this title, and no other sections: " + strings.Join(titles, " ")
+}
+
+func languageFor(opts job.JobOptions) string {
+	if opts.Language != "" {
+		return opts.Language
+	}
+	return "en"
+}
+
+// yt-dlp subtitle languages to ask for. For auto, only the captions in the video's original language
+func subLangsFor(opts job.JobOptions) string {
+	lang := languageFor(opts)
+	if lang == "auto" {
+		return ".*-orig"
+	}
+	return fmt.Sprintf("%s,%s.*", lang, lang)
+}
+
+// English summaries are what the prompts ask for anyway
+func languagePrompt(opts job.JobOptions) string {
+	switch lang := languageFor(opts); lang {
+	case "en":
+		return ""
+	case "auto":
+		return " Write the summary in the same language as the transcript."
+	default:
+		return fmt.Sprintf(" Write the summary in the language with ISO 639-1 code %q, whatever language the transcript is in.", lang)
+	}
+}
+
+func webhookURLFor(opts job.JobOptions) string {
+	if opts.WebhookURL != "" {
+		return opts.WebhookURL
+	}
+	return WebhookURL
+}
+
+func summaryPromptFor(opts job.JobOptions) string {
+	if prompt, ok := SummaryStyles[opts.Style]; ok {
+		return prompt
+	}
+	if prompt, ok := SummaryStyles[DefaultSummaryStyle]; ok {
+		return prompt
+	}
+	return systemPrompt
+}
+
+func summaryLengthFor(opts job.JobOptions) summaryLength {
+	if length, ok := SummaryLengths[opts.Length]; ok {
+		return length
+	}
+	return SummaryLengths["medium"]
+}
+
+func summarizationModelFor(opts job.JobOptions) string {
+	if opts.SummarizationModel != "" {
+		return opts.SummarizationModel
+	}
+	return GetSummarizationModel()
+}
+
+func transcriptionModelFor(opts job.JobOptions) string {
+	if opts.TranscriptionModel != "" {
+		return opts.TranscriptionModel
+	}
+	return GetTranscriptionModel()
+}
@@ -0,0 +1,54 @@
+package adapters
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/lrstanley/go-ytdlp"
+)
+
+// Titles YouTube gives entries we can't download. They still show up in a flat playlist listing
+var unavailablePlaylistTitles = []string{"[Private video]", "[Deleted video]", "[Unavailable video]"}
+
+// Lists the IDs of every video in a playlist without downloading anything.
+// Private, deleted and otherwise unavailable entries are skipped, and duplicates are removed.
+func ListPlaylistVideoIDs(playlistID string) ([]string, error) {
+	dl := ytdlp.New().
+		FlatPlaylist().
+		IgnoreErrors().
+		NoWarnings().
+		Print("%(id)s\t%(title)s").
+		SetExecutable(ytdlpBinPath)
+
+	result, err := withNetworkOptions(dl).Run(context.Background(), fmt.Sprintf("https://www.youtube.com/playlist?list=%s", playlistID))
+
+	// With IgnoreErrors a bad entry still makes yt-dlp exit non-zero, so only fail if nothing came back at all
+	if err != nil && (result == nil || strings.TrimSpace(result.Stdout) == "") {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	ids := make([]string, 0)
+
+	for _, line := range strings.Split(result.Stdout, "\n") {
+		id, title, _ := strings.Cut(strings.TrimSpace(line), "\t")
+		if id == "" || id == "NA" || seen[id] || isUnavailableTitle(title) {
+			continue
+		}
+
+		seen[id] = true
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+func isUnavailableTitle(title string) bool {
+	for _, t := range unavailablePlaylistTitles {
+		if title == t {
+			return true
+		}
+	}
+	return false
+}
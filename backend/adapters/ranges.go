@@ -0,0 +1,76 @@
+package adapters
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strconv"
+
+	"go-yt-sum/job"
+)
+
+var ErrRangeOutsideVideo = errors.New("time range is outside the video")
+
+// Range summaries live apart from the full summary, as <Paths.Summaries>/ranges/<videoID>/<start>-<end>.md,
+// so a video can have both. They get no versions, cache key or blurbs
+func rangeSummaryDir(videoID string) string {
+	return filepath.Join(Paths.Summaries, "ranges", videoID)
+}
+
+// An end of 0 is the end of the video
+func RangeSummaryPath(videoID string, start float64, end float64) string {
+	return filepath.Join(rangeSummaryDir(videoID), rangeName(start, end)+".md")
+}
+
+func rangeName(start float64, end float64) string {
+	if end <= 0 {
+		return fmt.Sprintf("%g-end", start)
+	}
+	return fmt.Sprintf("%g-%g", start, end)
+}
+
+// Where the job's summary is written: the full summary, or the one for its range
+func summaryPathFor(videoID string, opts job.JobOptions) string {
+	if opts.HasRange() {
+		return RangeSummaryPath(videoID, opts.StartSeconds, opts.EndSeconds)
+	}
+	return fmt.Sprintf("%s/%s.md", Paths.Summaries, videoID)
+}
+
+// Link to a range summary, for webhook payloads
+func RangeSummaryURL(videoID string, start float64, end float64) string {
+	q := url.Values{}
+	q.Set("start_seconds", strconv.FormatFloat(start, 'f', -1, 64))
+	if end > 0 {
+		q.Set("end_seconds", strconv.FormatFloat(end, 'f', -1, 64))
+	}
+	return fmt.Sprintf("%s/summaries/%s?%s", PublicURL, videoID, q.Encode())
+}
+
+// Checks the job's range against a video of the given length in seconds. A length of 0 is unknown, and lets any range through
+func ValidateRange(opts job.JobOptions, length float64) error {
+	if !opts.HasRange() || length <= 0 {
+		return nil
+	}
+
+	if opts.StartSeconds >= length {
+		return fmt.Errorf("%w: it starts at %s but the video is %s long", ErrRangeOutsideVideo, fmtHMS(int64(opts.StartSeconds)), fmtHMS(int64(length)))
+	}
+	if opts.EndSeconds > length {
+		return fmt.Errorf("%w: it ends at %s but the video is %s long", ErrRangeOutsideVideo, fmtHMS(int64(opts.EndSeconds)), fmtHMS(int64(length)))
+	}
+	return nil
+}
+
+// The segments that overlap [start, end). An end of 0 keeps everything from start on
+func segmentsInRange(script []Segment, start float64, end float64) []Segment {
+	out := make([]Segment, 0, len(script))
+	for _, s := range script {
+		if s.End <= start || (end > 0 && s.Start >= end) {
+			continue
+		}
+		out = append(out, s)
+	}
+	return out
+}
@@ -0,0 +1,27 @@
+package adapters
+
+import (
+	"bytes"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+)
+
+var (
+	// Summaries use GFM tables and strikethrough now and then
+	markdown = goldmark.New(goldmark.WithExtensions(extension.GFM))
+
+	// Summaries are written by an LLM that has read an untrusted transcript, so the rendered HTML is treated
+	// like user content: formatting and links survive, scripts, styles and event handlers don't
+	htmlPolicy = bluemonday.UGCPolicy()
+)
+
+// Renders a summary's markdown to an HTML fragment that's safe to put straight into a page
+func RenderSummaryHTML(summary string) (string, error) {
+	var buf bytes.Buffer
+	if err := markdown.Convert([]byte(summary), &buf); err != nil {
+		return "", err
+	}
+	return htmlPolicy.Sanitize(buf.String()), nil
+}
@@ -0,0 +1,161 @@
+package adapters
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"time"
+)
+
+var (
+	// How many times a yt-dlp invocation is retried after a transient failure. 0 disables retries
+	DownloadRetries = 3
+	// Wait before the first retry. Doubles on every attempt after that
+	DownloadRetryBackoff = 2 * time.Second
+	// Each wait is moved by up to this fraction of itself either way, so jobs that failed together don't all retry together
+	DownloadRetryJitter = 0.5
+
+	// Longest a single Groq call waits out 429s in total before giving up, e.g. on an exhausted daily quota.
+	// From RATE_LIMIT_MAX_WAIT_SECONDS
+	RateLimitMaxWait = 2 * time.Minute
+	// Wait after a 429 that didn't say how long to wait. Doubles on every one after that
+	RateLimitBackoff = 5 * time.Second
+)
+
+// yt-dlp output that means retrying won't help
+var permanentDownloadErrors = []string{
+	"private video",
+	"video unavailable",
+	"has been removed",
+	"account associated with this video has been terminated",
+	"sign in to confirm your age",
+	"not available in your country",
+	"members-only",
+	"copyright",
+	"unsupported url",
+}
+
+// yt-dlp output for failures that usually go away on their own (YouTube rotating, throttling, flaky network)
+var transientDownloadErrors = []string{
+	"http error 403",
+	"http error 429",
+	"http error 500",
+	"http error 502",
+	"http error 503",
+	"http error 504",
+	"timed out",
+	"connection reset",
+	"connection refused",
+	"remote end closed",
+	"temporary failure in name resolution",
+	"network is unreachable",
+	"incompleteread",
+}
+
+// Only errors we recognise as transient are retried, anything unknown fails straight away
+func IsTransientDownloadError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	msg := strings.ToLower(err.Error())
+
+	for _, s := range permanentDownloadErrors {
+		if strings.Contains(msg, s) {
+			return false
+		}
+	}
+
+	for _, s := range transientDownloadErrors {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Groq rate limits and 5xx responses, and network failures talking to it. Worth rerunning the whole stage for
+func IsTransientHTTPError(err error) bool {
+	var apiErr *GroqAPIError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode == 429 || apiErr.StatusCode >= 500
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// Calls run until it succeeds, fails permanently, or runs out of retries, backing off between attempts.
+// A non-nil onRetry is told the attempt about to start and how many there are in total, counting from 1.
+// Cancelling ctx stops immediately and returns ctx.Err()
+func retryDownload(ctx context.Context, videoID string, run func() error, onRetry func(attempt int, attempts int)) error {
+	for attempt := 0; ; attempt++ {
+		err := run()
+
+		// yt-dlp gets killed on cancel, report that rather than whatever exit error it produced
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if err == nil || attempt >= DownloadRetries || !IsTransientDownloadError(err) {
+			return err
+		}
+
+		wait := withJitter(DownloadRetryBackoff<<attempt, DownloadRetryJitter)
+		Logger.Warn("download failed, retrying", "video_id", videoID, "stage", "download",
+			"attempt", attempt+1, "attempts", DownloadRetries+1, "retry_in", wait, "error", err)
+
+		if onRetry != nil {
+			onRetry(attempt+2, DownloadRetries+1)
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// d moved by a random amount of up to fraction*d either way
+func withJitter(d time.Duration, fraction float64) time.Duration {
+	fraction = min(max(fraction, 0), 1)
+	return time.Duration(float64(d) * (1 + fraction*(2*rand.Float64()-1)))
+}
+
+// Calls call again after every 429, waiting as long as Groq asks, until it stops being rate limited or the waits would
+// add up to more than RateLimitMaxWait. Only the call that was refused is repeated, so work done before it isn't paid
+// for twice. Cancelling ctx stops immediately and returns ctx.Err()
+func waitOutRateLimits(ctx context.Context, call func() error) error {
+	var waited time.Duration
+
+	for attempt := 0; ; attempt++ {
+		err := call()
+
+		var rateLimited *RateLimitError
+		if !errors.As(err, &rateLimited) {
+			return err
+		}
+
+		wait := rateLimited.RetryAfter
+		if wait <= 0 {
+			wait = RateLimitBackoff << attempt
+		}
+		if waited+wait > RateLimitMaxWait {
+			return fmt.Errorf("still rate limited after waiting %s: %w", waited, err)
+		}
+		waited += wait
+
+		Logger.Warn("rate limited by groq, waiting", "retry_in", wait, "waited", waited, "max_wait", RateLimitMaxWait)
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package adapters
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestExtendSummaryWaitsOutRateLimits(t *testing.T) {
+	oldBackoff := RateLimitBackoff
+	RateLimitBackoff = time.Millisecond
+	defer func() { RateLimitBackoff = oldBackoff }()
+
+	var calls atomic.Int32
+	stubGroq(t, func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) <= 2 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"error": {"message": "rate limit reached", "type": "tokens"}}`))
+			return
+		}
+		writeCompletion(w, "the summary")
+	})
+
+	summary, err := extendSummary(context.Background(), "model", "prompt", "section", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *summary != "the summary" {
+		t.Errorf("summary = %q", *summary)
+	}
+	if calls.Load() != 3 {
+		t.Errorf("groq was called %d times, want 3", calls.Load())
+	}
+}
+
+func TestWaitOutRateLimitsGivesUp(t *testing.T) {
+	oldMaxWait := RateLimitMaxWait
+	RateLimitMaxWait = 10 * time.Second
+	defer func() { RateLimitMaxWait = oldMaxWait }()
+
+	var calls atomic.Int32
+	stubGroq(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		// Longer than RateLimitMaxWait, e.g. a daily quota
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+
+	start := time.Now()
+	_, err := extendSummary(context.Background(), "model", "prompt", "section", "", nil)
+
+	var rateLimited *RateLimitError
+	if !errors.As(err, &rateLimited) {
+		t.Fatalf("expected a RateLimitError, got %v", err)
+	}
+	if !IsTransientHTTPError(err) {
+		t.Error("the error should still be transient, so the stage's attempts decide what happens next")
+	}
+	if calls.Load() != 1 || time.Since(start) > time.Second {
+		t.Errorf("gave up after %d calls and %s, want 1 call and no wait", calls.Load(), time.Since(start))
+	}
+}
+
+// Shortens the download backoff and takes the jitter out for the length of the test
+func fastDownloadRetries(t *testing.T, retries int) {
+	t.Helper()
+
+	oldRetries, oldBackoff, oldJitter := DownloadRetries, DownloadRetryBackoff, DownloadRetryJitter
+	t.Cleanup(func() {
+		DownloadRetries, DownloadRetryBackoff, DownloadRetryJitter = oldRetries, oldBackoff, oldJitter
+	})
+	DownloadRetries, DownloadRetryBackoff, DownloadRetryJitter = retries, time.Millisecond, 0
+}
+
+func TestRetryDownloadRecoversFromTransientFailure(t *testing.T) {
+	fastDownloadRetries(t, 3)
+
+	calls := 0
+	var retries []int
+	err := retryDownload(context.Background(), "dQw4w9WgXcQ", func() error {
+		calls++
+		if calls <= 2 {
+			return errors.New("ERROR: unable to download video data: HTTP Error 403: Forbidden")
+		}
+		return nil
+	}, func(attempt int, attempts int) {
+		retries = append(retries, attempt)
+	})
+
+	if err != nil {
+		t.Fatalf("err = %v, want success on the third attempt", err)
+	}
+	if calls != 3 {
+		t.Errorf("ran %d times, want 3", calls)
+	}
+	if len(retries) != 2 || retries[0] != 2 || retries[1] != 3 {
+		t.Errorf("onRetry got attempts %v, want [2 3]", retries)
+	}
+}
+
+func TestRetryDownloadFailsPermanentErrorsAtOnce(t *testing.T) {
+	fastDownloadRetries(t, 3)
+
+	calls := 0
+	err := retryDownload(context.Background(), "dQw4w9WgXcQ", func() error {
+		calls++
+		return errors.New("ERROR: [youtube] dQw4w9WgXcQ: Private video. Sign in if you've been granted access")
+	}, nil)
+
+	if err == nil || calls != 1 {
+		t.Errorf("ran %d times with err %v, want one failing attempt", calls, err)
+	}
+}
+
+func TestRetryDownloadGivesUp(t *testing.T) {
+	fastDownloadRetries(t, 2)
+
+	calls := 0
+	err := retryDownload(context.Background(), "dQw4w9WgXcQ", func() error {
+		calls++
+		return errors.New("HTTP Error 429: Too Many Requests")
+	}, nil)
+
+	if err == nil || calls != 3 {
+		t.Errorf("ran %d times with err %v, want 3 failing attempts", calls, err)
+	}
+}
+
+func TestIsTransientDownloadError(t *testing.T) {
+	tests := []struct {
+		msg  string
+		want bool
+	}{
+		{"HTTP Error 403: Forbidden", true},
+		{"read timed out", true},
+		{"Video unavailable. This video has been removed by the uploader", false},
+		{"HTTP Error 403 while fetching a private video", false},
+		// yt-dlp's generic prefix on its own isn't a sign the failure will go away
+		{"ERROR: [youtube] dQw4w9WgXcQ: Unable to download webpage: HTTP Error 404: Not Found", false},
+		{"ERROR: Unable to download webpage: HTTP Error 410: Gone", false},
+		{"ERROR: Unable to download webpage: HTTP Error 503: Service Unavailable", true},
+		{"some error nobody has seen before", false},
+	}
+
+	for _, tt := range tests {
+		if got := IsTransientDownloadError(errors.New(tt.msg)); got != tt.want {
+			t.Errorf("IsTransientDownloadError(%q) = %v, want %v", tt.msg, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package adapters
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"go-yt-sum/db"
+)
+
+// How much a match in each field counts towards a video's rank
+const (
+	titleMatchScore   = 10
+	creatorMatchScore = 5
+	summaryMatchScore = 1
+)
+
+// Case-insensitive substring search over titles and creators, and the summaries too with fullText.
+// Returns the matching videos, best first. Ties are ordered by title
+func SearchVideos(videos map[string]db.VideoEntry, query string, fullText bool) []db.VideoEntry {
+	query = strings.ToLower(strings.TrimSpace(query))
+
+	type scored struct {
+		video db.VideoEntry
+		score int
+	}
+	matches := make([]scored, 0)
+
+	for id, video := range videos {
+		score := 0
+		if strings.Contains(strings.ToLower(video.VideoName), query) {
+			score += titleMatchScore
+		}
+		if strings.Contains(strings.ToLower(video.CreatorName), query) {
+			score += creatorMatchScore
+		}
+		if fullText && summaryContains(id, query) {
+			score += summaryMatchScore
+		}
+
+		if score > 0 {
+			matches = append(matches, scored{video, score})
+		}
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].score != matches[j].score {
+			return matches[i].score > matches[j].score
+		}
+		if matches[i].video.VideoName != matches[j].video.VideoName {
+			return matches[i].video.VideoName < matches[j].video.VideoName
+		}
+		return matches[i].video.VideoID < matches[j].video.VideoID
+	})
+
+	out := make([]db.VideoEntry, len(matches))
+	for i, m := range matches {
+		out[i] = m.video
+	}
+	return out
+}
+
+// query must already be lowercase
+func summaryContains(videoID string, query string) bool {
+	data, err := os.ReadFile(fmt.Sprintf("%s/%s.md", Paths.Summaries, videoID))
+	if err != nil {
+		return false
+	}
+	return strings.Contains(strings.ToLower(string(data)), query)
+}
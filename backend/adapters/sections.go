@@ -0,0 +1,45 @@
+package adapters
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// The sections the full summary was written with, kept next to it so regenerating reuses them even once the job
+// that asked for them is gone
+func summarySectionsPath(videoID string) string {
+	return fmt.Sprintf("%s/%s.sections.json", Paths.Summaries, videoID)
+}
+
+// A summary written without sections removes the file, so regenerating it doesn't bring back older ones
+func saveSummarySections(videoID string, sections []string) error {
+	if len(sections) == 0 {
+		if err := os.Remove(summarySectionsPath(videoID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	data, err := json.Marshal(sections)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(summarySectionsPath(videoID), data, 0644)
+}
+
+// The sections the video's summary was written with. Nil if it was left to pick its own
+func SummarySections(videoID string) []string {
+	data, err := os.ReadFile(summarySectionsPath(videoID))
+	if err != nil {
+		return nil
+	}
+
+	var sections []string
+	if err := json.Unmarshal(data, &sections); err != nil {
+		Logger.Warn("failed to read summary sections", "video_id", videoID, "error", err)
+		return nil
+	}
+	return sections
+}
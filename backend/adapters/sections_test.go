@@ -0,0 +1,41 @@
+package adapters
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"testing"
+
+	"go-yt-sum/job"
+)
+
+func TestSummarizeVideoStoresSections(t *testing.T) {
+	useTempContent(t)
+	stubGroq(t, func(w http.ResponseWriter, r *http.Request) {
+		writeCompletion(w, "# Title\\n\\n## Setup\\n\\n## Results")
+	})
+
+	const videoID = "dQw4w9WgXcQ"
+	segments := make([]Segment, 0)
+	for i := range 60 {
+		segments = append(segments, Segment{Start: float64(i * 5), End: float64(i*5 + 5), Text: "people talking about the setup and then the results"})
+	}
+	writeTestTranscription(t, videoID, segments)
+
+	sections := []string{"Setup", "Results"}
+	update := func(func(j *job.SummaryJob)) {}
+	if err := SummarizeVideo(context.Background(), videoID, job.JobOptions{Sections: sections}, update); err != nil {
+		t.Fatal(err)
+	}
+	if got := SummarySections(videoID); !slices.Equal(got, sections) {
+		t.Fatalf("SummarySections = %q, want %q", got, sections)
+	}
+
+	// Regenerated without sections, the summary goes back to its own structure and forgets the old ones
+	if err := SummarizeVideo(context.Background(), videoID, job.JobOptions{Force: true}, update); err != nil {
+		t.Fatal(err)
+	}
+	if got := SummarySections(videoID); got != nil {
+		t.Errorf("SummarySections after a summary without sections = %q, want nil", got)
+	}
+}
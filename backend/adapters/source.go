@@ -0,0 +1,73 @@
+package adapters
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"go-yt-sum/job"
+)
+
+var ErrInvalidSourceURL = errors.New("url must be an absolute http or https URL")
+
+// Hosts whose URLs carry a YouTube video ID we can use as the job key directly
+var youtubeHosts = map[string]bool{
+	"youtube.com":       true,
+	"www.youtube.com":   true,
+	"m.youtube.com":     true,
+	"music.youtube.com": true,
+	"youtu.be":          true,
+}
+
+// Works out the job key for any URL yt-dlp can download. YouTube URLs use their video ID, so they share jobs and
+// summaries with /summarize/{videoID}, and come back with an empty sourceURL since the ID is all DownloadVideo needs.
+// Anything else is keyed by a hash of the URL, shaped like a YouTube ID so it passes ValidateVideoID and is safe in paths
+func JobKeyForURL(raw string) (videoID string, sourceURL string, err error) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", "", ErrInvalidSourceURL
+	}
+
+	if id := youtubeVideoID(u); id != "" {
+		return id, "", nil
+	}
+
+	sum := sha256.Sum256([]byte(u.String()))
+	return base64.RawURLEncoding.EncodeToString(sum[:])[:11], u.String(), nil
+}
+
+// The video ID in a watch, youtu.be, shorts, embed or live URL. Empty if there isn't a valid one
+func youtubeVideoID(u *url.URL) string {
+	host := strings.ToLower(u.Hostname())
+	if !youtubeHosts[host] {
+		return ""
+	}
+
+	var id string
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+
+	switch {
+	case host == "youtu.be":
+		id = parts[0]
+	case parts[0] == "watch":
+		id = u.Query().Get("v")
+	case len(parts) >= 2 && (parts[0] == "shorts" || parts[0] == "embed" || parts[0] == "live"):
+		id = parts[1]
+	}
+
+	if !ValidateVideoID(id) {
+		return ""
+	}
+	return id
+}
+
+// Where yt-dlp fetches the video from. Jobs without a SourceURL are YouTube videos
+func sourceURLFor(videoID string, opts job.JobOptions) string {
+	if opts.SourceURL != "" {
+		return opts.SourceURL
+	}
+	return fmt.Sprintf("https://www.youtube.com/watch?v=%s", videoID)
+}
@@ -0,0 +1,62 @@
+package adapters
+
+import (
+	"context"
+	"os/exec"
+	"regexp"
+	"strconv"
+)
+
+var (
+	// Drop leading and trailing segments Whisper thinks are probably not speech (intro music, silence, outros)
+	TrimNonSpeech = true
+	// Segments with a no_speech_prob above this count as non-speech when trimming
+	NoSpeechThreshold = 0.6
+
+	// Don't send chunks whose loudest moment is below SilentChunkMaxDB off for transcription at all
+	SkipSilentChunks = false
+	SilentChunkMaxDB = -50.0
+)
+
+// Drops non-speech segments from the start and end of the transcript. Segments in the middle are left alone,
+// a pause mid-video is still part of the video. Captions have no no_speech_prob, so they're never trimmed
+func trimNonSpeech(script []Segment) []Segment {
+	isSpeech := func(s Segment) bool { return s.NoSpeechProb <= NoSpeechThreshold }
+
+	start := 0
+	for start < len(script) && !isSpeech(script[start]) {
+		start++
+	}
+
+	end := len(script)
+	for end > start && !isSpeech(script[end-1]) {
+		end--
+	}
+
+	return script[start:end]
+}
+
+var maxVolumeRe = regexp.MustCompile(`max_volume:\s*(-?[\d.]+|-inf) dB`)
+
+// Whether ffmpeg's volumedetect says the whole file stays under SilentChunkMaxDB.
+// If the file can't be measured it's assumed to have speech, so nothing gets skipped by mistake
+func isSilentChunk(ctx context.Context, filePath string) bool {
+	cmd := exec.CommandContext(ctx, "ffmpeg", "-i", filePath, "-af", "volumedetect", "-f", "null", "-")
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return false
+	}
+
+	m := maxVolumeRe.FindSubmatch(output)
+	if m == nil {
+		return false
+	}
+
+	if string(m[1]) == "-inf" {
+		return true
+	}
+
+	maxDB, err := strconv.ParseFloat(string(m[1]), 64)
+	return err == nil && maxDB < SilentChunkMaxDB
+}
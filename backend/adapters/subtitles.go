@@ -0,0 +1,56 @@
+package adapters
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+)
+
+// Returns an error satisfying os.IsNotExist if the video hasn't been transcribed yet
+func ReadTranscription(videoID string) ([]Segment, error) {
+	data, err := os.ReadFile(fmt.Sprintf("%s/%s.json", Paths.Transcriptions, videoID))
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []Segment
+	if err := json.Unmarshal(data, &segments); err != nil {
+		return nil, err
+	}
+
+	return segments, nil
+}
+
+// Like fmtHMS, but always includes hours and keeps the milliseconds, which subtitle players need.
+// SRT separates the milliseconds with a comma and WebVTT with a dot
+func fmtSubtitleTimestamp(seconds float64, msSep string) string {
+	ms := int64(math.Round(seconds * 1000))
+	if ms < 0 {
+		ms = 0
+	}
+
+	return fmt.Sprintf("%02d:%02d:%02d%s%03d", ms/3_600_000, ms/60_000%60, ms/1000%60, msSep, ms%1000)
+}
+
+func SegmentsToSRT(segments []Segment) string {
+	var sb strings.Builder
+
+	for i, s := range segments {
+		fmt.Fprintf(&sb, "%d\n%s --> %s\n%s\n\n", i+1, fmtSubtitleTimestamp(s.Start, ","), fmtSubtitleTimestamp(s.End, ","), strings.TrimSpace(s.Text))
+	}
+
+	return sb.String()
+}
+
+func SegmentsToVTT(segments []Segment) string {
+	var sb strings.Builder
+	sb.WriteString("WEBVTT\n\n")
+
+	for _, s := range segments {
+		fmt.Fprintf(&sb, "%s --> %s\n%s\n\n", fmtSubtitleTimestamp(s.Start, "."), fmtSubtitleTimestamp(s.End, "."), strings.TrimSpace(s.Text))
+	}
+
+	return sb.String()
+}
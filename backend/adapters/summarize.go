@@ -1,12 +1,13 @@
 package adapters
 
 import (
-	"bytes"
+	"context"
 	"fmt"
+	"go-yt-sum/db"
 	"go-yt-sum/job"
 	"os"
-
-	"net/http"
+	"path/filepath"
+	"strings"
 
 	"encoding/json"
 	"io"
@@ -15,9 +16,32 @@ import (
 
 // ---
 
-// Max tokens to feed into grok in a single summarization step
+// Max tokens to feed into grok in a single summarization step. Models with small context windows get less, see chunkTokenBudget
 var MaxTokens = 30_000
 
+// Tokens of transcript each summary chunk repeats from the end of the one before it, so a thought cut off at a chunk
+// boundary is still whole in one of them. 0 cuts chunks back to back
+var SummaryChunkOverlap = 500
+
+// Context window of each summarization model, in tokens. Overridable with MODEL_TOKEN_LIMITS
+var ModelTokenLimits = map[string]int{
+	"llama-3.3-70b-versatile":                       131_072,
+	"llama-3.1-8b-instant":                          131_072,
+	"meta-llama/llama-4-scout-17b-16e-instruct":     131_072,
+	"meta-llama/llama-4-maverick-17b-128e-instruct": 131_072,
+	"openai/gpt-oss-120b":                           131_072,
+	"openai/gpt-oss-20b":                            131_072,
+	"qwen/qwen3-32b":                                131_072,
+	"moonshotai/kimi-k2-instruct":                   131_072,
+	"gemma2-9b-it":                                  8_192,
+}
+
+// Stream each summary chunk from Groq, so clients see it being written in Progress.PartialSummary. From STREAM_SUMMARIES
+var StreamSummaries = false
+
+// Used for models missing from ModelTokenLimits. Small on purpose: too small costs a few extra calls, too big truncates
+var DefaultModelTokenLimit = 8_192
+
 type Message struct {
 	Content string `json:"content"`
 	Role    string `json:"role"`
@@ -26,6 +50,11 @@ type Message struct {
 type GroqSummarizationRequest struct {
 	Messages []Message `json:"messages"`
 	Model    string    `json:"model"`
+
+	// Set to {"type": "json_object"} to force the response to be a JSON object
+	ResponseFormat map[string]string `json:"response_format,omitempty"`
+
+	Stream bool `json:"stream,omitempty"`
 }
 
 type ResponseMessage struct {
@@ -52,34 +81,138 @@ func fmtHMS(timeSecs int64) string {
 	}
 }
 
-// Takes in all the segments, and outputs a list of 30,000 token formatted timestamped chunks
-func createTranscriptSegments(script []Segment) []string {
-	currentString := ""
+// How many transcript tokens fit in one extendSummary call for the model, up to maxTokens. Half the window is kept
+// free for the running summary and the response, and the prompt comes out of what's left.
+func chunkTokenBudget(model string, prompt string, maxTokens int) int {
+	limit, ok := ModelTokenLimits[model]
+	if !ok {
+		limit = DefaultModelTokenLimit
+	}
+
+	budget := limit/2 - estimateTokens(prompt)
+	return max(min(budget, maxTokens), 1)
+}
+
+// Takes in all the segments, and outputs a list of formatted timestamped chunks of at most maxTokens each.
+// Every chunk after the first starts with the last SummaryChunkOverlap tokens of the one before it, so a thought cut
+// off at the boundary is still whole in one of them
+func createTranscriptSegments(script []Segment, maxTokens int) []string {
+	type line struct {
+		text   string
+		tokens int
+	}
+
+	current := make([]line, 0)
+	currentTokens := 0
+	// Tokens added since the last cut, not counting the overlap carried over from the previous chunk
+	freshTokens := 0
 	out := make([]string, 0)
 
-	for _, segment := range script {
-		currentString += formatSubtitle(float64(segment.Start), float64(segment.End), segment.Text) + "\n"
+	limit := int(float64(maxTokens) * TokenSafetyMargin)
+	// Half the chunk at most, or chunks would be mostly repeats of each other
+	overlap := min(max(SummaryChunkOverlap, 0), limit/2)
+
+	join := func(lines []line) string {
+		var sb strings.Builder
+		for _, l := range lines {
+			sb.WriteString(l.text)
+		}
+		return sb.String()
+	}
 
-		// Assumes 4 chars per token average
-		if len(currentString) > MaxTokens*4 {
-			out = append(out, currentString)
-			currentString = ""
+	for _, segment := range script {
+		formatted := formatTranscriptLine(segment)
+		tokens := estimateTokens(formatted)
+
+		current = append(current, line{formatted, tokens})
+		currentTokens += tokens
+		freshTokens += tokens
+
+		if currentTokens > limit {
+			out = append(out, join(current))
+
+			// Carry the tail over, whole lines only
+			start := len(current)
+			carried := 0
+			for start > 0 && carried+current[start-1].tokens <= overlap {
+				start--
+				carried += current[start].tokens
+			}
+
+			current = append([]line(nil), current[start:]...)
+			currentTokens = carried
+			freshTokens = 0
 		}
 	}
 
-	// Whatever is left, append it
-	out = append(out, currentString)
+	// Whatever is left, unless it's nothing or just the overlap of a chunk that's already out
+	if freshTokens > 0 {
+		out = append(out, join(current))
+	}
 
 	return out
 }
 
-// Takes in a section of the transcript, calls groq to extend the existing summary with the new data
-func extendSummary(newSection string, currentSummary string) (*string, error) {
-	reqBody := &bytes.Buffer{}
+func formatTranscriptLine(segment Segment) string {
+	text := segment.Text
+	if segment.Speaker != "" {
+		text = fmt.Sprintf("%s: %s", segment.Speaker, text)
+	}
+	return formatSubtitle(float64(segment.Start), float64(segment.End), text) + "\n"
+}
+
+// The whole transcript as a single chunk, for videos short enough to summarize in one go
+func formatTranscript(script []Segment) string {
+	var sb strings.Builder
+	for _, segment := range script {
+		sb.WriteString(formatTranscriptLine(segment))
+	}
+	return sb.String()
+}
+
+// True when the transcript is short enough that the regular multi-chunk prompt would just bloat it
+func isShortTranscript(script []Segment) bool {
+	if ShortVideoSeconds <= 0 || len(script) == 0 {
+		return false
+	}
+
+	// Measured from the first segment, so a range of a long video counts by its own length
+	return script[len(script)-1].End-script[0].Start <= float64(ShortVideoSeconds)
+}
+
+func isSparseTranscript(script []Segment) bool {
+	if MinSummarySegments > 0 && len(script) < MinSummarySegments {
+		return true
+	}
+
+	words := 0
+	for _, s := range script {
+		words += len(strings.Fields(s.Text))
+	}
+
+	return MinSummaryWords > 0 && words < MinSummaryWords
+}
+
+// Stands in for a summary when there's too little said to summarize
+func sparseTranscriptSummary(script []Segment) string {
+	var sb strings.Builder
+	sb.WriteString("_Too little was said in this video to summarize. Here is the full transcript:_\n\n")
+
+	for _, s := range script {
+		sb.WriteString(formatSubtitle(s.Start, s.End, strings.TrimSpace(s.Text)))
+		sb.WriteString("\n\n")
+	}
+
+	return sb.String()
+}
+
+// Takes in a section of the transcript, calls groq to extend the existing summary with the new data.
+// A non-nil onPartial streams the response, and is called with the new summary as it's generated
+func extendSummary(ctx context.Context, model string, prompt string, newSection string, currentSummary string, onPartial func(soFar string)) (*string, error) {
 	reqData := GroqSummarizationRequest{
 		Messages: []Message{
 			{
-				Content: systemPrompt,
+				Content: prompt,
 				Role:    "system",
 			},
 			{
@@ -91,44 +224,129 @@ func extendSummary(newSection string, currentSummary string) (*string, error) {
 				Role:    "user",
 			},
 		},
-		Model: GetSummarizationModel(),
+		Model: model,
 	}
 
-	writer := json.NewEncoder(reqBody)
-	if err := writer.Encode(reqData); err != nil {
+	return summaryCompletion(ctx, reqData, onPartial)
+}
+
+// Sends a summary request, streaming it to a non-nil onPartial. 429s are waited out and the request sent again,
+// see waitOutRateLimits
+func summaryCompletion(ctx context.Context, reqData GroqSummarizationRequest, onPartial func(soFar string)) (*string, error) {
+	var content string
+
+	err := waitOutRateLimits(ctx, func() error {
+		if onPartial != nil {
+			streamed, err := streamChatCompletion(ctx, reqData, onPartial)
+			content = streamed
+			return err
+		}
+
+		responseData, err := chatCompletion(ctx, reqData)
+		if err != nil {
+			return err
+		}
+		content = responseData.Choices[0].Message.Content
+		return nil
+	})
+	if err != nil {
 		return nil, err
 	}
 
-	request, _ := http.NewRequest("POST", groqSummarizationUrl, reqBody)
+	return &content, nil
+}
+
+// Rewrites a summary into a shorter one covering the same video. prompt is appended to condenseSummaryPrompt,
+// for the language and sections the summary was written to. onPartial works as for extendSummary
+func condenseSummary(ctx context.Context, model string, prompt string, summary string, onPartial func(soFar string)) (*string, error) {
+	reqData := GroqSummarizationRequest{
+		Messages: []Message{
+			{
+				Content: condenseSummaryPrompt + prompt,
+				Role:    "system",
+			},
+			{
+				Content: fmt.Sprintf("Here is the summary to condense: %s", summary),
+				Role:    "user",
+			},
+		},
+		Model: model,
+	}
+
+	return summaryCompletion(ctx, reqData, onPartial)
+}
 
-	request.Header.Add("Authorization", fmt.Sprintf("Bearer %s", apiKey))
-	request.Header.Add("Content-Type", "application/json")
+// How many times a section can be halved after overflowing the context window before we give up
+var maxResplitDepth = 6
 
-	client := &http.Client{}
-	response, err := client.Do(request)
-	if err != nil {
+// Like extendSummary, but when the section plus the running summary turns out too big for the model,
+// the section is split in half by lines and each half is folded into the summary in turn
+func extendSummaryResplitting(ctx context.Context, model string, prompt string, section string, currentSummary string, onPartial func(soFar string), depth int) (*string, error) {
+	newSummary, err := extendSummary(ctx, model, prompt, section, currentSummary, onPartial)
+	if err == nil || !isContextLengthExceeded(err) {
+		return newSummary, err
+	}
+
+	lines := strings.SplitAfter(strings.TrimSuffix(section, "\n"), "\n")
+	if depth >= maxResplitDepth || len(lines) < 2 {
 		return nil, err
 	}
-	defer response.Body.Close()
 
-	rawResponseData, err := io.ReadAll(response.Body)
+	Logger.Info("section exceeded the context window, splitting it in half", "stage", "summarize", "lines", len(lines), "model", model)
+
+	half := len(lines) / 2
+	firstHalf, err := extendSummaryResplitting(ctx, model, prompt, strings.Join(lines[:half], ""), currentSummary, onPartial, depth+1)
 	if err != nil {
 		return nil, err
 	}
-	var responseData GroqSummarizationResponse
 
-	if err := json.Unmarshal(rawResponseData, &responseData); err != nil {
-		return nil, err
+	return extendSummaryResplitting(ctx, model, prompt, strings.Join(lines[half:], ""), *firstHalf, onPartial, depth+1)
+}
+
+// The Groq calls a summary takes: the model, the system prompt, and the transcript chunks fed to extendSummary
+type summaryPlan struct {
+	model  string
+	prompt string
+	chunks []string
+	// Whether a final condenseSummary call follows the chunks
+	condense bool
+}
+
+// Works out how a transcript gets summarized, without calling Groq
+func planSummary(scribeData []Segment, opts job.JobOptions) summaryPlan {
+	model := summarizationModelFor(opts)
+	prompt := summaryPromptFor(opts)
+	length := summaryLengthFor(opts)
+	chunks := createTranscriptSegments(scribeData, chunkTokenBudget(model, prompt, int(float64(MaxTokens)*length.chunkScale)))
+
+	// A style that was asked for explicitly wins over the brief prompt for short videos
+	if isShortTranscript(scribeData) && opts.Style == "" {
+		// Joining the chunks would repeat their overlap
+		chunks = []string{formatTranscript(scribeData)}
+		prompt = ShortSummaryPrompt
 	}
 
-	return &responseData.Choices[0].Message.Content, nil
+	if hasSpeakers(scribeData) {
+		prompt += speakerAttributionPrompt
+	}
+
+	prompt += length.prompt
+	prompt += sectionsPrompt(opts.Sections) + languagePrompt(opts)
+
+	return summaryPlan{
+		model:  model,
+		prompt: prompt,
+		chunks: chunks,
+		// A single chunk was already summarized to the right length
+		condense: length.condense && len(chunks) > 1,
+	}
 }
 
-func SummarizeVideo(videoID string, update func(func(j *job.SummaryJob))) error {
+func SummarizeVideo(ctx context.Context, videoID string, opts job.JobOptions, update func(func(j *job.SummaryJob))) error {
 
 	// Read transcription data
 
-	scribePath := fmt.Sprintf("%s/%s.%s", TranscriptionsPath, videoID, "json")
+	scribePath := fmt.Sprintf("%s/%s.%s", Paths.Transcriptions, videoID, "json")
 
 	scribeFile, err := os.Open(scribePath)
 	if err != nil {
@@ -146,47 +364,153 @@ func SummarizeVideo(videoID string, update func(func(j *job.SummaryJob))) error
 	}
 	scribeFile.Close()
 
+	if TrimNonSpeech {
+		scribeData = trimNonSpeech(scribeData)
+	}
+
+	if opts.HasRange() {
+		scribeData = segmentsInRange(scribeData, opts.StartSeconds, opts.EndSeconds)
+		if len(scribeData) == 0 {
+			return fmt.Errorf("%w: nothing in the transcript falls between %s", ErrRangeOutsideVideo, rangeName(opts.StartSeconds, opts.EndSeconds))
+		}
+	}
+
+	summaryPath := summaryPathFor(videoID, opts)
+	if err := os.MkdirAll(filepath.Dir(summaryPath), os.ModePerm); err != nil {
+		return err
+	}
+
+	if isSparseTranscript(scribeData) {
+		update(func(j *job.SummaryJob) {
+			j.Progress.TooSparse = true
+		})
+
+		return db.AtomicWriteFile(summaryPath, []byte(sparseTranscriptSummary(scribeData)), 0644)
+	}
+
 	// Chunk it up
 
-	chunks := createTranscriptSegments(scribeData)
+	plan := planSummary(scribeData, opts)
+	model, prompt, chunks, condense := plan.model, plan.prompt, plan.chunks, plan.condense
+
+	cacheKey := summaryCacheKey(model, prompt, chunks)
+	// The cache key sits next to the full summary, so ranges always summarize afresh
+	if SummaryCaching && !opts.Force && !opts.HasRange() {
+		if cached, ok := cachedSummary(videoID, cacheKey); ok {
+			Logger.Info("summary is up to date with its transcript, skipping step", "video_id", videoID, "stage", "summarize")
+			if err := saveSummarySections(videoID, opts.Sections); err != nil {
+				return err
+			}
+			writeBlurbs(ctx, videoID, model, cached, opts, update)
+			return nil
+		}
+	}
+
 	currentSummary := ""
 	update(func(j *job.SummaryJob) {
+		// The condensing pass counts as one more chunk
 		j.Progress.SummaryChunks = len(chunks)
+		if condense {
+			j.Progress.SummaryChunks++
+		}
 	})
 
+	var onPartial func(string)
+	if StreamSummaries {
+		onPartial = func(soFar string) {
+			update(func(j *job.SummaryJob) {
+				j.Progress.PartialSummary = soFar
+			})
+		}
+	}
+
 	// Summarize each chunk
 
 	for i, chunk := range chunks {
-		newSummary, err := extendSummary(chunk, currentSummary)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		newSummary, err := extendSummaryResplitting(ctx, model, prompt, chunk, currentSummary, onPartial, 0)
 
 		if err != nil {
 			return err
 		}
 
+		currentSummary = *newSummary
+
 		update(func(j *job.SummaryJob) {
 			j.Progress.ChunksSummarized = i + 1
+			j.Progress.InProgressSummary = currentSummary
+			j.Progress.PartialSummary = ""
 		})
+	}
 
-		currentSummary = *newSummary
+	if condense {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		condensed, err := condenseSummary(ctx, model, sectionsPrompt(opts.Sections)+languagePrompt(opts), currentSummary, onPartial)
+		if err != nil {
+			return err
+		}
+
+		currentSummary = *condensed
+
+		update(func(j *job.SummaryJob) {
+			j.Progress.ChunksSummarized = len(chunks) + 1
+			j.Progress.InProgressSummary = currentSummary
+			j.Progress.PartialSummary = ""
+		})
 	}
 
 	// Write out the finished summary
+	currentSummary = NormalizeHeadings(currentSummary)
 
-	summaryPath := fmt.Sprintf("%s/%s.%s", SummariesPath, videoID, "md")
+	// Swapped in with a rename, so a shutdown mid-write can't leave a truncated summary behind the old cache key
+	if err := db.AtomicWriteFile(summaryPath, []byte(currentSummary), 0644); err != nil {
+		return err
+	}
+
+	// It's on disk now, no need to keep broadcasting it
+	update(func(j *job.SummaryJob) {
+		j.Progress.InProgressSummary = ""
+	})
 
-	if err := os.MkdirAll(SummariesPath, os.ModePerm); err != nil {
+	// Versions, the cache key, sections and blurbs all belong to the full summary
+	if opts.HasRange() {
+		return nil
+	}
+
+	if err := saveSummaryVersion(videoID, currentSummary); err != nil {
 		return err
 	}
 
-	summaryFile, err := os.Create(summaryPath)
-	if err != nil {
+	if err := saveSummaryCacheKey(videoID, cacheKey); err != nil {
 		return err
 	}
-	defer summaryFile.Close()
 
-	if _, err := summaryFile.Write([]byte(currentSummary)); err != nil {
+	if err := saveSummarySections(videoID, opts.Sections); err != nil {
 		return err
 	}
 
+	writeBlurbs(ctx, videoID, model, currentSummary, opts, update)
+
 	return nil
 }
+
+// Blurbs are an extra, a failure there shouldn't throw away a good summary
+func writeBlurbs(ctx context.Context, videoID string, model string, summary string, opts job.JobOptions, update func(func(j *job.SummaryJob))) {
+	if len(opts.Blurbs) == 0 {
+		return
+	}
+
+	update(func(j *job.SummaryJob) {
+		j.Status = "writing_blurbs"
+	})
+
+	if err := GenerateBlurbs(ctx, videoID, model, summary, opts.Blurbs); err != nil {
+		Logger.Warn("failed to generate blurbs", "video_id", videoID, "stage", "summarize", "error", err)
+	}
+}
@@ -0,0 +1,278 @@
+package adapters
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go-yt-sum/job"
+)
+
+func testScript(n int) []Segment {
+	script := make([]Segment, n)
+	for i := range script {
+		script[i] = Segment{Start: float64(i * 3), End: float64(i*3 + 3), Text: fmt.Sprintf("segment %d says something worth summarizing", i)}
+	}
+	return script
+}
+
+// Whichever segment the transcript ends on, the last chunk is never empty or just the overlap of the one before it
+func TestCreateTranscriptSegmentsNoEmptyTrailingChunk(t *testing.T) {
+	oldOverlap := SummaryChunkOverlap
+	defer func() { SummaryChunkOverlap = oldOverlap }()
+
+	script := testScript(120)
+
+	for _, overlap := range []int{0, 40} {
+		SummaryChunkOverlap = overlap
+
+		for n := 1; n <= len(script); n++ {
+			chunks := createTranscriptSegments(script[:n], 200)
+			if len(chunks) == 0 {
+				t.Fatalf("overlap %d, %d segments: no chunks", overlap, n)
+			}
+
+			last := chunks[len(chunks)-1]
+			if strings.TrimSpace(last) == "" {
+				t.Fatalf("overlap %d, %d segments: empty trailing chunk", overlap, n)
+			}
+			if len(chunks) > 1 && strings.HasSuffix(chunks[len(chunks)-2], last) {
+				t.Fatalf("overlap %d, %d segments: trailing chunk only repeats the one before it", overlap, n)
+			}
+			if !strings.Contains(last, script[n-1].Text) {
+				t.Fatalf("overlap %d, %d segments: last segment missing from the last chunk", overlap, n)
+			}
+		}
+	}
+
+	if chunks := createTranscriptSegments(nil, 200); len(chunks) != 0 {
+		t.Errorf("empty transcript gave %d chunks", len(chunks))
+	}
+}
+
+func TestCreateTranscriptSegmentsOverlap(t *testing.T) {
+	oldOverlap := SummaryChunkOverlap
+	defer func() { SummaryChunkOverlap = oldOverlap }()
+
+	SummaryChunkOverlap = 40
+	chunks := createTranscriptSegments(testScript(120), 200)
+	if len(chunks) < 3 {
+		t.Fatalf("expected several chunks, got %d", len(chunks))
+	}
+
+	for i := 1; i < len(chunks); i++ {
+		prevLines := strings.SplitAfter(strings.TrimSuffix(chunks[i-1], "\n"), "\n")
+		firstLine := strings.SplitAfter(chunks[i], "\n")[0]
+		if !strings.Contains(chunks[i], prevLines[len(prevLines)-1]) || !strings.Contains(chunks[i-1], firstLine) {
+			t.Errorf("chunk %d doesn't start with the end of chunk %d", i, i-1)
+		}
+		if tokens := estimateTokens(chunks[i]); tokens > 200 {
+			t.Errorf("chunk %d is %d tokens, over the 200 token budget", i, tokens)
+		}
+	}
+}
+
+// Answers like a model that can only fit two transcript lines at a time: bigger sections get context_length_exceeded,
+// and smaller ones are "summarized" by appending their lines to the current summary
+func stubSmallContext(t *testing.T, requests *[]string) {
+	stubGroq(t, func(w http.ResponseWriter, r *http.Request) {
+		var req GroqSummarizationRequest
+		json.NewDecoder(r.Body).Decode(&req)
+
+		section := strings.TrimPrefix(req.Messages[1].Content, "Please summarize this: ")
+		_, current, _ := strings.Cut(req.Messages[2].Content, "just write an initial one: ")
+		*requests = append(*requests, section)
+
+		lines := strings.Fields(section)
+		if len(lines) > 2 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": {"message": "Please reduce the length of the messages", "type": "invalid_request_error", "code": "context_length_exceeded"}}`))
+			return
+		}
+		writeCompletion(w, current+strings.Join(lines, ""))
+	})
+}
+
+func TestExtendSummaryResplitsOnContextLengthExceeded(t *testing.T) {
+	var requests []string
+	stubSmallContext(t, &requests)
+
+	summary, err := extendSummaryResplitting(context.Background(), "model", "prompt", "a\nb\nc\nd\ne\n", "", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every line made it in, in order, with each half building on the summary of the one before
+	if *summary != "abcde" {
+		t.Errorf("summary = %q, want %q", *summary, "abcde")
+	}
+
+	// a-e overflows, a-b fits, c-e overflows again and is split into c and d-e
+	want := []string{"a\nb\nc\nd\ne\n", "a\nb\n", "c\nd\ne", "c\n", "d\ne"}
+	if len(requests) != len(want) {
+		t.Fatalf("sent sections %q, want %q", requests, want)
+	}
+	for i := range want {
+		if requests[i] != want[i] {
+			t.Errorf("section %d = %q, want %q", i, requests[i], want[i])
+		}
+	}
+}
+
+func TestExtendSummaryResplitGivesUp(t *testing.T) {
+	var requests []string
+	stubSmallContext(t, &requests)
+
+	oldDepth := maxResplitDepth
+	maxResplitDepth = 1
+	defer func() { maxResplitDepth = oldDepth }()
+
+	// One split leaves a three line half that still doesn't fit
+	_, err := extendSummaryResplitting(context.Background(), "model", "prompt", "a\nb\nc\nd\ne\nf\n", "", nil, 0)
+	if !isContextLengthExceeded(err) {
+		t.Errorf("err = %v, want context_length_exceeded", err)
+	}
+}
+
+// A script long enough to go through Groq, neither short nor sparse
+func writeSummarizableTranscript(t *testing.T, videoID string) {
+	t.Helper()
+
+	segments := make([]Segment, 0)
+	for i := range 60 {
+		segments = append(segments, Segment{Start: float64(i * 5), End: float64(i*5 + 5), Text: "people talking about the setup and then the results"})
+	}
+	writeTestTranscription(t, videoID, segments)
+}
+
+// Lists what's in the summaries directory, to catch temp files left behind
+func summaryFiles(t *testing.T) []string {
+	t.Helper()
+
+	entries, err := os.ReadDir(Paths.Summaries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func TestSummarizeVideoWritesSummaryWhole(t *testing.T) {
+	useTempContent(t)
+	stubGroq(t, func(w http.ResponseWriter, r *http.Request) {
+		writeCompletion(w, "# Title\\n\\nThe summary")
+	})
+
+	const videoID = "dQw4w9WgXcQ"
+	writeSummarizableTranscript(t, videoID)
+
+	if err := SummarizeVideo(context.Background(), videoID, job.JobOptions{}, func(func(j *job.SummaryJob)) {}); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(Paths.Summaries, videoID+".md"))
+	if err != nil || string(data) != "# Title\n\nThe summary" {
+		t.Errorf("summary = %q, %v", data, err)
+	}
+	for _, name := range summaryFiles(t) {
+		if strings.HasPrefix(name, ".") {
+			t.Errorf("temp file %s left behind", name)
+		}
+	}
+}
+
+func TestSummarizeVideoFailedWrite(t *testing.T) {
+	useTempContent(t)
+	stubGroq(t, func(w http.ResponseWriter, r *http.Request) {
+		writeCompletion(w, "# Title\\n\\nThe summary")
+	})
+
+	const videoID = "dQw4w9WgXcQ"
+	writeSummarizableTranscript(t, videoID)
+
+	// A non-empty directory where the summary goes, so it can't be renamed into place
+	blocker := filepath.Join(Paths.Summaries, videoID+".md")
+	if err := os.MkdirAll(filepath.Join(blocker, "in-the-way"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SummarizeVideo(context.Background(), videoID, job.JobOptions{}, func(func(j *job.SummaryJob)) {}); err == nil {
+		t.Fatal("expected the failed write to fail the summary")
+	}
+
+	// Nothing written after the summary, so a later request can't take it for cached
+	if _, err := os.Stat(summaryCacheKeyPath(videoID)); !os.IsNotExist(err) {
+		t.Error("cache key written for a summary that wasn't")
+	}
+}
+
+func TestIsSparseTranscript(t *testing.T) {
+	oldSegments, oldWords := MinSummarySegments, MinSummaryWords
+	defer func() { MinSummarySegments, MinSummaryWords = oldSegments, oldWords }()
+
+	words := func(n int) string { return strings.TrimSpace(strings.Repeat("word ", n)) }
+	segs := func(texts ...string) []Segment {
+		script := make([]Segment, len(texts))
+		for i, text := range texts {
+			script[i] = Segment{Start: float64(i), End: float64(i + 1), Text: text}
+		}
+		return script
+	}
+
+	tests := []struct {
+		name        string
+		minSegments int
+		minWords    int
+		script      []Segment
+		want        bool
+	}{
+		{"too few segments", 3, 25, segs(words(20), words(20)), true},
+		{"too few words", 3, 25, segs(words(8), words(8), words(8)), true},
+		{"just enough", 3, 25, segs(words(8), words(8), words(9)), false},
+		{"empty", 3, 25, nil, true},
+		{"segment check off", 0, 25, segs(words(30)), false},
+		{"word check off", 3, 0, segs("uh", "um", "ok"), false},
+		{"both off", 0, 0, nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			MinSummarySegments, MinSummaryWords = tt.minSegments, tt.minWords
+			if got := isSparseTranscript(tt.script); got != tt.want {
+				t.Errorf("isSparseTranscript = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSummarizeVideoSparseTranscript(t *testing.T) {
+	useTempContent(t)
+	stubGroq(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Error("a sparse transcript was sent to Groq")
+	})
+
+	const videoID = "dQw4w9WgXcQ"
+	writeTestTranscription(t, videoID, []Segment{{Start: 0, End: 4, Text: " [music]"}, {Start: 4, End: 8, Text: " thanks for watching"}})
+
+	var j job.SummaryJob
+	update := func(fn func(j *job.SummaryJob)) { fn(&j) }
+	if err := SummarizeVideo(context.Background(), videoID, job.JobOptions{}, update); err != nil {
+		t.Fatal(err)
+	}
+
+	if !j.Progress.TooSparse {
+		t.Error("job wasn't marked too sparse")
+	}
+	summary, err := os.ReadFile(filepath.Join(Paths.Summaries, videoID+".md"))
+	if err != nil || !strings.Contains(string(summary), "thanks for watching") {
+		t.Errorf("summary = %q, %v, want the transcript", summary, err)
+	}
+}
@@ -0,0 +1,42 @@
+package adapters
+
+import (
+	"sync"
+
+	"github.com/pkoukk/tiktoken-go"
+	tiktoken_loader "github.com/pkoukk/tiktoken-go-loader"
+)
+
+// Share of a token budget chunks are allowed to fill. cl100k only approximates the tokenizers of the models
+// we actually call (Llama, Qwen, ...), so some headroom is kept for the difference
+var TokenSafetyMargin = 0.9
+
+var (
+	tokenizerOnce sync.Once
+	tokenizer     *tiktoken.Tiktoken
+)
+
+// The encoding ships with the binary, so this never touches the network
+func loadTokenizer() *tiktoken.Tiktoken {
+	tokenizerOnce.Do(func() {
+		tiktoken.SetBpeLoader(tiktoken_loader.NewOfflineLoader())
+
+		enc, err := tiktoken.GetEncoding("cl100k_base")
+		if err != nil {
+			Logger.Warn("failed to load tokenizer, falling back to 4 chars per token", "error", err)
+			return
+		}
+		tokenizer = enc
+	})
+
+	return tokenizer
+}
+
+func estimateTokens(s string) int {
+	if enc := loadTokenizer(); enc != nil {
+		return len(enc.EncodeOrdinary(s))
+	}
+
+	// Assumes 4 chars per token average
+	return (len(s) + 3) / 4
+}
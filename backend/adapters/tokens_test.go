@@ -0,0 +1,39 @@
+package adapters
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEstimateTokens(t *testing.T) {
+	if loadTokenizer() == nil {
+		t.Fatal("cl100k_base didn't load from the bundled encoding")
+	}
+
+	// Counts from OpenAI's cl100k_base tokenizer
+	tests := []struct {
+		s    string
+		want int
+	}{
+		{"", 0},
+		{"hello world", 2},
+		{"tiktoken is great!", 6},
+	}
+
+	for _, tt := range tests {
+		if got := estimateTokens(tt.s); got != tt.want {
+			t.Errorf("estimateTokens(%q) = %d, want %d", tt.s, got, tt.want)
+		}
+	}
+}
+
+// Dense text is where 4 chars per token was furthest off
+func TestEstimateTokensDenseTranscript(t *testing.T) {
+	line := "[0:01:02-0:01:05]: 3.14159 × 2.71828 ≈ 8.5397, per arXiv:2301.00001v2\n"
+	s := strings.Repeat(line, 20)
+
+	got, heuristic := estimateTokens(s), (len(s)+3)/4
+	if got <= heuristic {
+		t.Errorf("estimateTokens = %d, want more than the %d that 4 chars per token guesses", got, heuristic)
+	}
+}
@@ -2,54 +2,173 @@ package adapters
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"go-yt-sum/job"
-	"log"
 	"os"
 	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
 
 	"mime/multipart"
 	"net/http"
+	"net/textproto"
 	"path/filepath"
 
 	"encoding/json"
 	"io"
 )
 
+// Length ffmpeg splits audio into before it's sent off for transcription. Shorter chunks transcribe in parallel
+// better, longer ones make fewer requests. Keep chunks under Groq's 25MB upload limit at TranscribeBitrate
+var TranscribeChunkSeconds = 1200
+
+// Format chunks are re-encoded to before upload, one of TranscribeCodecs. From TRANSCRIBE_CODEC
+var TranscribeCodec = "opus"
+
+// Bitrate chunks are re-encoded at, in ffmpeg's notation. Empty uses the codec's default
+var TranscribeBitrate = ""
+
+type audioCodec struct {
+	// ffmpeg's encoder for it
+	Encoder string
+	// File extension of the chunks, which Groq uses to tell the format
+	Ext         string
+	ContentType string
+	// Plenty for speech. Larger only costs upload time
+	DefaultBitrate string
+}
+
+// Formats Groq accepts that chunks can be encoded to. Opus at a low bitrate uploads a fraction of what mp3 does
+var TranscribeCodecs = map[string]audioCodec{
+	"opus": {Encoder: "libopus", Ext: "ogg", ContentType: "audio/ogg", DefaultBitrate: "32k"},
+	"mp3":  {Encoder: "libmp3lame", Ext: "mp3", ContentType: "audio/mpeg", DefaultBitrate: "96k"},
+}
+
+// The codec chunks are encoded with, falling back to mp3 if TranscribeCodec isn't one we know
+func transcribeCodec() audioCodec {
+	if codec, ok := TranscribeCodecs[TranscribeCodec]; ok {
+		return codec
+	}
+	return TranscribeCodecs["mp3"]
+}
+
+func transcribeBitrate() string {
+	if TranscribeBitrate != "" {
+		return TranscribeBitrate
+	}
+	return transcribeCodec().DefaultBitrate
+}
+
+// Content type for the chunk's extension, so Groq is told the same format the filename says
+func chunkContentType(filePath string) string {
+	ext := strings.TrimPrefix(filepath.Ext(filePath), ".")
+	for _, codec := range TranscribeCodecs {
+		if codec.Ext == ext {
+			return codec.ContentType
+		}
+	}
+	return "application/octet-stream"
+}
+
+// Number of chunks of a single video transcribed at the same time. The upload semaphore still applies on top
+var TranscribeChunkWorkers = 3
+
 type TranscriptionPayload struct {
 	Segments []Segment `json:"segments"`
 }
 
-func cleanUpChunks(videoID string) {
-	chunksPath := fmt.Sprintf("%s/%s/", DownloadsPath, videoID)
-	os.RemoveAll(chunksPath)
+// A chunk's transcription, saved next to the chunk as soon as it's done so a retry after a crash can skip it.
+// Only reused if the chunk was cut and transcribed the same way
+type chunkResult struct {
+	ChunkSeconds int       `json:"chunk_seconds"`
+	Model        string    `json:"model"`
+	Language     string    `json:"language"`
+	Segments     []Segment `json:"segments"`
 }
 
-// Takes mp3, chunks it, returns a list of the relative paths of all the chunk files. Good for iterating over once the function has been called
-func chunkAudio(videoID string) (*[]string, error) {
-	dlPath := fmt.Sprintf("%s/%s.%s", DownloadsPath, videoID, audioType)
-	outputPath := fmt.Sprintf("%s/%s", DownloadsPath, videoID)
+// downloads/{videoID}/003.ogg is saved as downloads/{videoID}/chunk-003.json
+func chunkResultPath(chunkPath string) string {
+	base := strings.TrimSuffix(filepath.Base(chunkPath), filepath.Ext(chunkPath))
+	return filepath.Join(filepath.Dir(chunkPath), fmt.Sprintf("chunk-%s.json", base))
+}
 
-	if err := os.MkdirAll(outputPath, os.ModePerm); err != nil {
-		return nil, err
+// Segments from an earlier attempt at the chunk, relative to its start. False if there's nothing usable
+func loadChunkResult(chunkPath string, model string, language string) ([]Segment, bool) {
+	data, err := os.ReadFile(chunkResultPath(chunkPath))
+	if err != nil {
+		return nil, false
+	}
+
+	var result chunkResult
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, false
+	}
+	if result.ChunkSeconds != TranscribeChunkSeconds || result.Model != model || result.Language != language {
+		return nil, false
 	}
 
-	cmd := exec.Command("ffmpeg",
+	return result.Segments, true
+}
+
+func saveChunkResult(chunkPath string, model string, language string, segments []Segment) error {
+	data, err := json.Marshal(chunkResult{
+		ChunkSeconds: TranscribeChunkSeconds,
+		Model:        model,
+		Language:     language,
+		Segments:     segments,
+	})
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(chunkResultPath(chunkPath), data, 0644)
+}
+
+func cleanUpChunks(videoID string) {
+	chunksPath := fmt.Sprintf("%s/%s/", Paths.Downloads, videoID)
+	os.RemoveAll(chunksPath)
+}
+
+// ffmpeg's arguments for cutting the audio at dlPath into TranscribeChunkSeconds chunks in outputPath
+func chunkAudioArgs(dlPath string, outputPath string) []string {
+	codec := transcribeCodec()
+
+	return []string{
 		"-y",
 		"-i", dlPath, // input
-		"-vn",                // no video
-		"-c:a", "libmp3lame", // encode to mp3
-		"-b:a", "96k",
+		"-vn",                 // no video
+		"-c:a", codec.Encoder, // re-encode to the upload format
+		"-b:a", transcribeBitrate(),
 		"-f", "segment", // <-- split muxer
-		"-segment_time", "1200", // 1200s = 20 min chunks
+		"-segment_time", strconv.Itoa(TranscribeChunkSeconds),
 		"-reset_timestamps", "1",
 		"-map", "0:a:0",
-		filepath.Join(outputPath, "%03d.mp3"), // output pattern is the FINAL arg
-	)
+		filepath.Join(outputPath, "%03d."+codec.Ext), // output pattern is the FINAL arg
+	}
+}
+
+// Takes the downloaded audio, chunks it in TranscribeCodec, returns a list of the relative paths of all the chunk files. Good for iterating over once the function has been called.
+// Chunk results from an earlier attempt live in the same directory and are left where they are
+func chunkAudio(ctx context.Context, videoID string) (*[]string, error) {
+	dlPath := fmt.Sprintf("%s/%s.%s", Paths.Downloads, videoID, audioType)
+	outputPath := fmt.Sprintf("%s/%s", Paths.Downloads, videoID)
+
+	if err := os.MkdirAll(outputPath, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	codec := transcribeCodec()
+
+	cmd := exec.CommandContext(ctx, "ffmpeg", chunkAudioArgs(dlPath, outputPath)...)
 
 	output, err := cmd.CombinedOutput()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
 	if err != nil {
-		log.Println(string(output))
+		Logger.Error("ffmpeg failed to split audio", "stage", "transcribe", "output", string(output))
 		return nil, err
 	}
 
@@ -61,15 +180,64 @@ func chunkAudio(videoID string) (*[]string, error) {
 	out := make([]string, 0)
 
 	for _, entry := range entries {
+		// Chunks from an earlier attempt with another codec are left out
+		if entry.IsDir() || filepath.Ext(entry.Name()) != "."+codec.Ext {
+			continue
+		}
 		out = append(out, fmt.Sprintf("%s/%s", outputPath, entry.Name()))
 	}
 
 	return &out, nil
 }
 
+// Length of an audio file in seconds, as reported by ffprobe
+func probeDuration(ctx context.Context, filePath string) (float64, error) {
+	cmd := exec.CommandContext(ctx, "ffprobe",
+		"-v", "error",
+		"-show_entries", "format=duration",
+		"-of", "default=noprint_wrappers=1:nokey=1",
+		filePath,
+	)
+
+	output, err := cmd.Output()
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseFloat(strings.TrimSpace(string(output)), 64)
+}
+
+// Swapped out by tests, which have no ffmpeg, ffprobe or real audio to run them on
+var (
+	splitAudio    = chunkAudio
+	chunkDuration = probeDuration
+)
+
+// Start time of each chunk within the whole video. ffmpeg cuts segments on frame boundaries and the last one is
+// usually short, so every chunk is measured rather than assuming the segment time. Only if ffprobe can't read
+// a chunk do we fall back to the nominal segment length for it.
+func chunkOffsets(ctx context.Context, entries []string) []float64 {
+	offsets := make([]float64, len(entries))
+	var next float64 = 0
+
+	for i, entry := range entries {
+		offsets[i] = next
+
+		duration, err := chunkDuration(ctx, entry)
+		if err != nil {
+			Logger.Warn("ffprobe failed, assuming the chunk is full length", "stage", "transcribe", "chunk", entry, "seconds", TranscribeChunkSeconds, "error", err)
+			duration = float64(TranscribeChunkSeconds)
+		}
+		next += duration
+	}
+
+	return offsets
+}
+
 // Opens the file, encodes http request, transcribes via groq, returns structured payload
 // Uses lastEnd to shift timestamps and then deduplicate
-func transcribeFile(filePath string, context string) (*TranscriptionPayload, error) {
+// A language of "auto" leaves it to Whisper to detect
+func transcribeFile(ctx context.Context, filePath string, model string, language string, prompt string) (*TranscriptionPayload, error) {
 	audioFile, err := os.Open(filePath)
 	if err != nil {
 		return nil, err
@@ -81,34 +249,59 @@ func transcribeFile(filePath string, context string) (*TranscriptionPayload, err
 	reqBody := &bytes.Buffer{}
 	writer := multipart.NewWriter(reqBody)
 
-	part, err := writer.CreateFormFile("file", filepath.Base(filePath))
+	// CreateFormFile would label every chunk application/octet-stream
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename="%s"`, filepath.Base(filePath)))
+	header.Set("Content-Type", chunkContentType(filePath))
+
+	part, err := writer.CreatePart(header)
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = io.Copy(part, audioFile)
+	if _, err := io.Copy(part, audioFile); err != nil {
+		return nil, err
+	}
 
 	// Write other fields
-	err = writer.WriteField("model", GetTranscriptionModel())
-	err = writer.WriteField("language", "en")
-	err = writer.WriteField("response_format", "verbose_json")
-	err = writer.WriteField("prompt", context)
-	err = writer.WriteField("timestamp_granularities[]", "segment")
+	fields := [][2]string{
+		{"model", model},
+		{"response_format", "verbose_json"},
+		{"prompt", prompt},
+		{"timestamp_granularities[]", "segment"},
+	}
+	if language != "auto" {
+		fields = append(fields, [2]string{"language", language})
+	}
+
+	for _, field := range fields {
+		if err := writer.WriteField(field[0], field[1]); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
 
-	err = writer.Close()
+	request, err := http.NewRequestWithContext(ctx, "POST", groqTranscriptionUrl, reqBody)
 	if err != nil {
 		return nil, err
 	}
 
-	request, _ := http.NewRequest("POST", groqTranscriptionUrl, reqBody)
+	// Wait for a free upload slot so parallel workers don't hammer the API
+	select {
+	case transcriptionSlots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-transcriptionSlots }()
 
 	// Write headers
 	request.Header.Add("Content-Type", writer.FormDataContentType())
-	request.Header.Add("Authorization", fmt.Sprintf("Bearer %s", apiKey))
 
-	// Send request
-	client := &http.Client{}
-	response, err := client.Do(request)
+	// Send request. An error body would unmarshal into an empty transcription, so those come back as errors
+	response, err := doGroqRequest(request)
 	if err != nil {
 		return nil, err
 	}
@@ -116,8 +309,11 @@ func transcribeFile(filePath string, context string) (*TranscriptionPayload, err
 	defer response.Body.Close()
 
 	respBody, err := io.ReadAll(response.Body)
-	var data TranscriptionPayload
+	if err != nil {
+		return nil, err
+	}
 
+	var data TranscriptionPayload
 	if err := json.Unmarshal(respBody, &data); err != nil {
 		return nil, err
 	}
@@ -125,15 +321,115 @@ func transcribeFile(filePath string, context string) (*TranscriptionPayload, err
 	return &data, nil
 }
 
+// Transcribes every chunk with a bounded pool of workers, then stitches the results back together in order.
+// Offsets are known up front, so each chunk's timestamps can be shifted independently of the others finishing.
+// Each chunk's result is saved as it finishes, and chunks an earlier attempt already did are not sent again.
+func transcribeChunks(ctx context.Context, entries []string, model string, language string, progress func(func(j *job.SummaryJob))) ([]Segment, error) {
+	offsets := chunkOffsets(ctx, entries)
+	results := make([][]Segment, len(entries))
+
+	// The first failure stops the remaining chunks
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+
+	indices := make(chan int)
+	go func() {
+		defer close(indices)
+		for i := range entries {
+			select {
+			case indices <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for range max(TranscribeChunkWorkers, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := range indices {
+				if saved, ok := loadChunkResult(entries[i], model, language); ok {
+					for k := range saved {
+						saved[k].Start += offsets[i]
+						saved[k].End += offsets[i]
+					}
+					results[i] = saved
+
+					progress(func(j *job.SummaryJob) {
+						j.Progress.ChunksTranscribed++
+					})
+					continue
+				}
+
+				if SkipSilentChunks && isSilentChunk(ctx, entries[i]) {
+					Logger.Info("skipping silent chunk", "stage", "transcribe", "chunk", entries[i])
+					progress(func(j *job.SummaryJob) {
+						j.Progress.ChunksTranscribed++
+					})
+					continue
+				}
+
+				chunkSegments, err := ActiveTranscriber.Transcribe(ctx, entries[i], model, language)
+				if err != nil {
+					errOnce.Do(func() {
+						firstErr = err
+						cancel()
+					})
+					return
+				}
+
+				// Losing the saved result only costs a retry the chunk, so it doesn't fail the job
+				if err := saveChunkResult(entries[i], model, language, chunkSegments); err != nil {
+					Logger.Warn("failed to save chunk transcription", "stage", "transcribe", "chunk", entries[i], "error", err)
+				}
+
+				for k := range chunkSegments {
+					chunkSegments[k].Start += offsets[i]
+					chunkSegments[k].End += offsets[i]
+				}
+				results[i] = chunkSegments
+
+				// Chunks finish out of order, so count rather than reporting the index
+				progress(func(j *job.SummaryJob) {
+					j.Progress.ChunksTranscribed++
+				})
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	segments := make([]Segment, 0)
+	for _, r := range results {
+		segments = append(segments, r...)
+	}
+
+	return segments, nil
+}
+
 // The progress func should handle locking and unlocking + sending data to clients.
 // The purpose of keeping it abstract is so if that logic changes (it likely will), this logic stays the same
-func TranscribeVideo(videoID string, progress func(func(j *job.SummaryJob))) error {
+func TranscribeVideo(ctx context.Context, videoID string, opts job.JobOptions, progress func(func(j *job.SummaryJob))) (err error) {
 	// Check for existing transcription
-	scribePath := fmt.Sprintf("%s/%s.%s", TranscriptionsPath, videoID, "json")
-	_, err := os.Stat(scribePath)
+	scribePath := fmt.Sprintf("%s/%s.%s", Paths.Transcriptions, videoID, "json")
 
-	if err == nil {
-		log.Printf("%s has already been transcribed. Skipping step.", videoID)
+	if _, err := os.Stat(scribePath); err == nil {
+		Logger.Info("already transcribed, skipping step", "video_id", videoID, "stage", "transcribe")
 		return nil
 	}
 
@@ -142,9 +438,15 @@ func TranscribeVideo(videoID string, progress func(func(j *job.SummaryJob))) err
 		j.Status = "chunking"
 	})
 
-	entries, err := chunkAudio(videoID)
-	defer cleanUpChunks(videoID)
+	// Chunks and their results stay until the transcription is written, so an attempt that fails on something
+	// worth retrying can be resumed. Nothing will resume a cancelled job or one that failed for good
+	defer func() {
+		if err != nil && (ctx.Err() != nil || !IsTransientHTTPError(err)) {
+			cleanUpChunks(videoID)
+		}
+	}()
 
+	entries, err := splitAudio(ctx, videoID)
 	if err != nil {
 		return err
 	}
@@ -152,30 +454,29 @@ func TranscribeVideo(videoID string, progress func(func(j *job.SummaryJob))) err
 	progress(func(j *job.SummaryJob) {
 		j.Status = "transcribing"
 		j.Progress.TranscriptionChunks = len(*entries)
+		j.Progress.ChunksTranscribed = 0
 	})
 
-	// Transcribe each segment
-	segments := make([]Segment, 0)
-	var lastTimestamp float64 = 0
-
-	for i, entry := range *entries {
-		newTranscription, err := transcribeFile(entry, "")
-		if err != nil {
-			return err
-		}
-
-		for i := range newTranscription.Segments {
-			newTranscription.Segments[i].Start += lastTimestamp
-			newTranscription.Segments[i].End += lastTimestamp
-		}
+	segments, err := transcribeChunks(ctx, *entries, transcriptionModelFor(opts), languageFor(opts), progress)
+	if err != nil {
+		return err
+	}
 
+	// Speaker labels are nice to have, an unlabelled transcript is still usable
+	if ActiveDiarizer != nil {
 		progress(func(j *job.SummaryJob) {
-			j.Progress.ChunksTranscribed = i + 1
+			j.Status = "diarizing"
 		})
 
-		segments = append(segments, newTranscription.Segments...)
-		// Each transcription chunk is 1200 seconds long, so we can increment by a fixed amount safely
-		lastTimestamp += 1200
+		diarized, err := ActiveDiarizer.Diarize(ctx, fmt.Sprintf("%s/%s.%s", Paths.Downloads, videoID, audioType), segments)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			Logger.Warn("diarization failed, keeping the transcript unlabelled", "video_id", videoID, "stage", "transcribe", "error", err)
+		} else {
+			segments = diarized
+		}
 	}
 
 	// Write output
@@ -186,8 +487,16 @@ func TranscribeVideo(videoID string, progress func(func(j *job.SummaryJob))) err
 
 	encoder := json.NewEncoder(outputFile)
 	if err := encoder.Encode(segments); err != nil {
+		outputFile.Close()
+		// A half-written transcription would count as done, and the chunks are still here to retry from
+		os.Remove(scribePath)
+		return err
+	}
+	if err := outputFile.Close(); err != nil {
+		os.Remove(scribePath)
 		return err
 	}
 
+	cleanUpChunks(videoID)
 	return nil
 }
@@ -0,0 +1,315 @@
+package adapters
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"go-yt-sum/job"
+)
+
+// Returns canned segments for each chunk, relative to the chunk's start
+type fakeTranscriber map[string][]Segment
+
+func (f fakeTranscriber) Transcribe(ctx context.Context, filePath string, model string, language string) ([]Segment, error) {
+	return append([]Segment(nil), f[filePath]...), nil
+}
+
+// Stands in for ffprobe with made up chunk lengths. Chunks missing from durations fail to probe
+func useChunkDurations(t *testing.T, durations map[string]float64) {
+	t.Helper()
+
+	old := chunkDuration
+	t.Cleanup(func() { chunkDuration = old })
+
+	chunkDuration = func(ctx context.Context, filePath string) (float64, error) {
+		if d, ok := durations[filePath]; ok {
+			return d, nil
+		}
+		return 0, errors.New("ffprobe failed")
+	}
+}
+
+func useTranscriber(t *testing.T, transcriber Transcriber) {
+	t.Helper()
+
+	old := ActiveTranscriber
+	t.Cleanup(func() { ActiveTranscriber = old })
+	ActiveTranscriber = transcriber
+}
+
+// A 25 minute video cut into a 20 minute chunk and a 5 minute one
+func twoChunks(t *testing.T) (string, string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	first, second := filepath.Join(dir, "000.ogg"), filepath.Join(dir, "001.ogg")
+	for _, chunk := range []string{first, second} {
+		if err := os.WriteFile(chunk, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	useTranscriber(t, fakeTranscriber{
+		first:  {{Start: 0, End: 600, Text: "first half"}, {Start: 600, End: 1199.4, Text: "second half"}},
+		second: {{Start: 0, End: 150, Text: "almost done"}, {Start: 150, End: 300, Text: "the end"}},
+	})
+	return first, second
+}
+
+func noProgress(func(j *job.SummaryJob)) {}
+
+func TestTranscribeChunksOffsetsByMeasuredDuration(t *testing.T) {
+	first, second := twoChunks(t)
+	useChunkDurations(t, map[string]float64{first: 1200.04, second: 300})
+
+	segments, err := transcribeChunks(context.Background(), []string{first, second}, "model", "en", noProgress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 4 {
+		t.Fatalf("got %d segments, want 4", len(segments))
+	}
+
+	if start := segments[2].Start; start < 1199 || start > 1201 {
+		t.Errorf("second chunk starts at %v, want ~1200", start)
+	}
+	if end := segments[3].End; end < 1499 || end > 1501 {
+		t.Errorf("last segment ends at %v, want ~1500, not %d", end, 2*TranscribeChunkSeconds+300)
+	}
+}
+
+func TestTranscribeChunksFallsBackToChunkLength(t *testing.T) {
+	first, second := twoChunks(t)
+	// Nothing comes after the last chunk, so only the first failing to probe shows up in the offsets
+	useChunkDurations(t, map[string]float64{second: 300})
+
+	segments, err := transcribeChunks(context.Background(), []string{first, second}, "model", "en", noProgress)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if start := segments[2].Start; start != float64(TranscribeChunkSeconds) {
+		t.Errorf("second chunk starts at %v, want the nominal %d", start, TranscribeChunkSeconds)
+	}
+}
+
+func TestTranscribeFileBadRequest(t *testing.T) {
+	stubGroq(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error": {"message": "file must be one of the supported formats", "type": "invalid_request_error", "code": "invalid_file"}}`))
+	})
+
+	chunk := filepath.Join(t.TempDir(), "000.ogg")
+	if err := os.WriteFile(chunk, []byte("not really audio"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	payload, err := transcribeFile(context.Background(), chunk, "whisper-large-v3-turbo", "en", "")
+	if payload != nil {
+		t.Errorf("got a payload %+v for a 400", payload)
+	}
+
+	var apiErr *GroqAPIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("err = %v, want a *GroqAPIError", err)
+	}
+	if apiErr.StatusCode != http.StatusBadRequest || apiErr.Code != "invalid_file" {
+		t.Errorf("err = %+v, want the 400 with code invalid_file", apiErr)
+	}
+}
+
+func TestTranscribeFileSendsChunk(t *testing.T) {
+	var form map[string]string
+	var contentType string
+	stubGroq(t, func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			t.Error(err)
+		}
+		form = map[string]string{}
+		for k, v := range r.MultipartForm.Value {
+			form[k] = v[0]
+		}
+		if files := r.MultipartForm.File["file"]; len(files) == 1 {
+			contentType = files[0].Header.Get("Content-Type")
+		}
+		w.Write([]byte(`{"segments": [{"start": 0, "end": 2.5, "text": " hello"}]}`))
+	})
+
+	chunk := filepath.Join(t.TempDir(), "000.ogg")
+	if err := os.WriteFile(chunk, []byte("not really audio"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	payload, err := transcribeFile(context.Background(), chunk, "whisper-large-v3-turbo", "auto", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payload.Segments) != 1 || payload.Segments[0].End != 2.5 {
+		t.Errorf("payload = %+v", payload)
+	}
+
+	if form["model"] != "whisper-large-v3-turbo" || form["response_format"] != "verbose_json" {
+		t.Errorf("form fields = %v", form)
+	}
+	if _, ok := form["language"]; ok {
+		t.Error("language was sent for auto")
+	}
+	if contentType != "audio/ogg" {
+		t.Errorf("file sent as %q, want audio/ogg", contentType)
+	}
+}
+
+func useChunking(t *testing.T, seconds int, codec string, bitrate string) {
+	t.Helper()
+
+	oldSeconds, oldCodec, oldBitrate := TranscribeChunkSeconds, TranscribeCodec, TranscribeBitrate
+	t.Cleanup(func() {
+		TranscribeChunkSeconds, TranscribeCodec, TranscribeBitrate = oldSeconds, oldCodec, oldBitrate
+	})
+	TranscribeChunkSeconds, TranscribeCodec, TranscribeBitrate = seconds, codec, bitrate
+}
+
+// The value following flag in args
+func argAfter(args []string, flag string) string {
+	for i, a := range args[:len(args)-1] {
+		if a == flag {
+			return args[i+1]
+		}
+	}
+	return ""
+}
+
+func TestChunkAudioArgs(t *testing.T) {
+	useChunking(t, 300, "mp3", "")
+
+	args := chunkAudioArgs("in.mp3", "out")
+	if got := argAfter(args, "-segment_time"); got != "300" {
+		t.Errorf("-segment_time %s, want 300", got)
+	}
+	if got := argAfter(args, "-b:a"); got != "96k" {
+		t.Errorf("-b:a %s, want mp3's default 96k", got)
+	}
+	if got := args[len(args)-1]; got != filepath.Join("out", "%03d.mp3") {
+		t.Errorf("output pattern %s", got)
+	}
+
+	TranscribeBitrate = "48k"
+	if got := argAfter(chunkAudioArgs("in.mp3", "out"), "-b:a"); got != "48k" {
+		t.Errorf("-b:a %s, want TranscribeBitrate", got)
+	}
+}
+
+// Needs ffmpeg to make the fixture and cut it up
+func TestChunkAudioSegmentCount(t *testing.T) {
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		t.Skip("ffmpeg isn't installed")
+	}
+	useTempContent(t)
+	useChunking(t, 20, "mp3", "32k")
+
+	// 50 seconds of silence, which 20 second chunks cut into 3 files
+	fixture := filepath.Join(Paths.Downloads, "dQw4w9WgXcQ."+audioType)
+	out, err := exec.Command("ffmpeg", "-f", "lavfi", "-i", "anullsrc=r=16000:cl=mono", "-t", "50", "-c:a", "libmp3lame", fixture).CombinedOutput()
+	if err != nil {
+		t.Fatalf("making the fixture: %v\n%s", err, out)
+	}
+
+	entries, err := chunkAudio(context.Background(), "dQw4w9WgXcQ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*entries) != 3 {
+		t.Errorf("got %d chunks %v, want 3", len(*entries), *entries)
+	}
+}
+
+// Fails every chunk with err
+type failingTranscriber struct{ err error }
+
+func (f failingTranscriber) Transcribe(ctx context.Context, filePath string, model string, language string) ([]Segment, error) {
+	return nil, f.err
+}
+
+// Stands in for ffmpeg, leaving two chunks in the video's download directory as if it had split them
+func useSplitChunks(t *testing.T, videoID string) string {
+	t.Helper()
+	useTempContent(t)
+
+	dir := filepath.Join(Paths.Downloads, videoID)
+	chunks := []string{filepath.Join(dir, "000.ogg"), filepath.Join(dir, "001.ogg")}
+
+	old := splitAudio
+	t.Cleanup(func() { splitAudio = old })
+	splitAudio = func(ctx context.Context, videoID string) (*[]string, error) {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+		for _, chunk := range chunks {
+			if err := os.WriteFile(chunk, nil, 0o644); err != nil {
+				return nil, err
+			}
+		}
+		return &chunks, nil
+	}
+
+	useChunkDurations(t, map[string]float64{chunks[0]: 1200, chunks[1]: 300})
+	return dir
+}
+
+func TestTranscribeVideoChunkCleanup(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name        string
+		ctx         context.Context
+		err         error
+		keepsChunks bool
+	}{
+		{"transient failure", context.Background(), &GroqAPIError{StatusCode: 503, Message: "over capacity"}, true},
+		{"rate limited", context.Background(), &RateLimitError{Err: &GroqAPIError{StatusCode: 429}}, true},
+		{"permanent failure", context.Background(), &GroqAPIError{StatusCode: 400, Message: "invalid file"}, false},
+		{"cancelled", cancelled, context.Canceled, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := useSplitChunks(t, "dQw4w9WgXcQ")
+			useTranscriber(t, failingTranscriber{err: tt.err})
+
+			if err := TranscribeVideo(tt.ctx, "dQw4w9WgXcQ", job.JobOptions{}, noProgress); err == nil {
+				t.Fatal("expected the transcription to fail")
+			}
+
+			_, err := os.Stat(dir)
+			if kept := err == nil; kept != tt.keepsChunks {
+				t.Errorf("chunks kept = %v, want %v", kept, tt.keepsChunks)
+			}
+		})
+	}
+}
+
+func TestTranscribeVideoCleansUpAfterWriting(t *testing.T) {
+	dir := useSplitChunks(t, "dQw4w9WgXcQ")
+	useTranscriber(t, fakeTranscriber{
+		filepath.Join(dir, "000.ogg"): {{Start: 0, End: 5, Text: "hello"}},
+		filepath.Join(dir, "001.ogg"): {{Start: 0, End: 5, Text: "goodbye"}},
+	})
+
+	if err := TranscribeVideo(context.Background(), "dQw4w9WgXcQ", job.JobOptions{}, noProgress); err != nil {
+		t.Fatal(err)
+	}
+
+	segments, err := ReadTranscription("dQw4w9WgXcQ")
+	if err != nil || len(segments) != 2 || segments[1].Start != 1200 {
+		t.Errorf("transcription = %+v, %v", segments, err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Error("chunks left behind after the transcription was written")
+	}
+}
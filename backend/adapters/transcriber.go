@@ -0,0 +1,37 @@
+package adapters
+
+import (
+	"context"
+	"fmt"
+)
+
+// Turns one audio chunk into timestamped segments, with timestamps relative to the start of the chunk.
+// Groq Whisper is the only provider so far, but OpenAI or a local whisper.cpp can be plugged in here
+type Transcriber interface {
+	// model is whatever the job or settings asked for. Providers with a single model can ignore it.
+	// A language of "auto" leaves it to the provider to detect
+	Transcribe(ctx context.Context, filePath string, model string, language string) ([]Segment, error)
+}
+
+// Picked from TRANSCRIBE_PROVIDER at startup
+var ActiveTranscriber Transcriber = GroqTranscriber{}
+
+// Transcribes through Groq's hosted Whisper
+type GroqTranscriber struct{}
+
+func (GroqTranscriber) Transcribe(ctx context.Context, filePath string, model string, language string) ([]Segment, error) {
+	payload, err := transcribeFile(ctx, filePath, model, language, "")
+	if err != nil {
+		return nil, err
+	}
+	return payload.Segments, nil
+}
+
+// Maps a TRANSCRIBE_PROVIDER name to its Transcriber. Empty means groq
+func NewTranscriber(provider string) (Transcriber, error) {
+	switch provider {
+	case "", "groq":
+		return GroqTranscriber{}, nil
+	}
+	return nil, fmt.Errorf("unknown transcription provider %q, the only one so far is groq", provider)
+}
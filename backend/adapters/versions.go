@@ -0,0 +1,104 @@
+package adapters
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"go-yt-sum/db"
+
+	"github.com/sergi/go-diff/diffmatchpatch"
+)
+
+// Every summary written is also archived as <Paths.Summaries>/versions/<videoID>/<n>.md, numbered from 1.
+// <Paths.Summaries>/<videoID>.md is always the latest one.
+func summaryVersionsDir(videoID string) string {
+	return filepath.Join(Paths.Summaries, "versions", videoID)
+}
+
+// Highest version saved for a video, 0 if none
+func LatestSummaryVersion(videoID string) (int, error) {
+	entries, err := os.ReadDir(summaryVersionsDir(videoID))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	latest := 0
+	for _, e := range entries {
+		n, err := strconv.Atoi(strings.TrimSuffix(e.Name(), ".md"))
+		if err == nil && n > latest {
+			latest = n
+		}
+	}
+
+	return latest, nil
+}
+
+func saveSummaryVersion(videoID, summary string) error {
+	latest, err := LatestSummaryVersion(videoID)
+	if err != nil {
+		return err
+	}
+
+	dir := summaryVersionsDir(videoID)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(dir, fmt.Sprintf("%d.md", latest+1)), []byte(summary), 0644)
+}
+
+// Replaces the video's summary with a hand edited one, archiving it as a new version like a generated one.
+// The file is swapped in with a rename, so readers never see it half written
+func WriteSummary(videoID, summary string) error {
+	if err := db.AtomicWriteFile(fmt.Sprintf("%s/%s.md", Paths.Summaries, videoID), []byte(summary), 0644); err != nil {
+		return err
+	}
+
+	return saveSummaryVersion(videoID, summary)
+}
+
+// Returns an error satisfying os.IsNotExist if the version was never saved
+func ReadSummaryVersion(videoID string, version int) (string, error) {
+	b, err := os.ReadFile(filepath.Join(summaryVersionsDir(videoID), fmt.Sprintf("%d.md", version)))
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// A run of lines that are the same in both versions, or only present in one of them
+type DiffChunk struct {
+	Op    string   `json:"op"` // "equal", "insert" or "delete"
+	Lines []string `json:"lines"`
+}
+
+// Line-level diff, in order. Rendering "delete" chunks on the left and "insert" chunks on the right gives a side-by-side view
+func DiffSummaries(from, to string) []DiffChunk {
+	dmp := diffmatchpatch.New()
+	a, b, lines := dmp.DiffLinesToChars(from, to)
+	diffs := dmp.DiffCharsToLines(dmp.DiffMain(a, b, false), lines)
+
+	chunks := make([]DiffChunk, 0, len(diffs))
+	for _, d := range diffs {
+		op := "equal"
+		switch d.Type {
+		case diffmatchpatch.DiffInsert:
+			op = "insert"
+		case diffmatchpatch.DiffDelete:
+			op = "delete"
+		}
+
+		chunks = append(chunks, DiffChunk{
+			Op:    op,
+			Lines: strings.Split(strings.TrimSuffix(d.Text, "\n"), "\n"),
+		})
+	}
+
+	return chunks
+}
@@ -0,0 +1,155 @@
+package adapters
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"go-yt-sum/job"
+)
+
+var (
+	// Where job results are POSTed when a job doesn't bring its own. Empty disables webhooks
+	WebhookURL = ""
+	// Prepended to /summaries/<id> and /transcriptions/<id> in webhook payloads, e.g. https://yt-sum.example.com
+	PublicURL = ""
+	// Hosts a per-request X-Webhook-Url may point at without the admin token, from WEBHOOK_ALLOWED_HOSTS
+	WebhookAllowedHosts []string
+
+	webhookTimeout  = 5 * time.Second
+	webhookAttempts = 3
+	webhookBackoff  = time.Second
+)
+
+// Per-request webhooks are dialled through this, so they can't be aimed at the server's own network
+var requestWebhookClient = &http.Client{
+	Transport: &http.Transport{
+		// A proxy would be dialled instead of the webhook's host, and skip the address check
+		Proxy:       nil,
+		DialContext: (&net.Dialer{Timeout: webhookTimeout, Control: refuseNonPublicAddress}).DialContext,
+	},
+}
+
+// Runs on the resolved address, so a hostname that resolves somewhere private is caught too
+func refuseNonPublicAddress(network string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !isPublicIP(ip) {
+		return fmt.Errorf("webhook address %s isn't a public address", host)
+	}
+	return nil
+}
+
+// Shared address space for carrier-grade NAT, which net.IP.IsPrivate doesn't cover
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+func isPublicIP(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+		!ip.IsInterfaceLocalMulticast() && !ip.IsMulticast() && !ip.IsUnspecified() && !sharedAddressSpace.Contains(ip)
+}
+
+// Whether rawURL's host is in WebhookAllowedHosts
+func WebhookHostAllowed(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+
+	for _, host := range WebhookAllowedHosts {
+		if strings.EqualFold(u.Hostname(), host) {
+			return true
+		}
+	}
+	return false
+}
+
+type WebhookPayload struct {
+	VideoID    string `json:"video_id"`
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+	SummaryURL string `json:"summary_url,omitempty"`
+	// Set instead of SummaryURL for transcript-only jobs
+	TranscriptURL string `json:"transcript_url,omitempty"`
+	// The summary is just the transcript, since too little was said to summarize
+	TooSparse bool `json:"too_sparse,omitempty"`
+}
+
+func NewWebhookPayload(videoID string, status string, errMsg string) WebhookPayload {
+	payload := WebhookPayload{VideoID: videoID, Status: status, Error: errMsg}
+	if status == "finished" {
+		payload.SummaryURL = fmt.Sprintf("%s/summaries/%s", PublicURL, videoID)
+	}
+	return payload
+}
+
+// Where a finished job's transcript can be fetched
+func TranscriptURL(videoID string) string {
+	return fmt.Sprintf("%s/transcriptions/%s", PublicURL, videoID)
+}
+
+// Tells the job's webhook, if it has one, how the job ended. Returns straight away, the POST happens in the background.
+// The operator's WEBHOOK_URL may be anywhere, a job's own webhook only at a public address
+func NotifyJobDone(opts job.JobOptions, payload WebhookPayload) {
+	client := httpClient
+	if opts.WebhookURL != "" {
+		client = requestWebhookClient
+	}
+
+	if url := webhookURLFor(opts); url != "" {
+		go notifyWebhook(client, url, payload)
+	}
+}
+
+// Best effort: a few short attempts, then the failure is only logged
+func notifyWebhook(client *http.Client, url string, payload WebhookPayload) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		Logger.Error("failed to encode webhook", "video_id", payload.VideoID, "error", err)
+		return
+	}
+
+	for attempt := 0; attempt < webhookAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(webhookBackoff << (attempt - 1))
+		}
+
+		if err = postWebhook(client, url, body); err == nil {
+			return
+		}
+	}
+
+	Logger.Warn("webhook failed", "video_id", payload.VideoID, "attempts", webhookAttempts, "error", err)
+}
+
+func postWebhook(client *http.Client, url string, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %d", response.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package adapters
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIsPublicIP(t *testing.T) {
+	tests := []struct {
+		ip     string
+		public bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:4700::1111", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"169.254.169.254", false},
+		{"10.0.0.5", false},
+		{"172.16.3.4", false},
+		{"192.168.1.1", false},
+		{"100.64.0.1", false},
+		{"fd00::1", false},
+		{"0.0.0.0", false},
+		{"::ffff:127.0.0.1", false},
+	}
+
+	for _, tt := range tests {
+		if got := isPublicIP(net.ParseIP(tt.ip)); got != tt.public {
+			t.Errorf("isPublicIP(%s) = %v, want %v", tt.ip, got, tt.public)
+		}
+	}
+}
+
+func TestRequestWebhookRefusesLoopback(t *testing.T) {
+	called := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer server.Close()
+
+	if err := postWebhook(requestWebhookClient, server.URL, []byte("{}")); err == nil {
+		t.Fatal("expected a per-request webhook to a loopback address to fail")
+	}
+	if called {
+		t.Fatal("webhook reached the loopback server")
+	}
+
+	if err := postWebhook(httpClient, server.URL, []byte("{}")); err != nil {
+		t.Fatalf("WEBHOOK_URL's client should reach anything, got %v", err)
+	}
+}
+
+func TestWebhookHostAllowed(t *testing.T) {
+	WebhookAllowedHosts = []string{"hooks.example.com"}
+	defer func() { WebhookAllowedHosts = nil }()
+
+	if !WebhookHostAllowed("https://HOOKS.example.com:8443/done") {
+		t.Error("allowlisted host was refused")
+	}
+	if WebhookHostAllowed("https://hooks.example.com.evil.test/done") {
+		t.Error("host merely starting with an allowlisted one was allowed")
+	}
+	if WebhookHostAllowed("http://169.254.169.254/latest") {
+		t.Error("host missing from the allowlist was allowed")
+	}
+}
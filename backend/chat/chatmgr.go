@@ -3,21 +3,63 @@ package chat
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"go-yt-sum/adapters"
+	"go-yt-sum/db"
 	"net/http"
 	"os"
 
 	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
+var ErrChatBusy = errors.New("chat is busy processing another message")
+
+var ErrMessageNotFound = errors.New("no message at that index")
+
+var ErrQueueFull = errors.New("too many messages waiting for an answer, wait for the others first")
+
+// Messages a video's chat holds waiting behind the one being answered, each of them a Groq call to come.
+// From CHAT_MAX_QUEUED_MESSAGES
+var MaxQueuedMessages = 10
+
 func NewChatManager() *ChatManager {
 	return &ChatManager{
 		Chats:   make(map[string]*Chat, 0),
 		Clients: make(map[string]*Client, 0),
+		closed:  make(chan struct{}),
+
+		historyLocks: make(map[string]*historyLock),
+	}
+}
+
+func (chat *Chat) snapshot() chatSnapshot {
+	chat.mu.Lock()
+	defer chat.mu.Unlock()
+
+	return chatSnapshot{
+		VideoID:             chat.VideoID,
+		IsBusy:              chat.IsBusy,
+		InProgressRequestID: chat.InProgressRequestID,
+		InProgressRequest:   chat.InProgressRequest,
+		InProgressResponse:  chat.InProgressResponse,
+		Queued:              len(chat.queue),
 	}
 }
 
+// Writes a full SSE frame and flushes it
+func (c *Client) write(frame string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, err := fmt.Fprint(c.Connection, frame); err != nil {
+		return err
+	}
+	c.Connection.(http.Flusher).Flush()
+	return nil
+}
+
 // Creates new chat if one doesn't exist, then increments
 // Requires the caller to lock
 func (mgr *ChatManager) addListenerLocked(videoID string) *Chat {
@@ -42,34 +84,45 @@ func (mgr *ChatManager) CreateClient(w http.ResponseWriter, videoID string) (str
 	mgr.mu.Lock()
 
 	id := uuid.New().String()
-	mgr.Clients[id] = &Client{
+	client := &Client{
 		ListeningTo: videoID,
 		Connection:  w,
 	}
+	mgr.Clients[id] = client
 
 	// Update num listeners, then take a snapshot of the chat we can send to the client without needing the lock
 	newChat := mgr.addListenerLocked(videoID)
-	chatSnapshot := *newChat
+	snapshot := newChat.snapshot()
 
 	mgr.mu.Unlock()
 
 	// Send them initial chatroom data
 
-	jb, err := json.Marshal(chatSnapshot)
+	jb, err := json.Marshal(snapshot)
 
 	if err != nil {
 		return "", err
 	}
 
 	eventString := fmt.Sprintf("event: init\ndata: %s\n\n", jb)
-	if _, err := fmt.Fprint(w, eventString); err != nil {
+	if err := client.write(eventString); err != nil {
 		return "", err
 	}
-	w.(http.Flusher).Flush()
 
 	return id, nil
 }
 
+// Sends an SSE comment so proxies don't close the connection for being idle
+func (mgr *ChatManager) Heartbeat(clientID string) {
+	mgr.mu.Lock()
+	client, ok := mgr.Clients[clientID]
+	mgr.mu.Unlock()
+
+	if ok {
+		client.write(": keepalive\n\n")
+	}
+}
+
 func (mgr *ChatManager) DeleteClient(clientID string) error {
 	// Create new client
 	mgr.mu.Lock()
@@ -90,7 +143,8 @@ func (mgr *ChatManager) DeleteClient(clientID string) error {
 			chat.NumListeners--
 		}
 
-		if chat.NumListeners == 0 {
+		// A busy chat is removed once its queue drains instead, so a new listener can't start a second queue
+		if chat.NumListeners == 0 && !chat.IsBusy {
 			delete(mgr.Chats, roomID)
 		}
 		chat.mu.Unlock()
@@ -99,69 +153,138 @@ func (mgr *ChatManager) DeleteClient(clientID string) error {
 	return nil
 }
 
-func (mgr *ChatManager) SendMessage(videoID string, message string) error {
+// Sends every client a final shutdown event, then closes Closed so their handlers return
+func (mgr *ChatManager) CloseClients() {
+	mgr.closeOnce.Do(func() {
+		mgr.mu.Lock()
+		for _, client := range mgr.Clients {
+			client.write("event: shutdown\ndata: {}\n\n")
+		}
+		mgr.mu.Unlock()
+
+		close(mgr.closed)
+	})
+}
+
+func (mgr *ChatManager) Closed() <-chan struct{} {
+	return mgr.closed
+}
+
+// Registers a gauge of open chat SSE streams with reg
+func (mgr *ChatManager) RegisterMetrics(reg prometheus.Registerer) error {
+	return reg.Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "ytsum_sse_clients",
+		Help:        "Open SSE streams.",
+		ConstLabels: prometheus.Labels{"stream": "chat"},
+	}, func() float64 {
+		mgr.mu.Lock()
+		defer mgr.mu.Unlock()
+		return float64(len(mgr.Clients))
+	}))
+}
+
+// Queues the message behind any others for the video and returns an ID that tags its events.
+// Returns ErrQueueFull once MaxQueuedMessages are waiting. An empty model uses the chat model from settings
+func (mgr *ChatManager) SendMessage(videoID string, message string, model string) (string, error) {
+	if !adapters.AllowOpenChat && !adapters.HasVideoContext(videoID) {
+		return "", adapters.ErrNoVideoContext
+	}
+
 	mgr.mu.Lock()
 	chat, ok := mgr.Chats[videoID]
 	if !ok {
 		mgr.mu.Unlock()
-		return fmt.Errorf("chat for video %q not found", videoID)
+		return "", fmt.Errorf("chat for video %q not found", videoID)
 	}
 
-	if chat.IsBusy {
+	requestID := uuid.New().String()
+
+	chat.mu.Lock()
+	if len(chat.queue) >= MaxQueuedMessages {
+		chat.mu.Unlock()
 		mgr.mu.Unlock()
-		return fmt.Errorf("chat is busy processing another message")
+		return "", ErrQueueFull
 	}
-
+	chat.queue = append(chat.queue, pendingMessage{RequestID: requestID, Message: message, Model: model})
+	start := !chat.IsBusy
 	chat.IsBusy = true
-	chat.InProgressRequest = message
-	chat.InProgressResponse = ""
+	chat.mu.Unlock()
 	mgr.mu.Unlock()
 
-	// Broadcast that chat is now busy processing this message
-	mgr.broadcastUpdate(videoID)
+	if start {
+		go mgr.processQueue(videoID, chat)
+	}
 
-	// Launch goroutine with context
-	go func() {
-		defer func() {
-			// First broadcast completion signal
-			mgr.broadcastComplete(videoID)
+	// Lets everyone see the queue grow
+	mgr.broadcastUpdate(videoID)
 
-			// Save chat history before clearing state
-			chat.mu.Lock()
-			finalResponse := chat.InProgressResponse
-			chat.mu.Unlock()
+	return requestID, nil
+}
 
-			if finalResponse != "" {
-				mgr.saveChatHistory(videoID, message, finalResponse)
-			}
+// Answers queued messages one at a time, oldest first. Each answer is saved before the next starts,
+// so every message sees the ones before it in its history
+func (mgr *ChatManager) processQueue(videoID string, chat *Chat) {
+	for {
+		mgr.mu.Lock()
+		chat.mu.Lock()
 
-			// Then clear state and broadcast final update
-			chat.mu.Lock()
+		if len(chat.queue) == 0 {
 			chat.IsBusy = false
+			chat.InProgressRequestID = ""
 			chat.InProgressRequest = ""
 			chat.InProgressResponse = ""
-			chat.mu.Unlock()
-			mgr.broadcastUpdate(videoID)
-		}()
 
-		ctx := context.Background()
-		onProgress := func(token string) {
-			chat.mu.Lock()
-			chat.InProgressResponse += token
-			chat.mu.Unlock()
-			mgr.broadcastUpdate(videoID)
-		}
+			// Everyone left while we were busy, DeleteClient left the cleanup to us
+			if chat.NumListeners == 0 && mgr.Chats[videoID] == chat {
+				delete(mgr.Chats, videoID)
+			}
 
-		err := adapters.SendChatMessage(ctx, videoID, message, onProgress)
-		if err != nil {
-			chat.mu.Lock()
-			chat.InProgressResponse = fmt.Sprintf("Error: %s", err.Error())
 			chat.mu.Unlock()
+			mgr.mu.Unlock()
 			mgr.broadcastUpdate(videoID)
+			return
 		}
-	}()
 
-	return nil
+		next := chat.queue[0]
+		chat.queue = chat.queue[1:]
+		chat.InProgressRequestID = next.RequestID
+		chat.InProgressRequest = next.Message
+		chat.InProgressResponse = ""
+
+		chat.mu.Unlock()
+		mgr.mu.Unlock()
+
+		mgr.broadcastUpdate(videoID)
+		mgr.answer(videoID, chat, next)
+	}
+}
+
+func (mgr *ChatManager) answer(videoID string, chat *Chat, msg pendingMessage) {
+	ctx := context.Background()
+	onProgress := func(token string) {
+		chat.mu.Lock()
+		chat.InProgressResponse += token
+		chat.mu.Unlock()
+		mgr.broadcastUpdate(videoID)
+	}
+
+	err := adapters.SendChatMessage(ctx, videoID, msg.Message, msg.Model, onProgress)
+	if err != nil {
+		chat.mu.Lock()
+		chat.InProgressResponse = fmt.Sprintf("Error: %s", err.Error())
+		chat.mu.Unlock()
+		mgr.broadcastUpdate(videoID)
+	}
+
+	mgr.broadcastComplete(videoID, msg.RequestID)
+
+	chat.mu.Lock()
+	finalResponse := chat.InProgressResponse
+	chat.mu.Unlock()
+
+	if finalResponse != "" {
+		mgr.saveChatHistory(videoID, msg.Message, finalResponse)
+	}
 }
 
 func (mgr *ChatManager) broadcastUpdate(videoID string) {
@@ -172,10 +295,9 @@ func (mgr *ChatManager) broadcastUpdate(videoID string) {
 		return
 	}
 
-	chatSnapshot := *chat
 	mgr.mu.Unlock()
 
-	jb, err := json.Marshal(chatSnapshot)
+	jb, err := json.Marshal(chat.snapshot())
 	if err != nil {
 		return
 	}
@@ -185,28 +307,131 @@ func (mgr *ChatManager) broadcastUpdate(videoID string) {
 	mgr.mu.Lock()
 	for _, client := range mgr.Clients {
 		if client.ListeningTo == videoID {
-			fmt.Fprint(client.Connection, eventString)
-			client.Connection.(http.Flusher).Flush()
+			client.write(eventString)
 		}
 	}
 	mgr.mu.Unlock()
 }
 
-func (mgr *ChatManager) broadcastComplete(videoID string) {
-	eventString := "event: complete\ndata: {}\n\n"
+func (mgr *ChatManager) broadcastComplete(videoID string, requestID string) {
+	eventString := fmt.Sprintf("event: complete\ndata: {\"request_id\":%q}\n\n", requestID)
 
 	mgr.mu.Lock()
 	for _, client := range mgr.Clients {
 		if client.ListeningTo == videoID {
-			fmt.Fprint(client.Connection, eventString)
-			client.Connection.(http.Flusher).Flush()
+			client.write(eventString)
 		}
 	}
 	mgr.mu.Unlock()
 }
 
+func chatHistoryPath(videoID string) string {
+	return fmt.Sprintf("%s/%s.json", adapters.Paths.Chats, videoID)
+}
+
+// Anything that changes a video's history file must hold this, so two writers can't both read the old history
+// and have the second write drop the first's messages. Returns the unlock. The lock is only kept while someone
+// holds or waits for it, so there's never more than one per video being written to
+func (mgr *ChatManager) lockHistory(videoID string) func() {
+	mgr.historyLocksMu.Lock()
+	lock, ok := mgr.historyLocks[videoID]
+	if !ok {
+		lock = &historyLock{}
+		mgr.historyLocks[videoID] = lock
+	}
+	lock.refs++
+	mgr.historyLocksMu.Unlock()
+
+	lock.Lock()
+
+	return func() {
+		lock.Unlock()
+
+		mgr.historyLocksMu.Lock()
+		defer mgr.historyLocksMu.Unlock()
+
+		if lock.refs--; lock.refs == 0 {
+			delete(mgr.historyLocks, videoID)
+		}
+	}
+}
+
+// Returns up to limit messages ending just before index before, along with how many messages there are in total.
+// A negative before means the end of the history and a limit of 0 or less means no limit
+func (mgr *ChatManager) LoadHistoryPage(videoID string, limit int, before int) ([]Message, int, error) {
+	history, err := mgr.loadChatHistory(videoID)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	total := len(history)
+	if before < 0 || before > total {
+		before = total
+	}
+
+	start := 0
+	if limit > 0 {
+		start = max(before-limit, 0)
+	}
+
+	return history[start:before], total, nil
+}
+
+// Deletes the video's chat history. Refused while a response is being written, since it would be saved right after
+func (mgr *ChatManager) ClearHistory(videoID string) error {
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
+
+	if chat, ok := mgr.Chats[videoID]; ok && chat.snapshot().IsBusy {
+		return ErrChatBusy
+	}
+
+	defer mgr.lockHistory(videoID)()
+
+	if err := os.Remove(chatHistoryPath(videoID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Removes the user message and assistant reply pair that the message at index belongs to, index being a position
+// in the history like LoadHistoryPage's. Returns how many messages are left. Refused while a response is being written
+func (mgr *ChatManager) DeleteMessage(videoID string, index int) (int, error) {
+	mgr.mu.Lock()
+	defer mgr.mu.Unlock()
+
+	if chat, ok := mgr.Chats[videoID]; ok && chat.snapshot().IsBusy {
+		return 0, ErrChatBusy
+	}
+
+	defer mgr.lockHistory(videoID)()
+
+	history, err := mgr.loadChatHistory(videoID)
+	if err != nil {
+		return 0, err
+	}
+
+	if index < 0 || index >= len(history) {
+		return 0, ErrMessageNotFound
+	}
+
+	start, end := index, index+1
+	if history[index].Role == "assistant" && index > 0 && history[index-1].Role == "user" {
+		start = index - 1
+	} else if history[index].Role == "user" && end < len(history) && history[end].Role == "assistant" {
+		end++
+	}
+
+	history = append(history[:start], history[end:]...)
+	if err := mgr.writeChatHistory(videoID, history); err != nil {
+		return 0, err
+	}
+
+	return len(history), nil
+}
+
 func (mgr *ChatManager) loadChatHistory(videoID string) ([]Message, error) {
-	chatPath := fmt.Sprintf("./content/chats/%s.json", videoID)
+	chatPath := chatHistoryPath(videoID)
 
 	if _, err := os.Stat(chatPath); os.IsNotExist(err) {
 		return []Message{}, nil
@@ -226,6 +451,8 @@ func (mgr *ChatManager) loadChatHistory(videoID string) ([]Message, error) {
 }
 
 func (mgr *ChatManager) saveChatHistory(videoID, userMessage, assistantResponse string) error {
+	defer mgr.lockHistory(videoID)()
+
 	history, err := mgr.loadChatHistory(videoID)
 	if err != nil {
 		return err
@@ -237,16 +464,16 @@ func (mgr *ChatManager) saveChatHistory(videoID, userMessage, assistantResponse
 		Message{Content: assistantResponse, Role: "assistant"},
 	)
 
-	chatPath := fmt.Sprintf("./content/chats/%s.json", videoID)
-
-	if err := os.MkdirAll("./content/chats", os.ModePerm); err != nil {
-		return err
-	}
+	return mgr.writeChatHistory(videoID, history)
+}
 
+// Replaced atomically, so a crash mid-write can't leave half a history behind. The caller must hold the video's
+// history lock
+func (mgr *ChatManager) writeChatHistory(videoID string, history []Message) error {
 	data, err := json.MarshalIndent(history, "", "  ")
 	if err != nil {
 		return err
 	}
 
-	return os.WriteFile(chatPath, data, 0644)
+	return db.AtomicWriteFile(chatHistoryPath(videoID), data, 0644)
 }
@@ -0,0 +1,185 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"go-yt-sum/adapters"
+)
+
+// Content directories under a temp dir for the rest of the test
+func useTempContent(t *testing.T) {
+	t.Helper()
+
+	old := adapters.Paths
+	t.Cleanup(func() { adapters.Paths = old })
+	adapters.Paths = adapters.NewContentPaths(t.TempDir())
+}
+
+// Run with -race: both writers read and rewrite the same file
+func TestSaveChatHistoryBackToBack(t *testing.T) {
+	useTempContent(t)
+	mgr := NewChatManager()
+
+	const videoID = "dQw4w9WgXcQ"
+	var wg sync.WaitGroup
+	for i := range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := mgr.saveChatHistory(videoID, fmt.Sprintf("question %d", i), fmt.Sprintf("answer %d", i)); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	history, err := mgr.loadChatHistory(videoID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 4 {
+		t.Fatalf("history has %d messages, want both pairs: %+v", len(history), history)
+	}
+	for i := 0; i < len(history); i += 2 {
+		if history[i].Role != "user" || history[i+1].Role != "assistant" {
+			t.Errorf("pairs interleaved: %+v", history)
+		}
+	}
+
+	mgr.historyLocksMu.Lock()
+	defer mgr.historyLocksMu.Unlock()
+	if len(mgr.historyLocks) != 0 {
+		t.Errorf("%d history locks left behind once nobody holds them", len(mgr.historyLocks))
+	}
+}
+
+// Answers every chat request with "answer to <last user message>", holding each one until release gets a value
+func stubChatGroq(t *testing.T, release chan struct{}) *[][]adapters.ChatMessage {
+	t.Helper()
+
+	var mu sync.Mutex
+	requests := make([][]adapters.ChatMessage, 0)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req adapters.GroqChatRequest
+		json.NewDecoder(r.Body).Decode(&req)
+
+		mu.Lock()
+		requests = append(requests, req.Messages)
+		mu.Unlock()
+
+		<-release
+
+		last := req.Messages[len(req.Messages)-1].Content
+		fmt.Fprintf(w, "data: {\"choices\": [{\"delta\": {\"content\": %q}}]}\n\ndata: [DONE]\n\n", "answer to "+last)
+	}))
+
+	oldOpen := adapters.AllowOpenChat
+	t.Cleanup(func() {
+		server.Close()
+		adapters.AllowOpenChat = oldOpen
+		adapters.Init("", "", nil)
+	})
+
+	adapters.AllowOpenChat = true
+	adapters.Init("", "test-key", nil)
+	adapters.SetGroqClient(server.Client(), server.URL)
+	return &requests
+}
+
+func waitForHistory(t *testing.T, mgr *ChatManager, videoID string, n int) []Message {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		history, err := mgr.loadChatHistory(videoID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(history) >= n {
+			return history
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("history has %d messages after 5s, want %d", len(history), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestQueuedMessagesAnsweredInOrder(t *testing.T) {
+	useTempContent(t)
+	release := make(chan struct{})
+	requests := stubChatGroq(t, release)
+
+	const videoID = "dQw4w9WgXcQ"
+	mgr := NewChatManager()
+	if _, err := mgr.CreateClient(httptest.NewRecorder(), videoID); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, msg := range []string{"first", "second", "third"} {
+		if _, err := mgr.SendMessage(videoID, msg, "model"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(release)
+
+	history := waitForHistory(t, mgr, videoID, 6)
+	want := []string{"first", "answer to first", "second", "answer to second", "third", "answer to third"}
+	for i, m := range history {
+		if m.Content != want[i] {
+			t.Fatalf("history out of order: %+v", history)
+		}
+	}
+
+	// Each answer was saved before the next message went out, so the third saw both earlier pairs
+	third := (*requests)[2]
+	if len(third) < 5 || third[len(third)-2].Content != "answer to second" {
+		t.Errorf("third request didn't carry the history before it: %+v", third)
+	}
+}
+
+func TestSendMessageQueueLimit(t *testing.T) {
+	useTempContent(t)
+	release := make(chan struct{})
+	stubChatGroq(t, release)
+
+	oldMax := MaxQueuedMessages
+	MaxQueuedMessages = 1
+	defer func() { MaxQueuedMessages = oldMax }()
+
+	const videoID = "dQw4w9WgXcQ"
+	mgr := NewChatManager()
+	if _, err := mgr.CreateClient(httptest.NewRecorder(), videoID); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first is taken off the queue to be answered, the second waits behind it
+	if _, err := mgr.SendMessage(videoID, "first", "model"); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for mgr.Chats[videoID].snapshot().InProgressRequest != "first" {
+		if time.Now().After(deadline) {
+			t.Fatal("first message never started")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if _, err := mgr.SendMessage(videoID, "second", "model"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := mgr.SendMessage(videoID, "third", "model"); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("third message: err = %v, want ErrQueueFull", err)
+	}
+
+	close(release)
+	waitForHistory(t, mgr, videoID, 4)
+}
@@ -9,16 +9,42 @@ type Chat struct {
 	VideoID string `json:"video_id"`
 	IsBusy  bool   `json:"is_busy"`
 
-	InProgressRequest  string `json:"request"`
-	InProgressResponse string `json:"response"`
+	InProgressRequestID string `json:"request_id"`
+	InProgressRequest   string `json:"request"`
+	InProgressResponse  string `json:"response"`
+
+	// Messages sent while another was being answered, oldest first
+	queue []pendingMessage
 
 	NumListeners int        `json:"-"`
 	mu           sync.Mutex `json:"-"`
 }
 
+type pendingMessage struct {
+	RequestID string
+	Message   string
+	Model     string
+}
+
+// What clients are sent. Chat itself can't be copied or marshalled while someone might hold its lock
+type chatSnapshot struct {
+	VideoID string `json:"video_id"`
+	IsBusy  bool   `json:"is_busy"`
+
+	InProgressRequestID string `json:"request_id"`
+	InProgressRequest   string `json:"request"`
+	InProgressResponse  string `json:"response"`
+
+	// Messages waiting behind the one in progress
+	Queued int `json:"queued"`
+}
+
 type Client struct {
 	ListeningTo string
 	Connection  http.ResponseWriter
+
+	// Broadcasts and heartbeats come from different goroutines, this keeps their frames from interleaving
+	mu sync.Mutex
 }
 
 type ChatManager struct {
@@ -26,9 +52,23 @@ type ChatManager struct {
 	// Maps clientID to
 	Clients map[string]*Client `json:"-"`
 
+	// Closed by CloseClients, telling SSE handlers to end their streams
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	// One lock per video, held for the whole read-modify-write of its history file. See lockHistory
+	historyLocks   map[string]*historyLock
+	historyLocksMu sync.Mutex
+
 	mu sync.Mutex `json:"-"`
 }
 
+// refs counts who holds or waits for the lock, guarded by historyLocksMu
+type historyLock struct {
+	sync.Mutex
+	refs int
+}
+
 type Message struct {
 	Content string `json:"content"`
 	Role    string `json:"role"`
@@ -1,11 +1,13 @@
 package db
 
 import (
+	"bytes"
 	"encoding/json"
 	"log"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 )
 
 type VideoEntry struct {
@@ -16,8 +18,19 @@ type VideoEntry struct {
 	Length            float64 `json:"length"`
 	UploadDate        string  `json:"upload_date"`
 
+	// The page the video was downloaded from. Empty for YouTube videos, whose ID is enough
+	SourceURL string `json:"source_url,omitempty"`
+
 	JobFailed bool   `json:"job_failed"`
 	LastError string `json:"last_error"`
+
+	// The stored summary is just the transcript, since too little was said in the video to summarize
+	TooSparse bool `json:"too_sparse,omitempty"`
+
+	// Timing of the last successful job
+	QueuedAt   time.Time `json:"queued_at,omitzero"`
+	StartedAt  time.Time `json:"started_at,omitzero"`
+	FinishedAt time.Time `json:"finished_at,omitzero"`
 }
 
 // Maps VideoID to VideoEntry (which is just video metadata)
@@ -65,6 +78,8 @@ func (db *DB) Delete(VideoID string) {
 	db.Lock.Lock()
 	delete(db.Data, VideoID)
 	db.Lock.Unlock()
+
+	db.SaveToFile()
 }
 
 func (db *DB) Create(VideoID string, Entry VideoEntry) {
@@ -106,41 +121,16 @@ func (db *DB) SaveToFile() {
 		return
 	}
 
-	dir := filepath.Dir(db.FilePath)
-	if err := os.MkdirAll(dir, 0o755); err != nil {
-		log.Printf("SaveToFile: mkdir %s: %v", dir, err)
-		return
-	}
-
-	tmp, err := os.CreateTemp(dir, ".db-*.json")
-	if err != nil {
-		log.Printf("SaveToFile: create temp: %v", err)
-		return
-	}
-	defer func() {
-		_ = os.Remove(tmp.Name()) // no-op if renamed
-	}()
-
-	enc := json.NewEncoder(tmp)
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
 	enc.SetIndent("", "  ")
 	if err := enc.Encode(db); err != nil {
-		_ = tmp.Close()
 		log.Printf("SaveToFile: encode json: %v", err)
 		return
 	}
 
-	if err := tmp.Sync(); err != nil {
-		_ = tmp.Close()
-		log.Printf("SaveToFile: fsync: %v", err)
-		return
-	}
-	if err := tmp.Close(); err != nil {
-		log.Printf("SaveToFile: close: %v", err)
-		return
-	}
-
-	if err := os.Rename(tmp.Name(), db.FilePath); err != nil {
-		log.Printf("SaveToFile: rename: %v", err)
+	if err := AtomicWriteFile(db.FilePath, buf.Bytes(), 0o644); err != nil {
+		log.Printf("SaveToFile: %v", err)
 		return
 	}
 }
@@ -160,6 +150,36 @@ func (db *DB) SetJobFailed(videoID string, failed bool, errorMsg string) {
 	}
 }
 
+// SetJobTimes records when the video's job was queued, started and finished
+func (db *DB) SetJobTimes(videoID string, queued, started, finished time.Time) {
+	db.Lock.Lock()
+
+	if entry, exists := db.Data[videoID]; exists {
+		entry.QueuedAt = queued
+		entry.StartedAt = started
+		entry.FinishedAt = finished
+		db.Data[videoID] = entry
+		db.Lock.Unlock()
+		db.SaveToFile()
+	} else {
+		db.Lock.Unlock()
+	}
+}
+
+// SetTooSparse records whether the video's summary is the raw transcript standing in for one
+func (db *DB) SetTooSparse(videoID string, tooSparse bool) {
+	db.Lock.Lock()
+
+	if entry, exists := db.Data[videoID]; exists {
+		entry.TooSparse = tooSparse
+		db.Data[videoID] = entry
+		db.Lock.Unlock()
+		db.SaveToFile()
+	} else {
+		db.Lock.Unlock()
+	}
+}
+
 // UpdateJobSuccess marks a job as successful and clears failure state
 func (db *DB) UpdateJobSuccess(videoID string) {
 	db.SetJobFailed(videoID, false, "")
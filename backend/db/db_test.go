@@ -0,0 +1,42 @@
+package db
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewDBCreatesFileAtPath(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+
+	db, err := NewDB("./tmp/x/db.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(filepath.Join(dir, "tmp", "x", "db.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Mode().IsRegular() {
+		t.Fatalf("db.json is a %s, want a regular file", info.Mode().Type())
+	}
+
+	// Nothing ends up next to it or in the working directory
+	if _, err := os.Stat(filepath.Join(dir, "db.json")); !os.IsNotExist(err) {
+		t.Error("db.json was also created in the working directory")
+	}
+
+	// What's saved reads back through the same path
+	db.Create("dQw4w9WgXcQ", VideoEntry{VideoID: "dQw4w9WgXcQ", VideoName: "Never Gonna Give You Up"})
+	db.SaveToFile()
+
+	reopened, err := NewDB("./tmp/x/db.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reopened.Read("dQw4w9WgXcQ").VideoName; got != "Never Gonna Give You Up" {
+		t.Errorf("reopened entry has name %q", got)
+	}
+}
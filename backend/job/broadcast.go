@@ -0,0 +1,101 @@
+package job
+
+import (
+	"sync"
+)
+
+// Most clients written to at the same time by one broadcast, so a slow client doesn't hold up the rest
+var BroadcastConcurrency = 8
+
+type queuedEvent struct {
+	eventType string
+	data      []byte
+}
+
+// Job events waiting to be written to clients, at most one per key, which is normally the job's video ID.
+// A newer update replaces the queued one, since clients only care about the latest state
+type broadcastQueue struct {
+	mu      sync.Mutex
+	pending map[string]queuedEvent
+	order   []string
+	ready   chan struct{}
+}
+
+func newBroadcastQueue() *broadcastQueue {
+	return &broadcastQueue{
+		pending: make(map[string]queuedEvent),
+		ready:   make(chan struct{}, 1),
+	}
+}
+
+// Never blocks, so it's safe to call from the pipeline while holding a job's lock
+func (q *broadcastQueue) push(key string, eventType string, data []byte) {
+	q.mu.Lock()
+	if queued, ok := q.pending[key]; ok {
+		// Clients that haven't seen "new" yet still need it, just with the latest data. Unless the job is being
+		// evicted, when clients need to hear that it's gone more
+		if queued.eventType == "new" && eventType != "evicted" {
+			eventType = "new"
+		}
+	} else {
+		q.order = append(q.order, key)
+	}
+	q.pending[key] = queuedEvent{eventType: eventType, data: data}
+	q.mu.Unlock()
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Takes everything queued so far, oldest job first
+func (q *broadcastQueue) drain() []queuedEvent {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	events := make([]queuedEvent, 0, len(q.order))
+	for _, id := range q.order {
+		events = append(events, q.pending[id])
+	}
+
+	q.pending = make(map[string]queuedEvent)
+	q.order = nil
+	return events
+}
+
+func (manager *ActiveJobsManager) broadcastLoop() {
+	for range manager.broadcasts.ready {
+		events := manager.broadcasts.drain()
+		if len(events) == 0 {
+			continue
+		}
+
+		manager.writeToClients(events)
+	}
+}
+
+// Each client gets every event in order. Different clients are written to in parallel, up to BroadcastConcurrency.
+// Every write has a deadline, see clientWriteTimeout, so a stalled client holds up the next broadcast only that long
+func (manager *ActiveJobsManager) writeToClients(events []queuedEvent) {
+	slots := make(chan struct{}, max(BroadcastConcurrency, 1))
+	var wg sync.WaitGroup
+
+	for _, client := range manager.clientSnapshot() {
+		slots <- struct{}{}
+		wg.Add(1)
+
+		go func(c *Client) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+
+			for _, e := range events {
+				c.send(e.eventType, e.data)
+			}
+		}(client)
+	}
+
+	wg.Wait()
+}
@@ -0,0 +1,177 @@
+package job
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Records every event written to it. Writes block while stall is open, like a client that stopped reading
+type fakeConn struct {
+	stall chan struct{}
+
+	mu     sync.Mutex
+	events []string
+}
+
+func (c *fakeConn) WriteEvent(eventType string, data []byte) error {
+	if c.stall != nil {
+		<-c.stall
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.events = append(c.events, eventType)
+	return nil
+}
+
+func (c *fakeConn) Heartbeat() error {
+	return c.WriteEvent("heartbeat", nil)
+}
+
+func (c *fakeConn) received(eventType string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, e := range c.events {
+		if e == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// Fails the test if f hasn't returned within a second
+func within(t *testing.T, what string, f func()) {
+	t.Helper()
+
+	done := make(chan struct{})
+	go func() {
+		f()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("%s blocked behind a stalled client", what)
+	}
+}
+
+func TestStalledClientDoesNotBlockOthers(t *testing.T) {
+	manager := newMemoryManager(t)
+
+	fast := &fakeConn{}
+	fastID := manager.CreateClient(fast)
+
+	slow := &fakeConn{}
+	manager.CreateClient(slow)
+	// Stalls from here on, after its init went out
+	slow.stall = make(chan struct{})
+	defer close(slow.stall)
+
+	j := newSummaryJob("dQw4w9WgXcQ", JobOptions{}, func(*SummaryJob) {})
+	manager.BroadcastJobData(j, "new")
+
+	deadline := time.Now().Add(time.Second)
+	for !fast.received("new") {
+		if time.Now().After(deadline) {
+			t.Fatal("fast client never got the broadcast")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// The broadcast is still stuck writing to the slow client, none of these may wait for it
+	within(t, "Heartbeat", func() { manager.Heartbeat(fastID) })
+	within(t, "CreateClient", func() { manager.DeleteClient(manager.CreateClient(&fakeConn{})) })
+	within(t, "DeleteClient", func() { manager.DeleteClient(fastID) })
+}
+
+func TestQueuedNewDoesNotHideEvicted(t *testing.T) {
+	q := newBroadcastQueue()
+
+	q.push("a", "new", []byte("1"))
+	q.push("a", "update", []byte("2"))
+	if events := q.drain(); len(events) != 1 || events[0].eventType != "new" || string(events[0].data) != "2" {
+		t.Errorf("queued new followed by an update = %+v, want new with the latest data", events)
+	}
+
+	q.push("a", "new", []byte("1"))
+	q.push("a", "evicted", []byte("2"))
+	if events := q.drain(); len(events) != 1 || events[0].eventType != "evicted" {
+		t.Errorf("queued new followed by evicted = %+v, want evicted", events)
+	}
+}
+
+// Notices two writes to it overlapping, which would interleave their frames on a real connection
+type overlapConn struct {
+	inFlight   atomic.Int32
+	overlapped atomic.Bool
+
+	mu    sync.Mutex
+	first string
+}
+
+func (c *overlapConn) WriteEvent(eventType string, data []byte) error {
+	if c.inFlight.Add(1) > 1 {
+		c.overlapped.Store(true)
+	}
+	defer c.inFlight.Add(-1)
+
+	c.mu.Lock()
+	if c.first == "" {
+		c.first = eventType
+	}
+	c.mu.Unlock()
+
+	time.Sleep(100 * time.Microsecond)
+	return nil
+}
+
+func (c *overlapConn) Heartbeat() error {
+	return c.WriteEvent("heartbeat", nil)
+}
+
+// Meant for go test -race: clients come and go while jobs update, and no connection sees two writes at once
+func TestClientsOpenWhileJobsUpdate(t *testing.T) {
+	manager := newMemoryManager(t)
+
+	var wg sync.WaitGroup
+	for _, id := range []string{"dQw4w9WgXcQ", "9bZkp7q19f0", "kJQP7kiw5Fk"} {
+		_, j := manager.CreateJob(id, JobOptions{})
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 50 {
+				j.UpdateJob(func(j *SummaryJob) { j.Progress.ChunksSummarized++ })
+			}
+		}()
+	}
+
+	conns := make([]*overlapConn, 20)
+	for i := range conns {
+		conns[i] = &overlapConn{}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id := manager.CreateClient(conns[i])
+			manager.Heartbeat(id)
+			time.Sleep(time.Millisecond)
+			manager.DeleteClient(id)
+		}()
+	}
+
+	wg.Wait()
+
+	for i, conn := range conns {
+		if conn.overlapped.Load() {
+			t.Errorf("client %d had writes overlap", i)
+		}
+		if conn.first != "init" {
+			t.Errorf("client %d got %q first, want init", i, conn.first)
+		}
+	}
+}
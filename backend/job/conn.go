@@ -0,0 +1,75 @@
+package job
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// How a client receives job events. The same events go out over SSE or a WebSocket, each framed its own way
+type ClientConn interface {
+	// data is the event's JSON payload
+	WriteEvent(eventType string, data []byte) error
+	// Keeps the connection from looking idle to proxies
+	Heartbeat() error
+}
+
+// Give up on a write to a client after this long, so a stalled client can't hold up a broadcast forever
+var clientWriteTimeout = 10 * time.Second
+
+type sseConn struct {
+	w  http.ResponseWriter
+	rc *http.ResponseController
+}
+
+// w must support flushing and write deadlines, as net/http's ResponseWriter does
+func NewSSEConn(w http.ResponseWriter) ClientConn {
+	return sseConn{w: w, rc: http.NewResponseController(w)}
+}
+
+// Writes a full SSE frame and flushes it
+func (c sseConn) WriteEvent(eventType string, data []byte) error {
+	return c.write(fmt.Sprintf("event: %s\ndata: %s\n\n", eventType, data))
+}
+
+func (c sseConn) Heartbeat() error {
+	return c.write(": keepalive\n\n")
+}
+
+// The stream has no deadline between writes, only while one is in progress
+func (c sseConn) write(frame string) error {
+	c.rc.SetWriteDeadline(time.Now().Add(clientWriteTimeout))
+	defer c.rc.SetWriteDeadline(time.Time{})
+
+	if _, err := fmt.Fprint(c.w, frame); err != nil {
+		return err
+	}
+	return c.rc.Flush()
+}
+
+// A WebSocket message carrying one job event, the JSON equivalent of an SSE frame
+type WSEvent struct {
+	Event string          `json:"event"`
+	Data  json.RawMessage `json:"data"`
+}
+
+type wsConn struct {
+	conn *websocket.Conn
+}
+
+// The caller keeps reading from conn. Writes must only go through the returned ClientConn
+func NewWSConn(conn *websocket.Conn) ClientConn {
+	return wsConn{conn: conn}
+}
+
+func (c wsConn) WriteEvent(eventType string, data []byte) error {
+	c.conn.SetWriteDeadline(time.Now().Add(clientWriteTimeout))
+	return c.conn.WriteJSON(WSEvent{Event: eventType, Data: data})
+}
+
+func (c wsConn) Heartbeat() error {
+	return c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(clientWriteTimeout))
+}
@@ -0,0 +1,82 @@
+package job
+
+import "time"
+
+// Jobs that finished, failed or were cancelled are dropped from memory this long after they ended.
+// Their outcome is still in the DB. 0 keeps them for as long as the server runs
+var JobTTL = time.Hour
+
+// How often the eviction loop looks for expired jobs
+var evictionInterval = time.Minute
+
+func (manager *ActiveJobsManager) evictionLoop() {
+	ticker := time.NewTicker(evictionInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if evicted := manager.EvictExpiredJobs(time.Now().Add(-JobTTL)); evicted > 0 {
+			manager.Logger.Info("evicted expired jobs", "jobs", evicted, "ttl", JobTTL)
+		}
+	}
+}
+
+// Removes every job that ended before cutoff, once the DB has its final state. Clients get an "evicted" event
+// with the job's last state before it goes. Returns how many jobs were removed
+func (manager *ActiveJobsManager) EvictExpiredJobs(cutoff time.Time) int {
+	evicted := 0
+
+	for id, job := range manager.GetAllJobs() {
+		if !job.IsTerminal() || !job.endedBefore(cutoff) {
+			continue
+		}
+
+		manager.recordFinalState(job)
+
+		manager.Lock.Lock()
+		// A retry may have replaced the job since it was listed
+		if manager.Jobs[id] == job {
+			job.Lock.RLock()
+			manager.BroadcastJobData(job, "evicted")
+			job.Lock.RUnlock()
+
+			delete(manager.Jobs, id)
+			evicted++
+		}
+		manager.Lock.Unlock()
+	}
+
+	if evicted > 0 {
+		manager.markDirty()
+	}
+	return evicted
+}
+
+func (job *SummaryJob) endedBefore(cutoff time.Time) bool {
+	job.Lock.RLock()
+	defer job.Lock.RUnlock()
+
+	return !job.FinishedAt.IsZero() && job.FinishedAt.Before(cutoff)
+}
+
+// The pipeline records how a job ended as it happens, but jobs restored from a checkpoint may never have been
+// written, so this writes it again before the job is forgotten. Times are only kept for finished jobs, as the DB
+// holds the timing of the last successful job. Cancelling isn't a failure, so a cancelled job leaves the DB as it was
+func (manager *ActiveJobsManager) recordFinalState(job *SummaryJob) {
+	job.Lock.RLock()
+	status, errMsg := job.Status, job.Error
+	queued, started, finished := job.QueuedAt, job.StartedAt, job.FinishedAt
+	tooSparse := job.Progress.TooSparse
+	job.Lock.RUnlock()
+
+	switch status {
+	case "finished":
+		manager.DB.UpdateJobSuccess(job.VideoID)
+		manager.DB.SetJobTimes(job.VideoID, queued, started, finished)
+		if job.Options.WritesFullSummary() {
+			manager.DB.SetTooSparse(job.VideoID, tooSparse)
+		}
+	case "cancelled":
+	default:
+		manager.DB.SetJobFailed(job.VideoID, true, errMsg)
+	}
+}
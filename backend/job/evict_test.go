@@ -0,0 +1,70 @@
+package job
+
+import (
+	"testing"
+	"time"
+
+	"go-yt-sum/db"
+)
+
+func TestEvictRecordsOnlyWhatTheJobProved(t *testing.T) {
+	manager := newMemoryManager(t)
+
+	lastSuccess := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, id := range []string{"cancelledID", "failedID00", "finishedID"} {
+		manager.DB.Create(id, db.VideoEntry{FinishedAt: lastSuccess})
+	}
+
+	ended := time.Now().Add(-2 * time.Hour)
+	add := func(id string, status string) {
+		j := newSummaryJob(id, JobOptions{}, func(*SummaryJob) {})
+		j.Status = status
+		j.Error = status
+		j.QueuedAt, j.StartedAt, j.FinishedAt = ended, ended, ended
+		manager.Jobs[id] = j
+	}
+	add("cancelledID", "cancelled")
+	add("failedID00", "failed")
+	add("finishedID", "finished")
+
+	if evicted := manager.EvictExpiredJobs(time.Now().Add(-time.Hour)); evicted != 3 {
+		t.Fatalf("evicted %d jobs, want 3", evicted)
+	}
+
+	if e := manager.DB.Read("cancelledID"); e.JobFailed || !e.FinishedAt.Equal(lastSuccess) {
+		t.Errorf("cancelled job changed the DB: job_failed=%v finished_at=%v", e.JobFailed, e.FinishedAt)
+	}
+	if e := manager.DB.Read("failedID00"); !e.JobFailed || !e.FinishedAt.Equal(lastSuccess) {
+		t.Errorf("failed job should be marked failed and keep the last success's times: job_failed=%v finished_at=%v", e.JobFailed, e.FinishedAt)
+	}
+	if e := manager.DB.Read("finishedID"); e.JobFailed || !e.FinishedAt.Equal(ended) {
+		t.Errorf("finished job should record its times: job_failed=%v finished_at=%v", e.JobFailed, e.FinishedAt)
+	}
+}
+
+func TestEvictKeepsTooSparse(t *testing.T) {
+	manager := newMemoryManager(t)
+	manager.DB.Create("sparseID00", db.VideoEntry{})
+	manager.DB.Create("rangeID000", db.VideoEntry{TooSparse: true})
+
+	ended := time.Now().Add(-2 * time.Hour)
+	add := func(id string, opts JobOptions) {
+		j := newSummaryJob(id, opts, func(*SummaryJob) {})
+		j.Status = "finished"
+		j.Progress.TooSparse = id == "sparseID00"
+		j.QueuedAt, j.StartedAt, j.FinishedAt = ended, ended, ended
+		manager.Jobs[id] = j
+	}
+	add("sparseID00", JobOptions{})
+	// A range summary says nothing about the video's own summary
+	add("rangeID000", JobOptions{StartSeconds: 60})
+
+	manager.EvictExpiredJobs(time.Now().Add(-time.Hour))
+
+	if !manager.DB.Read("sparseID00").TooSparse {
+		t.Error("too_sparse was lost when the job was evicted")
+	}
+	if !manager.DB.Read("rangeID000").TooSparse {
+		t.Error("a range job overwrote the full summary's too_sparse")
+	}
+}
@@ -0,0 +1,68 @@
+package job
+
+import (
+	"errors"
+	"time"
+)
+
+// How long an Idempotency-Key keeps answering with the job it first created. From IDEMPOTENCY_TTL_SECONDS
+var IdempotencyTTL = 10 * time.Minute
+
+// The key's first request is still being submitted, so it isn't known yet whether it will succeed
+var ErrIdempotencyKeyPending = errors.New("a request with this Idempotency-Key is still being handled")
+
+// The key was already used for a request for another video
+var ErrIdempotencyKeyReused = errors.New("Idempotency-Key was already used for another video")
+
+type idempotencyEntry struct {
+	videoID string
+	at      time.Time
+	// Claimed but not yet settled or released
+	pending bool
+}
+
+// Ties key to videoID, pending until SettleIdempotencyKey or ReleaseIdempotencyKey is called, and returns true.
+// Returns false if the key already got its job submitted within IdempotencyTTL, in which case the request is a
+// repeat and nothing should be submitted
+func (manager *ActiveJobsManager) ClaimIdempotencyKey(key string, videoID string) (bool, error) {
+	manager.idempotencyLock.Lock()
+	defer manager.idempotencyLock.Unlock()
+
+	now := time.Now()
+	for k, e := range manager.idempotencyKeys {
+		if !e.pending && now.Sub(e.at) > IdempotencyTTL {
+			delete(manager.idempotencyKeys, k)
+		}
+	}
+
+	if e, ok := manager.idempotencyKeys[key]; ok {
+		switch {
+		case e.videoID != videoID:
+			return false, ErrIdempotencyKeyReused
+		case e.pending:
+			return false, ErrIdempotencyKeyPending
+		}
+		return false, nil
+	}
+
+	manager.idempotencyKeys[key] = idempotencyEntry{videoID: videoID, at: now, pending: true}
+	return true, nil
+}
+
+// Keeps a claimed key once its job is submitted, so repeats within IdempotencyTTL are answered as it was
+func (manager *ActiveJobsManager) SettleIdempotencyKey(key string) {
+	manager.idempotencyLock.Lock()
+	defer manager.idempotencyLock.Unlock()
+
+	if e, ok := manager.idempotencyKeys[key]; ok {
+		manager.idempotencyKeys[key] = idempotencyEntry{videoID: e.videoID, at: time.Now()}
+	}
+}
+
+// Gives up a key whose request never got its job submitted, so a retry with it can try again
+func (manager *ActiveJobsManager) ReleaseIdempotencyKey(key string) {
+	manager.idempotencyLock.Lock()
+	defer manager.idempotencyLock.Unlock()
+
+	delete(manager.idempotencyKeys, key)
+}
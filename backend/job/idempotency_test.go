@@ -0,0 +1,62 @@
+package job
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyKeyPendingUntilSettled(t *testing.T) {
+	manager := newMemoryManager(t)
+
+	if fresh, err := manager.ClaimIdempotencyKey("key", "dQw4w9WgXcQ"); !fresh || err != nil {
+		t.Fatalf("first claim = %v, %v, want fresh", fresh, err)
+	}
+
+	// The first request hasn't been submitted yet, so a concurrent repeat can't be told it succeeded
+	if _, err := manager.ClaimIdempotencyKey("key", "dQw4w9WgXcQ"); !errors.Is(err, ErrIdempotencyKeyPending) {
+		t.Errorf("concurrent repeat: err = %v, want ErrIdempotencyKeyPending", err)
+	}
+
+	manager.SettleIdempotencyKey("key")
+	if fresh, err := manager.ClaimIdempotencyKey("key", "dQw4w9WgXcQ"); fresh || err != nil {
+		t.Errorf("repeat after settling = %v, %v, want a repeat", fresh, err)
+	}
+
+	if _, err := manager.ClaimIdempotencyKey("key", "9bZkp7q19f0"); !errors.Is(err, ErrIdempotencyKeyReused) {
+		t.Errorf("another video: err = %v, want ErrIdempotencyKeyReused", err)
+	}
+}
+
+func TestIdempotencyKeyReleasedOnFailure(t *testing.T) {
+	manager := newMemoryManager(t)
+
+	manager.ClaimIdempotencyKey("key", "dQw4w9WgXcQ")
+	manager.ReleaseIdempotencyKey("key")
+
+	// The first attempt failed, so its retry gets to submit
+	if fresh, err := manager.ClaimIdempotencyKey("key", "dQw4w9WgXcQ"); !fresh || err != nil {
+		t.Errorf("retry after release = %v, %v, want fresh", fresh, err)
+	}
+}
+
+func TestIdempotencyKeyExpires(t *testing.T) {
+	manager := newMemoryManager(t)
+
+	oldTTL := IdempotencyTTL
+	IdempotencyTTL = time.Millisecond
+	defer func() { IdempotencyTTL = oldTTL }()
+
+	manager.ClaimIdempotencyKey("pending", "dQw4w9WgXcQ")
+	manager.ClaimIdempotencyKey("settled", "9bZkp7q19f0")
+	manager.SettleIdempotencyKey("settled")
+	time.Sleep(5 * time.Millisecond)
+
+	if fresh, _ := manager.ClaimIdempotencyKey("settled", "9bZkp7q19f0"); !fresh {
+		t.Error("settled key outlived IdempotencyTTL")
+	}
+	// A request still being handled keeps its claim however long it takes
+	if _, err := manager.ClaimIdempotencyKey("pending", "dQw4w9WgXcQ"); !errors.Is(err, ErrIdempotencyKeyPending) {
+		t.Errorf("pending key after the TTL: err = %v, want ErrIdempotencyKeyPending", err)
+	}
+}
@@ -1,8 +1,12 @@
 package job
 
 import (
+	"context"
 	"go-yt-sum/db"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 // ---
@@ -11,12 +15,98 @@ type JobProgress struct {
 	VideoMeta        *db.VideoEntry
 	PercentageString string `json:"percentage_string"`
 
+	// Whether the transcript comes from the video's captions rather than transcribing its audio. Set by the download stage
 	HadCaptions         bool `json:"had_captions"`
 	TranscriptionChunks int  `json:"transcription_chunks"`
 	ChunksTranscribed   int  `json:"transcription_chunks_transcribed"`
 
+	// How many times a stage has been rerun after a transient error
+	StageRetries int `json:"stage_retries,omitempty"`
+
+	// Which yt-dlp attempt the download is on, out of how many, while it retries a transient failure. 0 otherwise
+	DownloadAttempt  int `json:"download_attempt,omitempty"`
+	DownloadAttempts int `json:"download_attempts,omitempty"`
+
+	// When the download stage first found the video to be a stream that hasn't ended, under the wait policy
+	StreamWaitStartedAt time.Time `json:"stream_wait_started_at,omitzero"`
+
+	// Set when the transcript was too sparse to summarize, and the summary is just the transcript
+	TooSparse bool `json:"too_sparse,omitempty"`
+
 	SummaryChunks    int `json:"summary_chunks"`
 	ChunksSummarized int `json:"summary_chunks_transcribed"`
+
+	// The summary as of the last finished chunk, so clients can preview it before the job is done
+	InProgressSummary string `json:"in_progress_summary,omitempty"`
+
+	// The summary the current chunk is producing, token by token. Only set with adapters.StreamSummaries
+	PartialSummary string `json:"partial_summary,omitempty"`
+
+	// 0-100 across every stage, weighted by stageWeights. Recalculated on every update
+	OverallPercent float64 `json:"overall_percent"`
+
+	// yt-dlp's estimate of how long the audio download has left
+	DownloadETA time.Duration `json:"-"`
+
+	// Seconds the current stage has left, going by how long its chunks have taken so far.
+	// Null until there's something to go on, and for stages without chunks
+	ETASeconds *float64 `json:"eta_seconds"`
+}
+
+// Share of OverallPercent each stage accounts for
+var stageWeights = struct{ download, transcription, summary float64 }{20, 40, 40}
+
+// Per-job settings supplied by whoever requested the job
+type JobOptions struct {
+	// Used to share summarization capacity fairly between clients
+	Submitter string `json:"-"`
+
+	// Override the models from settings for this job only. Empty means use the settings
+	SummarizationModel string `json:"summarization_model,omitempty"`
+	TranscriptionModel string `json:"transcription_model,omitempty"`
+
+	// ISO 639-1 code of the video's language, e.g. "es", or "auto" to detect it. Empty means English.
+	// Captions, transcription and the summary all follow it
+	Language string `json:"language,omitempty"`
+
+	// Picks one of the adapters' SummaryStyles, e.g. "bullets". Empty means the default style
+	Style string `json:"style,omitempty"`
+
+	// "short", "medium" or "long". Empty means medium
+	Length string `json:"length,omitempty"`
+
+	// Section titles the summary must have, in order. Empty lets the model pick its own structure
+	Sections []string `json:"sections,omitempty"`
+
+	// Social media blurbs to write once the summary is done, e.g. "tweet". Empty skips the extra call
+	Blurbs []string `json:"blurbs,omitempty"`
+
+	// Summarize again even if the transcript and parameters match the existing summary
+	Force bool `json:"force,omitempty"`
+
+	// Overrides WEBHOOK_URL for this job. Kept out of the broadcast job JSON, the checkpoint stores it separately
+	WebhookURL string `json:"-"`
+
+	// Page yt-dlp downloads the video from, for videos that aren't on YouTube. Only POST /summarize sets it
+	SourceURL string `json:"source_url,omitempty"`
+
+	// Stop once the transcript is written, without summarizing it
+	TranscriptOnly bool `json:"transcript_only,omitempty"`
+
+	// Only summarize this part of the video, in seconds. 0 means the start or the end of the video.
+	// The summary is kept apart from the full one, see adapters.RangeSummaryPath
+	StartSeconds float64 `json:"start_seconds,omitempty"`
+	EndSeconds   float64 `json:"end_seconds,omitempty"`
+}
+
+// Whether the job summarizes only part of the video
+func (opts JobOptions) HasRange() bool {
+	return opts.StartSeconds > 0 || opts.EndSeconds > 0
+}
+
+// Whether the job writes the video's own summary. Transcript-only and range jobs leave it alone
+func (opts JobOptions) WritesFullSummary() bool {
+	return !opts.TranscriptOnly && !opts.HasRange()
 }
 
 type SummaryJob struct {
@@ -24,9 +114,44 @@ type SummaryJob struct {
 	Status   string       `json:"status"`
 	Error    string       `json:"error"`
 	Progress JobProgress  `json:"job_progress"`
+	Options  JobOptions   `json:"options"`
 	Lock     sync.RWMutex `json:"-"`
 
 	OnUpdate func(*SummaryJob) `json:"-"`
+
+	// When the job was created, when its first stage started, and when it finished, failed or was cancelled
+	QueuedAt   time.Time `json:"queued_at"`
+	StartedAt  time.Time `json:"started_at,omitzero"`
+	FinishedAt time.Time `json:"finished_at,omitzero"`
+
+	// Cancelled when the job is cancelled so in-flight stages can bail out
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// Last status logged by the update handler
+	loggedStatus string
+	// Whether the update handler has sent the meta event yet
+	metaSent bool
+
+	// Stage the ETA was last worked out for, and when the job entered it
+	etaStage      string
+	etaStageStart time.Time
+}
+
+func newSummaryJob(videoID string, opts JobOptions, onUpdate func(*SummaryJob)) *SummaryJob {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &SummaryJob{
+		VideoID:  videoID,
+		Status:   "pending",
+		Options:  opts,
+		OnUpdate: onUpdate,
+		ctx:      ctx,
+		cancel:   cancel,
+
+		QueuedAt:     time.Now(),
+		loggedStatus: "pending",
+	}
 }
 
 // Convenience wrapper
@@ -34,7 +159,14 @@ func (job *SummaryJob) UpdateStatus(newStatus string) {
 	job.Lock.Lock()
 	defer job.Lock.Unlock()
 
+	// A cancelled job stays cancelled, even if a stage reports progress on its way out
+	if job.ctx.Err() != nil {
+		return
+	}
+
 	job.Status = newStatus
+	job.Progress.OverallPercent = job.overallPercent()
+	job.Progress.ETASeconds = job.etaSeconds()
 	job.OnUpdate(job)
 }
 
@@ -43,7 +175,13 @@ func (job *SummaryJob) UpdateJob(fn func(j *SummaryJob)) {
 	job.Lock.Lock()
 	defer job.Lock.Unlock()
 
+	if job.ctx.Err() != nil {
+		return
+	}
+
 	fn(job)
+	job.Progress.OverallPercent = job.overallPercent()
+	job.Progress.ETASeconds = job.etaSeconds()
 	job.OnUpdate(job)
 }
 
@@ -54,4 +192,129 @@ func (job *SummaryJob) GetStatus() string {
 	return job.Status
 }
 
+func (job *SummaryJob) GetError() string {
+	job.Lock.RLock()
+	defer job.Lock.RUnlock()
+
+	return job.Error
+}
+
+func (job *SummaryJob) GetProgress() JobProgress {
+	job.Lock.RLock()
+	defer job.Lock.RUnlock()
+
+	return job.Progress
+}
+
+// Works out how far along the job is from its status and stage counters. The caller must hold the lock.
+// Jobs that ended without finishing stay where they stopped
+func (job *SummaryJob) overallPercent() float64 {
+	p := job.Progress
+	var download, transcription, summary float64
+
+	switch {
+	case job.Status == "finished":
+		return 100
+	case IsReplaceableStatus(job.Status):
+		return p.OverallPercent
+	case job.Status == "pending", job.Status == "checking_for_captions", job.Status == "waiting_for_stream":
+	case job.Status == "downloading_audio":
+		download = parsePercentage(p.PercentageString) / 100
+	default:
+		download = 1
+	}
+
+	switch {
+	case p.HadCaptions || job.Status == "summarizing" || job.Status == "writing_blurbs":
+		transcription = 1
+	case p.TranscriptionChunks > 0:
+		transcription = float64(p.ChunksTranscribed) / float64(p.TranscriptionChunks)
+	}
+
+	switch {
+	case job.Status == "writing_blurbs":
+		summary = 1
+	case p.SummaryChunks > 0:
+		summary = float64(p.ChunksSummarized) / float64(p.SummaryChunks)
+	}
+
+	percent := download*stageWeights.download + transcription*stageWeights.transcription + summary*stageWeights.summary
+	// Without a summary stage the other two make up the whole job
+	if job.Options.TranscriptOnly {
+		percent *= 100 / (stageWeights.download + stageWeights.transcription)
+	}
+	return min(max(percent, 0), 100)
+}
+
+// Estimates how long the current stage has left. Downloads use yt-dlp's own estimate. Chunked stages assume the
+// remaining chunks take as long on average as the ones done since the stage started. The caller must hold the lock
+func (job *SummaryJob) etaSeconds() *float64 {
+	p := job.Progress
+
+	var done, total int
+	switch job.Status {
+	case "downloading_audio":
+	case "transcribing":
+		done, total = p.ChunksTranscribed, p.TranscriptionChunks
+	case "summarizing":
+		done, total = p.ChunksSummarized, p.SummaryChunks
+	default:
+		job.etaStage = ""
+		return nil
+	}
+
+	if job.Status != job.etaStage {
+		job.etaStage = job.Status
+		job.etaStageStart = time.Now()
+	}
+
+	if job.Status == "downloading_audio" {
+		if p.DownloadETA <= 0 {
+			return nil
+		}
+		eta := p.DownloadETA.Seconds()
+		return &eta
+	}
+
+	if done <= 0 || total <= 0 {
+		return nil
+	}
+
+	perChunk := time.Since(job.etaStageStart).Seconds() / float64(done)
+	eta := perChunk * float64(max(total-done, 0))
+	return &eta
+}
+
+// yt-dlp reports progress like " 45.3%". Anything unreadable counts as no progress
+func parsePercentage(s string) float64 {
+	v, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(s), "%"), 64)
+	if err != nil {
+		return 0
+	}
+	return v
+}
+
+// Finished, failed, rejected and cancelled jobs won't be touched by the pipeline again
+func IsTerminalStatus(status string) bool {
+	return status == "finished" || IsReplaceableStatus(status)
+}
+
+// Failed, rejected and cancelled jobs ended without a summary, so a new request for the video replaces them
+func IsReplaceableStatus(status string) bool {
+	switch status {
+	case "failed", "rejected_too_long", "rejected_live", "cancelled":
+		return true
+	}
+	return false
+}
+
+func (job *SummaryJob) IsTerminal() bool {
+	return IsTerminalStatus(job.GetStatus())
+}
+
+// Stages pass this to the adapters so that cancelling the job aborts their IO
+func (job *SummaryJob) Context() context.Context {
+	return job.ctx
+}
+
 // ---
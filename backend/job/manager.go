@@ -5,13 +5,53 @@ import (
 	"fmt"
 	"github.com/google/uuid"
 	"go-yt-sum/db"
-	"log"
-	"net/http"
+	"log/slog"
 	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 type Client struct {
-	Connection http.ResponseWriter
+	Connection ClientConn
+
+	// Broadcasts and heartbeats come from different goroutines, this keeps their frames from interleaving
+	mu sync.Mutex
+	// Set once the client is deleted or a write to it fails, after which nothing more is written to it
+	gone bool
+}
+
+func (c *Client) send(eventType string, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.gone {
+		c.write(func() error { return c.Connection.WriteEvent(eventType, data) })
+	}
+}
+
+func (c *Client) heartbeat() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.gone {
+		c.write(c.Connection.Heartbeat)
+	}
+}
+
+// A failed write, e.g. one that ran past its deadline, leaves the connection unusable. c.mu must be held
+func (c *Client) write(write func() error) {
+	if err := write(); err != nil {
+		c.gone = true
+	}
+}
+
+// Waits out a write in progress, so the handler can't finish with its connection while it's still being written to
+func (c *Client) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gone = true
 }
 
 type ActiveJobsManager struct {
@@ -21,81 +61,240 @@ type ActiveJobsManager struct {
 
 	Lock        sync.RWMutex
 	ClientsLock sync.Mutex
+
+	Logger *slog.Logger
+
+	// Job state is checkpointed here so it survives a restart. Empty disables checkpointing
+	checkpointPath string
+	dirty          chan struct{}
+
+	// Updates are written to clients from broadcastLoop, so the pipeline never waits on a slow client
+	broadcasts *broadcastQueue
+
+	// Closed by CloseClients, telling SSE handlers to end their streams
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	// Idempotency-Key headers seen on summarize requests, see ClaimIdempotencyKey
+	idempotencyKeys map[string]idempotencyEntry
+	idempotencyLock sync.Mutex
 }
 
-func NewJobManager(db *db.DB) *ActiveJobsManager {
-	return &ActiveJobsManager{
-		Jobs:    make(map[string]*SummaryJob),
-		Clients: make(map[string]*Client),
-		DB:      db,
+// Restores jobs from checkpointPath if it exists. summaryExists tells finished jobs that still have their summary from those that don't
+func NewJobManager(db *db.DB, checkpointPath string, summaryExists func(videoID string) bool) (*ActiveJobsManager, error) {
+	manager := &ActiveJobsManager{
+		Jobs:           make(map[string]*SummaryJob),
+		Clients:        make(map[string]*Client),
+		DB:             db,
+		Logger:         slog.Default(),
+		checkpointPath: checkpointPath,
+		dirty:          make(chan struct{}, 1),
+		broadcasts:     newBroadcastQueue(),
+		closed:         make(chan struct{}),
+
+		idempotencyKeys: make(map[string]idempotencyEntry),
+	}
+	go manager.broadcastLoop()
+
+	if checkpointPath != "" {
+		if err := manager.loadCheckpoint(summaryExists); err != nil {
+			return nil, err
+		}
+		go manager.checkpointLoop()
+	}
+
+	if JobTTL > 0 {
+		go manager.evictionLoop()
 	}
+
+	return manager, nil
 }
 
 // ---
 
 // Stores for later, then sends initial job data
-func (manager *ActiveJobsManager) CreateClient(w http.ResponseWriter) string {
-	manager.ClientsLock.Lock()
-	defer manager.ClientsLock.Unlock()
+func (manager *ActiveJobsManager) CreateClient(conn ClientConn) string {
+	// Snapshot before taking ClientsLock, so a slow broadcast in progress doesn't hold up reading the jobs
+	jobs, err := manager.marshalJobs(false)
+	jsonString := []byte("{}")
+	if err == nil {
+		jsonString, err = json.Marshal(jobs)
+	}
+
+	if err != nil {
+		manager.Logger.Error("failed to encode all jobs when opening SSE connection, this should NOT happen", "error", err)
+	}
 
 	id := uuid.New().String()
-	manager.Clients[id] = &Client{
-		Connection: w,
+	client := &Client{
+		Connection: conn,
 	}
 
-	jsonString, err := json.Marshal(manager.Jobs)
+	// Broadcasts that see the client before init is written wait for it, so init always comes first
+	client.mu.Lock()
+	defer client.mu.Unlock()
 
-	if err != nil {
-		log.Println("Failed to encode all jobs when opening SSE connection. This should NOT happen.")
-	}
+	manager.ClientsLock.Lock()
+	manager.Clients[id] = client
+	manager.ClientsLock.Unlock()
 
-	eventString := fmt.Sprintf("event: init\ndata: %s\n\n", jsonString)
-	fmt.Fprint(w, eventString)
-	w.(http.Flusher).Flush()
+	client.write(func() error { return conn.WriteEvent("init", jsonString) })
 
 	return id
 }
 
+// Encodes every job while holding its read lock, so the encoding can't race with an update
+func (manager *ActiveJobsManager) marshalJobs(withWebhooks bool) (map[string]json.RawMessage, error) {
+	snapshot := make(map[string]json.RawMessage)
+
+	for id, job := range manager.GetAllJobs() {
+		var b []byte
+		var err error
+
+		job.Lock.RLock()
+		if withWebhooks {
+			b, err = json.Marshal(checkpointedJob{SummaryJob: job, WebhookURL: job.Options.WebhookURL})
+		} else {
+			b, err = json.Marshal(job)
+		}
+		job.Lock.RUnlock()
+
+		if err != nil {
+			return nil, err
+		}
+		snapshot[id] = b
+	}
+
+	return snapshot, nil
+}
+
+// Keeps proxies from closing the connection for being idle
+func (manager *ActiveJobsManager) Heartbeat(id string) {
+	manager.ClientsLock.Lock()
+	client, ok := manager.Clients[id]
+	manager.ClientsLock.Unlock()
+
+	if ok {
+		client.heartbeat()
+	}
+}
+
+// Sends an event to just one client, e.g. the answer to something it asked over its WebSocket
+func (manager *ActiveJobsManager) SendEvent(id string, eventType string, data []byte) {
+	manager.ClientsLock.Lock()
+	client, ok := manager.Clients[id]
+	manager.ClientsLock.Unlock()
+
+	if ok {
+		client.send(eventType, data)
+	}
+}
+
 func (manager *ActiveJobsManager) DeleteClient(id string) {
 	manager.ClientsLock.Lock()
-	defer manager.ClientsLock.Unlock()
+	client, ok := manager.Clients[id]
 	delete(manager.Clients, id)
+	manager.ClientsLock.Unlock()
+
+	if ok {
+		client.close()
+	}
 }
 
+// The clients connected right now. Written to without holding ClientsLock, so a slow client holds up nobody else
+func (manager *ActiveJobsManager) clientSnapshot() []*Client {
+	manager.ClientsLock.Lock()
+	defer manager.ClientsLock.Unlock()
+
+	clients := make([]*Client, 0, len(manager.Clients))
+	for _, client := range manager.Clients {
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+// Sends every client a final shutdown event, then closes Closed so their handlers return
+func (manager *ActiveJobsManager) CloseClients() {
+	manager.closeOnce.Do(func() {
+		for _, client := range manager.clientSnapshot() {
+			client.send("shutdown", []byte("{}"))
+		}
+
+		close(manager.closed)
+	})
+}
+
+func (manager *ActiveJobsManager) Closed() <-chan struct{} {
+	return manager.closed
+}
+
+// Registers a gauge of open job SSE streams with reg
+func (manager *ActiveJobsManager) RegisterMetrics(reg prometheus.Registerer) error {
+	return reg.Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "ytsum_sse_clients",
+		Help:        "Open SSE streams.",
+		ConstLabels: prometheus.Labels{"stream": "jobs"},
+	}, func() float64 {
+		manager.ClientsLock.Lock()
+		defer manager.ClientsLock.Unlock()
+		return float64(len(manager.Clients))
+	}))
+}
+
+// Queues the job's current state for every client. The caller must hold the job's lock, as the update handler does,
+// unless nobody else can see the job yet
 func (manager *ActiveJobsManager) BroadcastJobData(job *SummaryJob, eventType string) {
 	jsonString, err := json.Marshal(job)
 
 	if err != nil {
-		log.Printf("Failed to encode update for job %s", job.VideoID)
+		manager.Logger.Error("failed to encode job update", "video_id", job.VideoID, "error", err)
+		return
 	}
 
-	eventString := fmt.Sprintf("event: %s\ndata: %s\n\n", eventType, jsonString)
+	manager.broadcasts.push(job.VideoID, eventType, jsonString)
+}
 
-	for _, client := range manager.Clients {
-		fmt.Fprint(client.Connection, eventString)
-		client.Connection.(http.Flusher).Flush()
+// Queues a meta event carrying just the job's VideoEntry, so clients can show the video before it's summarized.
+// It's queued apart from the job's updates, which would otherwise replace it. The caller must hold the job's lock
+func (manager *ActiveJobsManager) BroadcastVideoMeta(job *SummaryJob) {
+	jsonString, err := json.Marshal(job.Progress.VideoMeta)
+
+	if err != nil {
+		manager.Logger.Error("failed to encode video metadata", "video_id", job.VideoID, "error", err)
+		return
 	}
+
+	manager.broadcasts.push("meta:"+job.VideoID, "meta", jsonString)
+}
+
+func (manager *ActiveJobsManager) CreateJob(videoID string, opts JobOptions) (bool, *SummaryJob) {
+	return manager.createJob(videoID, opts, false)
+}
+
+// Like CreateJob, but a finished job gets replaced too so the video can be summarized again
+func (manager *ActiveJobsManager) RegenerateJob(videoID string, opts JobOptions) (bool, *SummaryJob) {
+	return manager.createJob(videoID, opts, true)
 }
 
-func (manager *ActiveJobsManager) CreateJob(videoID string) (bool, *SummaryJob) {
+func (manager *ActiveJobsManager) createJob(videoID string, opts JobOptions, replaceFinished bool) (bool, *SummaryJob) {
 	manager.Lock.Lock()
 	defer manager.Lock.Unlock()
 
-	if job, exists := manager.Jobs[videoID]; exists && job.GetStatus() != "failed" {
-		return true, job
+	if job, exists := manager.Jobs[videoID]; exists {
+		status := job.GetStatus()
+		if !IsReplaceableStatus(status) && !(replaceFinished && status == "finished") {
+			return true, job
+		}
 	}
 
 	// Reset database failure state when creating/retrying a job
 	manager.DB.UpdateJobSuccess(videoID)
 
-	newJob := &SummaryJob{
-		VideoID:  videoID,
-		Status:   "pending",
-		OnUpdate: manager.CreateUpdateHandler(),
-	}
+	newJob := newSummaryJob(videoID, opts, manager.CreateUpdateHandler())
 
 	manager.BroadcastJobData(newJob, "new")
 	manager.Jobs[videoID] = newJob
+	manager.markDirty()
 
 	return false, newJob
 }
@@ -104,6 +303,18 @@ func (manager *ActiveJobsManager) CreateJob(videoID string) (bool, *SummaryJob)
 func (manager *ActiveJobsManager) CreateUpdateHandler() func(job *SummaryJob) {
 	return func(job *SummaryJob) {
 		manager.BroadcastJobData(job, "update")
+		manager.markDirty()
+
+		if job.Status != job.loggedStatus {
+			manager.Logger.Info("job status changed", "video_id", job.VideoID, "from", job.loggedStatus, "status", job.Status,
+				"elapsed", time.Since(job.QueuedAt).Round(time.Millisecond))
+			job.loggedStatus = job.Status
+		}
+
+		if job.Progress.VideoMeta != nil && !job.metaSent {
+			manager.BroadcastVideoMeta(job)
+			job.metaSent = true
+		}
 
 		// If the videoMeta gets created and we don't already have it, snag it and save it
 		if !manager.DB.Exists(job.VideoID) && job.Progress.VideoMeta != nil {
@@ -112,6 +323,28 @@ func (manager *ActiveJobsManager) CreateUpdateHandler() func(job *SummaryJob) {
 	}
 }
 
+// Stops whatever stage the job is in and marks it cancelled. Jobs that already ended can't be cancelled
+func (manager *ActiveJobsManager) CancelJob(videoID string) error {
+	job := manager.GetJob(videoID)
+	if job == nil {
+		return fmt.Errorf("no job for video %q", videoID)
+	}
+
+	job.Lock.Lock()
+	defer job.Lock.Unlock()
+
+	if IsTerminalStatus(job.Status) {
+		return fmt.Errorf("job for video %q already %s", videoID, job.Status)
+	}
+
+	job.cancel()
+	job.Status = "cancelled"
+	job.FinishedAt = time.Now()
+	job.OnUpdate(job)
+
+	return nil
+}
+
 func (manager *ActiveJobsManager) GetJob(videoID string) *SummaryJob {
 	manager.Lock.Lock()
 	defer manager.Lock.Unlock()
@@ -125,11 +358,17 @@ func (manager *ActiveJobsManager) GetJob(videoID string) *SummaryJob {
 	return nil
 }
 
+// Returns a copy of the map, so callers can range over it without holding the lock
 func (manager *ActiveJobsManager) GetAllJobs() map[string]*SummaryJob {
 	manager.Lock.RLock()
 	defer manager.Lock.RUnlock()
 
-	return manager.Jobs
+	jobs := make(map[string]*SummaryJob, len(manager.Jobs))
+	for id, job := range manager.Jobs {
+		jobs[id] = job
+	}
+
+	return jobs
 }
 
 func (manager *ActiveJobsManager) DeleteJob(videoID string) {
@@ -137,4 +376,5 @@ func (manager *ActiveJobsManager) DeleteJob(videoID string) {
 	defer manager.Lock.Unlock()
 
 	delete(manager.Jobs, videoID)
+	manager.markDirty()
 }
@@ -0,0 +1,129 @@
+package job
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"go-yt-sum/db"
+)
+
+// Checkpoints are written at most this often, however fast jobs update
+var checkpointInterval = time.Second
+
+// And at least this often, in case an update signal was missed
+var checkpointFallbackInterval = 30 * time.Second
+
+// A job as the checkpoint stores it. JobOptions.WebhookURL stays out of the job JSON clients see, so it's kept here
+type checkpointedJob struct {
+	*SummaryJob
+	WebhookURL string `json:"webhook_url,omitempty"`
+}
+
+// Asks the checkpoint loop to write soon. Never blocks: one pending request covers any number of updates
+func (manager *ActiveJobsManager) markDirty() {
+	if manager.checkpointPath == "" {
+		return
+	}
+
+	select {
+	case manager.dirty <- struct{}{}:
+	default:
+	}
+}
+
+func (manager *ActiveJobsManager) checkpointLoop() {
+	ticker := time.NewTicker(checkpointFallbackInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-manager.dirty:
+		case <-ticker.C:
+		}
+
+		if err := manager.SaveCheckpoint(); err != nil {
+			manager.Logger.Error("failed to checkpoint jobs", "error", err)
+		}
+
+		time.Sleep(checkpointInterval)
+	}
+}
+
+// Writes every job's state to the checkpoint file, atomically
+func (manager *ActiveJobsManager) SaveCheckpoint() error {
+	if manager.checkpointPath == "" {
+		return nil
+	}
+
+	snapshot, err := manager.marshalJobs(true)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return db.AtomicWriteFile(manager.checkpointPath, data, 0o644)
+}
+
+// Restores jobs from the last checkpoint. Finished jobs whose summary still exists come back as finished.
+// Anything that was mid-pipeline can't pick up where it left off, so it comes back failed and can be retried.
+func (manager *ActiveJobsManager) loadCheckpoint(summaryExists func(videoID string) bool) error {
+	data, err := os.ReadFile(manager.checkpointPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var saved map[string]checkpointedJob
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return err
+	}
+
+	for id, s := range saved {
+		if s.SummaryJob == nil {
+			continue
+		}
+
+		opts := s.Options
+		opts.WebhookURL = s.WebhookURL
+
+		restored := newSummaryJob(id, opts, manager.CreateUpdateHandler())
+		restored.Status = s.Status
+		restored.Error = s.Error
+		restored.Progress = s.Progress
+		restored.QueuedAt = s.QueuedAt
+		restored.StartedAt = s.StartedAt
+		restored.FinishedAt = s.FinishedAt
+
+		switch {
+		case IsReplaceableStatus(s.Status):
+		case s.Status == "finished":
+			// Transcript-only and range jobs never wrote the summary summaryExists looks for
+			if s.Options.WritesFullSummary() && !summaryExists(id) {
+				restored.Status = "failed"
+				restored.Error = "summary missing after server restart"
+			}
+		default:
+			restored.Status = "failed"
+			restored.Error = "interrupted by server restart"
+			restored.FinishedAt = time.Now()
+		}
+
+		restored.loggedStatus = restored.Status
+
+		if restored.Status == "failed" && s.Status != "failed" {
+			manager.DB.SetJobFailed(id, true, restored.Error)
+		}
+
+		manager.Jobs[id] = restored
+	}
+
+	manager.Logger.Info("restored jobs from checkpoint", "jobs", len(saved), "path", manager.checkpointPath)
+	return nil
+}
@@ -0,0 +1,129 @@
+package job
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go-yt-sum/db"
+)
+
+func newTestManager(t *testing.T, dir string) *ActiveJobsManager {
+	t.Helper()
+
+	database, err := db.NewDB(filepath.Join(dir, "db.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manager, err := NewJobManager(database, filepath.Join(dir, "jobs.json"), func(string) bool { return true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	return manager
+}
+
+// Like newTestManager without checkpointing, for tests that change jobs: the checkpoint loop writes in the
+// background and could still be writing when the temp dir is removed
+func newMemoryManager(t *testing.T) *ActiveJobsManager {
+	t.Helper()
+
+	database, err := db.NewDB(filepath.Join(t.TempDir(), "db.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manager, err := NewJobManager(database, "", func(string) bool { return true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	return manager
+}
+
+func TestCheckpointKeepsWebhookURL(t *testing.T) {
+	dir := t.TempDir()
+	manager := newTestManager(t, dir)
+
+	j := newSummaryJob("dQw4w9WgXcQ", JobOptions{WebhookURL: "https://hooks.example.com/done"}, func(*SummaryJob) {})
+	j.Status = "finished"
+	manager.Jobs[j.VideoID] = j
+
+	if err := manager.SaveCheckpoint(); err != nil {
+		t.Fatal(err)
+	}
+
+	broadcast, err := manager.marshalJobs(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(broadcast[j.VideoID]), "hooks.example.com") {
+		t.Error("webhook URL is in the job JSON sent to clients")
+	}
+
+	restored := newTestManager(t, dir).GetJob(j.VideoID)
+	if restored == nil {
+		t.Fatal("job wasn't restored")
+	}
+	if restored.Options.WebhookURL != "https://hooks.example.com/done" {
+		t.Errorf("restored webhook URL = %q", restored.Options.WebhookURL)
+	}
+}
+
+func TestCheckpointRestoresJobs(t *testing.T) {
+	dir := t.TempDir()
+	manager := newTestManager(t, dir)
+
+	add := func(id string, status string) *SummaryJob {
+		j := newSummaryJob(id, JobOptions{}, func(*SummaryJob) {})
+		j.Status = status
+		manager.Jobs[id] = j
+		return j
+	}
+	add("finishedAAAA", "finished")
+	add("noSummaryAAA", "finished")
+	add("failedAAAAAA", "failed").Error = "yt-dlp exited with 1"
+	add("cancelledAAA", "cancelled")
+	running := add("summarizing", "summarizing")
+	running.Progress.SummaryChunks = 4
+	running.Progress.ChunksSummarized = 2
+
+	if err := manager.SaveCheckpoint(); err != nil {
+		t.Fatal(err)
+	}
+
+	database, err := db.NewDB(filepath.Join(dir, "db.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, err := NewJobManager(database, filepath.Join(dir, "jobs.json"), func(id string) bool { return id != "noSummaryAAA" })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		id     string
+		status string
+		err    string
+	}{
+		{"finishedAAAA", "finished", ""},
+		{"noSummaryAAA", "failed", "summary missing after server restart"},
+		{"failedAAAAAA", "failed", "yt-dlp exited with 1"},
+		{"cancelledAAA", "cancelled", ""},
+		{"summarizing", "failed", "interrupted by server restart"},
+	}
+	for _, tt := range tests {
+		j := restored.GetJob(tt.id)
+		if j == nil {
+			t.Errorf("%s wasn't restored", tt.id)
+			continue
+		}
+		if j.Status != tt.status || j.Error != tt.err {
+			t.Errorf("%s restored as %q (%q), want %q (%q)", tt.id, j.Status, j.Error, tt.status, tt.err)
+		}
+	}
+
+	// Progress comes back as it was when the job stopped
+	if p := restored.GetJob("summarizing").Progress; p.SummaryChunks != 4 || p.ChunksSummarized != 2 {
+		t.Errorf("restored progress = %+v", p)
+	}
+}
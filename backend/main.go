@@ -1,13 +1,28 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"go-yt-sum/adapters"
 	"go-yt-sum/chat"
@@ -17,117 +32,1285 @@ import (
 	"go-yt-sum/settings"
 
 	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
 	"github.com/joho/godotenv"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/cors"
 )
 
-var DBPath = "./content/db.json"
+// Prefix every route is served under, from BASE_PATH. Empty when mounted at the root
+var BasePath = ""
 
-func constructQueueHandler(videoIdIn chan<- string) http.HandlerFunc {
+// Bearer token for /admin routes, from ADMIN_TOKEN. Admin routes are disabled while it's empty
+var AdminToken = ""
+
+// How long shutdown waits for open requests, and then for in-flight pipeline stages, from SHUTDOWN_TIMEOUT_SECONDS
+var ShutdownTimeout = 30 * time.Second
+
+// Serve Prometheus metrics at /metrics, from METRICS. Off by default
+var MetricsEnabled = false
+
+// Clears leftover downloads before the pipeline starts, see adapters.CleanupDownloads. Off unless CLEANUP_ON_START is set
+var CleanupOnStart = false
+
+// Largest request body any handler reads, from MAX_REQUEST_BODY_BYTES. Bigger bodies get a 413
+var MaxRequestBodyBytes int64 = 1 << 20
+
+// Largest body POST /chat/{videoID} takes. Much less than MaxRequestBodyBytes, since every message is sent on to Groq
+var MaxChatMessageBytes int64 = 32 << 10
+
+// Server timeouts, so slow or stalled clients can't hold connections open. Event streams clear theirs, see streamWithoutDeadlines
+var (
+	serverReadHeaderTimeout = 10 * time.Second
+	serverReadTimeout       = 30 * time.Second
+	serverWriteTimeout      = 60 * time.Second
+	serverIdleTimeout       = 120 * time.Second
+)
+
+// Reverse proxies tend to drop connections after ~60s without traffic
+var sseHeartbeatInterval = 15 * time.Second
+
+// SSE streams stay open for as long as the client wants, far past the server's read and write timeouts.
+// WebSockets don't need this, the upgrade clears the deadlines itself
+func streamWithoutDeadlines(w http.ResponseWriter) {
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Time{})
+	rc.SetWriteDeadline(time.Time{})
+}
+
+// Blocks until the client disconnects or closed is closed, calling heartbeat on every tick in the meantime
+func keepSSEAlive(ctx context.Context, closed <-chan struct{}, heartbeat func()) {
+	ticker := time.NewTicker(sseHeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			heartbeat()
+		case <-ctx.Done():
+			return
+		case <-closed:
+			return
+		}
+	}
+}
+
+// Best guess at who sent the request. Behind a reverse proxy the client address is in X-Forwarded-For
+func submitterFor(r *http.Request) string {
+	if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+		return strings.TrimSpace(strings.Split(fwd, ",")[0])
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Reads the optional JSON body of a summarize request. No body at all means all defaults
+func decodeJobOptions(r *http.Request) (job.JobOptions, error) {
+	var body struct {
+		job.JobOptions
+		// Older name for style, still accepted
+		PromptStyle string `json:"prompt_style"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+		return body.JobOptions, fmt.Errorf("invalid request body: %w", err)
+	}
+
+	opts := body.JobOptions
+	if opts.Style == "" {
+		opts.Style = body.PromptStyle
+	}
+
+	// Anyone can submit jobs, so only the admin or an allowlisted host gets to pick where the server POSTs to
+	opts.WebhookURL = r.Header.Get("X-Webhook-Url")
+	if opts.WebhookURL != "" && !isAdmin(r) && !adapters.WebhookHostAllowed(opts.WebhookURL) {
+		return opts, errors.New("X-Webhook-Url needs the admin token, or a host listed in WEBHOOK_ALLOWED_HOSTS")
+	}
+	// Only POST /summarize may point a job somewhere other than YouTube
+	opts.SourceURL = ""
+	if err := adapters.ValidateJobOptions(opts); err != nil {
+		return opts, err
+	}
+
+	opts.Submitter = submitterFor(r)
+	return opts, nil
+}
+
+// Caps every request body at MaxRequestBodyBytes. Reads past it fail with an *http.MaxBytesError
+func limitBodyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, MaxRequestBodyBytes)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// 413 if reading the body failed because it was too big, 400 for anything else wrong with it
+func bodyErrorStatus(err error) int {
+	var tooBig *http.MaxBytesError
+	if errors.As(err, &tooBig) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+// Rejects any route whose {videoID} isn't a YouTube video ID before it reaches a handler
+func validateVideoIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if videoID, ok := mux.Vars(r)["videoID"]; ok && !adapters.ValidateVideoID(videoID) {
+			http.Error(w, "invalid video id", http.StatusBadRequest)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Whether the request carries ADMIN_TOKEN. Never true while it's empty
+func isAdmin(r *http.Request) bool {
+	given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return AdminToken != "" && subtle.ConstantTimeCompare([]byte(given), []byte(AdminToken)) == 1
+}
+
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if AdminToken == "" {
+			http.Error(w, "admin endpoints are disabled, set ADMIN_TOKEN to enable them", http.StatusForbidden)
+			return
+		}
+
+		if !isAdmin(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// A full or stopping pipeline is 503, since it'll take jobs again once some finish or the server is back.
+// A full request buffer stays 429
+func writeSubmitError(w http.ResponseWriter, err error) {
+	if errors.Is(err, pipeline.ErrPipelineFull) || errors.Is(err, pipeline.ErrPipelineStopped) {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusTooManyRequests)
+}
+
+type CapacityResponse struct {
+	ActiveJobs int `json:"active_jobs"`
+	// 0 when there's no limit
+	MaxActiveJobs  int `json:"max_active_jobs"`
+	QueuedRequests int `json:"queued_requests"`
+}
+
+// How close the pipeline is to refusing new jobs
+func constructCapacityHandler(pipe *pipeline.SummarizerPipeline) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		active, max := pipe.ActiveJobs()
+		writeJSON(w, http.StatusOK, CapacityResponse{
+			ActiveJobs:     active,
+			MaxActiveJobs:  max,
+			QueuedRequests: pipe.QueuedRequests(),
+		})
+	}
+}
+
+type JobConflictResponse struct {
+	Error  string `json:"error"`
+	Status string `json:"status"`
+}
+
+// POST /summarize/{videoID}?priority=high. Priority is low, normal or high, and only decides who downloads first
+func constructQueueHandler(pipe *pipeline.SummarizerPipeline, mgr *job.ActiveJobsManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		videoID := mux.Vars(r)["videoID"]
+
+		opts, err := decodeJobOptions(r)
+		if err != nil {
+			http.Error(w, err.Error(), bodyErrorStatus(err))
+			return
+		}
+
+		priority, err := pipeline.ParsePriority(r.URL.Query().Get("priority"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		req := pipeline.Request{
+			VideoID:  videoID,
+			Options:  opts,
+			Priority: priority,
+		}
+
+		if submitJob(w, r, pipe, mgr, req) {
+			w.WriteHeader(http.StatusAccepted)
+		}
+	}
+}
+
+// Longest Idempotency-Key header accepted
+const maxIdempotencyKeyLength = 255
+
+// Submits a request for a new job, writing the error response and returning false if it can't be.
+//
+// Jobs are already deduplicated by job key, so an Idempotency-Key header changes what a repeat is told, not whether
+// a second job gets made. A repeat within job.IdempotencyTTL of a request that got its job submitted returns true
+// without submitting anything, so it gets the 202 the first did rather than a 409 for the job that created. A repeat
+// arriving while the first is still being submitted gets a 409, since it can't be told yet how that one ends.
+// Reusing a key for another video is a 422
+func submitJob(w http.ResponseWriter, r *http.Request, pipe *pipeline.SummarizerPipeline, mgr *job.ActiveJobsManager, req pipeline.Request) (submitted bool) {
+	if key := r.Header.Get("Idempotency-Key"); key != "" {
+		if len(key) > maxIdempotencyKeyLength {
+			http.Error(w, fmt.Sprintf("Idempotency-Key can be at most %d characters", maxIdempotencyKeyLength), http.StatusBadRequest)
+			return false
+		}
+
+		fresh, err := mgr.ClaimIdempotencyKey(key, req.VideoID)
+		switch {
+		case errors.Is(err, job.ErrIdempotencyKeyReused):
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return false
+		case errors.Is(err, job.ErrIdempotencyKeyPending):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return false
+		case !fresh:
+			return true
+		}
+
+		// Only a request that got its job submitted keeps the key
+		defer func() {
+			if submitted {
+				mgr.SettleIdempotencyKey(key)
+			} else {
+				mgr.ReleaseIdempotencyKey(key)
+			}
+		}()
+	}
+
+	// Failed, rejected and cancelled jobs get replaced by the pipeline, anything else would make this POST a no-op.
+	// Range summaries don't touch the full one, so they replace finished jobs too
+	if j := mgr.GetJob(req.VideoID); j != nil {
+		status := j.GetStatus()
+		if !job.IsReplaceableStatus(status) && !(req.Options.HasRange() && status == "finished") {
+			writeJSON(w, http.StatusConflict, JobConflictResponse{Error: "job already exists", Status: status})
+			return false
+		}
+	}
+
+	if err := checkRange(mgr, req.VideoID, req.Options); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+
+	if err := pipe.Submit(req); err != nil {
+		writeSubmitError(w, err)
+		return false
+	}
+	return true
+}
+
+// Checks a requested range against the video's length. Until the video has been downloaded once its length isn't
+// known, so anything goes and the summarize stage checks what it can
+func checkRange(mgr *job.ActiveJobsManager, videoID string, opts job.JobOptions) error {
+	if !opts.HasRange() || !mgr.DB.Exists(videoID) {
+		return nil
+	}
+	return adapters.ValidateRange(opts, mgr.DB.Read(videoID).Length)
+}
+
+type QueueURLResponse struct {
+	// The key the job and its outputs are stored under, used in place of a video ID by every other route
+	VideoID string `json:"video_id"`
+}
+
+// POST /summarize with {"url": "..."} and the usual job options, and optionally ?priority= like /summarize/{videoID}.
+// Takes any URL yt-dlp can download.
+// Responds with the key to follow the job by
+func constructQueueURLHandler(pipe *pipeline.SummarizerPipeline, mgr *job.ActiveJobsManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// decodeJobOptions reads the body too, so it's buffered for both
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "invalid request body", bodyErrorStatus(err))
+			return
+		}
+
+		var req struct {
+			URL string `json:"url"`
+		}
+		if err := json.Unmarshal(body, &req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request body: %s", err.Error()), http.StatusBadRequest)
+			return
+		}
+
+		videoID, sourceURL, err := adapters.JobKeyForURL(req.URL)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		opts, err := decodeJobOptions(r)
+		if err != nil {
+			http.Error(w, err.Error(), bodyErrorStatus(err))
+			return
+		}
+		opts.SourceURL = sourceURL
+
+		priority, err := pipeline.ParsePriority(r.URL.Query().Get("priority"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if submitJob(w, r, pipe, mgr, pipeline.Request{VideoID: videoID, Options: opts, Priority: priority}) {
+			writeJSON(w, http.StatusAccepted, QueueURLResponse{VideoID: videoID})
+		}
+	}
+}
+
+// GET /summarize/{videoID}/estimate?style=&length=&summarization_model=&start_seconds=&end_seconds=. Works out how many
+// chunks and tokens summarizing the video would take with those options, from its transcript if it has one and from
+// its length otherwise. Nothing is sent to Groq
+func constructEstimateHandler(mgr *job.ActiveJobsManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		videoID := mux.Vars(r)["videoID"]
+		q := r.URL.Query()
+
+		start, end, err := parseRangeQuery(q)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		opts := job.JobOptions{
+			Style:              q.Get("style"),
+			Length:             q.Get("length"),
+			SummarizationModel: q.Get("summarization_model"),
+			StartSeconds:       start,
+			EndSeconds:         end,
+		}
+		if err := adapters.ValidateJobOptions(opts); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := checkRange(mgr, videoID, opts); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var length float64
+		if mgr.DB.Exists(videoID) {
+			length = mgr.DB.Read(videoID).Length
+		}
+
+		estimate, err := adapters.EstimateSummary(videoID, opts, length)
+		if errors.Is(err, adapters.ErrNothingToEstimate) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, estimate)
+	}
+}
+
+// Requeues a failed job with the options it was submitted with, or from the DB once the job itself is gone.
+// Stages whose output is already on disk are skipped
+func constructRetryJobHandler(pipe *pipeline.SummarizerPipeline, db *db.DB, mgr *job.ActiveJobsManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		videoID := mux.Vars(r)["videoID"]
+
+		var opts job.JobOptions
+		if j := mgr.GetJob(videoID); j != nil {
+			if j.GetStatus() != "failed" {
+				http.Error(w, "only failed jobs can be retried", http.StatusConflict)
+				return
+			}
+			opts = j.Options
+		} else {
+			// Evicted or lost to a restart, but the DB still remembers it failed. Like constructRetryFailedHandler,
+			// only the source URL survives from its options
+			if !db.Exists(videoID) || !db.Read(videoID).JobFailed {
+				http.NotFound(w, r)
+				return
+			}
+			opts.SourceURL = db.Read(videoID).SourceURL
+		}
+		opts.Submitter = submitterFor(r)
+
+		if err := pipe.Submit(pipeline.Request{VideoID: videoID, Options: opts, Resume: true}); err != nil {
+			writeSubmitError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// Summarizes a video again from its existing transcript, skipping download and transcription. The body takes the
+// usual job options, e.g. a style. Unless it sets force, nothing is sent to Groq if the transcript and
+// parameters are the same as last time
+func constructRegenerateHandler(pipe *pipeline.SummarizerPipeline, mgr *job.ActiveJobsManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		videoID := mux.Vars(r)["videoID"]
+
+		opts, err := decodeJobOptions(r)
+		if err != nil {
+			http.Error(w, err.Error(), bodyErrorStatus(err))
+			return
+		}
+
+		if !adapters.TranscriptionExists(videoID) {
+			http.Error(w, "video has no transcript to summarize", http.StatusNotFound)
+			return
+		}
+
+		j := mgr.GetJob(videoID)
+		if j != nil && !j.IsTerminal() {
+			writeJSON(w, http.StatusConflict, JobConflictResponse{Error: "job already running", Status: j.GetStatus()})
+			return
+		}
+
+		if err := checkRange(mgr, videoID, opts); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Keep the structure the summary was made with unless a new one is asked for. It's stored with the summary,
+		// since the job that asked for it may be long gone
+		if len(opts.Sections) == 0 {
+			opts.Sections = adapters.SummarySections(videoID)
+		}
+		if j != nil {
+			opts.SourceURL = j.Options.SourceURL
+		}
+
+		if err := pipe.Submit(pipeline.Request{VideoID: videoID, Options: opts, Resume: true, Regenerate: true}); err != nil {
+			writeSubmitError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// Number of jobs in each status, only listing statuses at least one job is in
+func constructJobStatusSummaryHandler(mgr *job.ActiveJobsManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		counts := make(map[string]int)
+		for _, j := range mgr.GetAllJobs() {
+			counts[j.GetStatus()]++
+		}
+
+		writeJSON(w, http.StatusOK, counts)
+	}
+}
+
+// GET /admin/queue. How many jobs are waiting in front of each pipeline stage
+func constructQueueDepthsHandler(pipe *pipeline.SummarizerPipeline) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, pipe.QueueDepths())
+	}
+}
+
+type FlushQueueResponse struct {
+	Cancelled       []string `json:"cancelled"`
+	DroppedRequests int      `json:"dropped_requests"`
+}
+
+// POST /admin/queue/flush. Cancels every job waiting between stages. Jobs a stage is already working on carry on
+func constructFlushQueueHandler(pipe *pipeline.SummarizerPipeline) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cancelled, dropped := pipe.Flush()
+		writeJSON(w, http.StatusOK, FlushQueueResponse{Cancelled: cancelled, DroppedRequests: dropped})
+	}
+}
+
+type RetryFailedResponse struct {
+	Retried int `json:"retried"`
+	Skipped int `json:"skipped"`
+}
+
+// Requeues every video that failed, whether we only know from the DB or it still has a job in memory.
+// Videos that picked up a new job in the meantime are skipped, as is anything that doesn't fit in the queue.
+func constructRetryFailedHandler(pipe *pipeline.SummarizerPipeline, db *db.DB, mgr *job.ActiveJobsManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		failed := make(map[string]bool)
+		for id, entry := range db.ReadAll() {
+			if entry.JobFailed {
+				failed[id] = true
+			}
+		}
+		for id, j := range mgr.GetAllJobs() {
+			if j.GetStatus() == "failed" {
+				failed[id] = true
+			}
+		}
+
+		resp := RetryFailedResponse{}
+		submitter := submitterFor(r)
+
+		for videoID := range failed {
+			opts := job.JobOptions{}
+			if db.Exists(videoID) {
+				opts.SourceURL = db.Read(videoID).SourceURL
+			}
+			if j := mgr.GetJob(videoID); j != nil {
+				if j.GetStatus() != "failed" {
+					resp.Skipped++
+					continue
+				}
+				opts = j.Options
+			}
+			opts.Submitter = submitter
+
+			if err := pipe.Submit(pipeline.Request{VideoID: videoID, Options: opts, Resume: true}); err != nil {
+				resp.Skipped++
+				continue
+			}
+			resp.Retried++
+		}
+
+		writeJSON(w, http.StatusAccepted, resp)
+	}
+}
+
+type BatchSubmitResponse struct {
+	Enqueued          []string `json:"enqueued"`
+	AlreadySummarized []string `json:"already_summarized"`
+	QueueFull         []string `json:"queue_full"`
+}
+
+// Queues every ID without blocking. Once the queue or the pipeline is full the rest are reported back instead of waiting.
+// With skipExisting, videos that are already in the DB and have a summary are left alone.
+func enqueueBatch(pipe *pipeline.SummarizerPipeline, db *db.DB, videoIDs []string, opts job.JobOptions, skipExisting bool) BatchSubmitResponse {
+	resp := BatchSubmitResponse{
+		Enqueued:          make([]string, 0),
+		AlreadySummarized: make([]string, 0),
+		QueueFull:         make([]string, 0),
+	}
+
+	for _, videoID := range videoIDs {
+		if skipExisting && db.Exists(videoID) && adapters.SummaryExists(videoID) {
+			resp.AlreadySummarized = append(resp.AlreadySummarized, videoID)
+			continue
+		}
+
+		if err := pipe.Submit(pipeline.Request{VideoID: videoID, Options: opts}); err != nil {
+			resp.QueueFull = append(resp.QueueFull, videoID)
+			continue
+		}
+		resp.Enqueued = append(resp.Enqueued, videoID)
+	}
+
+	return resp
+}
+
+func constructBatchQueueHandler(pipe *pipeline.SummarizerPipeline, db *db.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			VideoIDs []string `json:"video_ids"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request", bodyErrorStatus(err))
+			return
+		}
+
+		for _, videoID := range req.VideoIDs {
+			if !adapters.ValidateVideoID(videoID) {
+				http.Error(w, fmt.Sprintf("invalid video id %q", videoID), http.StatusBadRequest)
+				return
+			}
+		}
+
+		skipExisting := true
+		if raw := r.URL.Query().Get("skip_existing"); raw != "" {
+			parsed, err := strconv.ParseBool(raw)
+			if err != nil {
+				http.Error(w, "skip_existing must be true or false", http.StatusBadRequest)
+				return
+			}
+			skipExisting = parsed
+		}
+
+		opts := job.JobOptions{Submitter: submitterFor(r)}
+		writeJSON(w, http.StatusAccepted, enqueueBatch(pipe, db, req.VideoIDs, opts, skipExisting))
+	}
+}
+
+func constructPlaylistQueueHandler(pipe *pipeline.SummarizerPipeline, db *db.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		playlistID := mux.Vars(r)["playlistID"]
+
+		videoIDs, err := adapters.ListPlaylistVideoIDs(playlistID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		opts := job.JobOptions{Submitter: submitterFor(r)}
+		writeJSON(w, http.StatusAccepted, enqueueBatch(pipe, db, videoIDs, opts, true))
+	}
+}
+
+func constructGetJobHandler(mgr *job.ActiveJobsManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		videoID := mux.Vars(r)["videoID"]
+		job := mgr.GetJob(videoID)
+
+		if job == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+
+		if err := json.NewEncoder(w).Encode(job); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+func constructCancelJobHandler(mgr *job.ActiveJobsManager) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		videoID := mux.Vars(r)["videoID"]
 
-		select {
-		case videoIdIn <- videoID:
-			w.WriteHeader(http.StatusAccepted)
-		default:
-			http.Error(w, "queue full", http.StatusTooManyRequests)
+		if mgr.GetJob(videoID) == nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		if err := mgr.CancelJob(videoID); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+type JobStatusResponse struct {
+	Status   string           `json:"status"`
+	Progress *job.JobProgress `json:"job_progress,omitempty"`
+}
+
+// GET /summarize/status?ids=a,b,c. IDs without an active job come back as "no_job"
+func constructJobStatusesHandler(mgr *job.ActiveJobsManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		jobs := mgr.GetAllJobs()
+		statuses := make(map[string]JobStatusResponse)
+
+		for _, videoID := range strings.Split(r.URL.Query().Get("ids"), ",") {
+			videoID = strings.TrimSpace(videoID)
+			if videoID == "" {
+				continue
+			}
+
+			j, ok := jobs[videoID]
+			if !ok {
+				statuses[videoID] = JobStatusResponse{Status: "no_job"}
+				continue
+			}
+
+			progress := j.GetProgress()
+			statuses[videoID] = JobStatusResponse{Status: j.GetStatus(), Progress: &progress}
+		}
+
+		writeJSON(w, http.StatusOK, statuses)
+	}
+}
+
+// What the DB remembers of a video's last job, for videos that have no job in memory anymore
+func dbJobStatus(videoID string, video db.VideoEntry) (status string, errMsg string) {
+	switch {
+	case video.JobFailed:
+		return "failed", video.LastError
+	case adapters.SummaryExists(videoID):
+		return "finished", ""
+	}
+	return "no_job", ""
+}
+
+// Most IDs one POST /summarize/jobs/batch can ask about
+const maxBatchStatusIDs = 500
+
+type BatchJobStatus struct {
+	Status     string           `json:"status"`
+	Error      string           `json:"error,omitempty"`
+	Progress   *job.JobProgress `json:"job_progress,omitempty"`
+	ExistsInDB bool             `json:"exists_in_db"`
+}
+
+// POST /summarize/jobs/batch with {"video_ids": [...]}. Like /summarize/status, but IDs without a job in memory fall
+// back to what the DB remembers, as in /summarize/jobs, so a grid of videos needs only one request
+func constructBatchJobStatusHandler(mgr *job.ActiveJobsManager, db *db.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			VideoIDs []string `json:"video_ids"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request", bodyErrorStatus(err))
+			return
+		}
+
+		if len(req.VideoIDs) > maxBatchStatusIDs {
+			http.Error(w, fmt.Sprintf("at most %d video ids can be asked about at once", maxBatchStatusIDs), http.StatusBadRequest)
+			return
+		}
+
+		for _, videoID := range req.VideoIDs {
+			if !adapters.ValidateVideoID(videoID) {
+				http.Error(w, fmt.Sprintf("invalid video id %q", videoID), http.StatusBadRequest)
+				return
+			}
+		}
+
+		jobs := mgr.GetAllJobs()
+		statuses := make(map[string]BatchJobStatus, len(req.VideoIDs))
+
+		for _, videoID := range req.VideoIDs {
+			status := BatchJobStatus{ExistsInDB: db.Exists(videoID)}
+
+			if j, ok := jobs[videoID]; ok {
+				progress := j.GetProgress()
+				status.Status = j.GetStatus()
+				status.Error = j.GetError()
+				status.Progress = &progress
+			} else if status.ExistsInDB {
+				status.Status, status.Error = dbJobStatus(videoID, db.Read(videoID))
+			} else {
+				status.Status = "no_job"
+			}
+
+			statuses[videoID] = status
+		}
+
+		writeJSON(w, http.StatusOK, statuses)
+	}
+}
+
+type JobListEntry struct {
+	VideoID  string           `json:"video_id"`
+	Status   string           `json:"status"`
+	Error    string           `json:"error,omitempty"`
+	Progress *job.JobProgress `json:"job_progress,omitempty"`
+	Video    *db.VideoEntry   `json:"video,omitempty"`
+}
+
+// GET /summarize/jobs?status=failed. Jobs in memory plus every video in the DB, so videos whose job is gone
+// still show up with the outcome the DB remembers. Sorted by video ID
+func constructListJobsHandler(mgr *job.ActiveJobsManager, db *db.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		want := r.URL.Query().Get("status")
+		entries := make(map[string]JobListEntry)
+
+		for id, video := range db.ReadAll() {
+			entry := JobListEntry{VideoID: id, Video: &video}
+			entry.Status, entry.Error = dbJobStatus(id, video)
+			entries[id] = entry
+		}
+
+		for id, j := range mgr.GetAllJobs() {
+			entry := entries[id]
+			progress := j.GetProgress()
+
+			entry.VideoID = id
+			entry.Status = j.GetStatus()
+			entry.Error = j.GetError()
+			entry.Progress = &progress
+			entries[id] = entry
+		}
+
+		list := make([]JobListEntry, 0, len(entries))
+		for _, entry := range entries {
+			if want == "" || entry.Status == want {
+				list = append(list, entry)
+			}
+		}
+
+		sort.Slice(list, func(i, k int) bool { return list[i].VideoID < list[k].VideoID })
+
+		writeJSON(w, http.StatusOK, list)
+	}
+}
+
+func createNewSSEClient(mgr *job.ActiveJobsManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		streamWithoutDeadlines(w)
+
+		// CORS headers come from the cors middleware, like every other route
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+
+		id := mgr.CreateClient(job.NewSSEConn(w))
+		defer mgr.DeleteClient(id)
+
+		// Don't return: keep the connection open until the client disconnects
+		keepSSEAlive(r.Context(), mgr.Closed(), func() { mgr.Heartbeat(id) })
+	}
+}
+
+// main points CheckOrigin at the CORS config, so the WebSocket handshake lets in the same origins
+var wsUpgrader = websocket.Upgrader{}
+
+// Largest message a WebSocket client may send. They're only ever small commands
+const wsReadLimit = 4096
+
+// What a WebSocket client can send back to us
+type WSClientMessage struct {
+	Cancel string `json:"cancel"`
+}
+
+// Same events as the SSE stream, sent as {"event", "data"} messages. Clients can also cancel jobs with {"cancel": "videoID"}
+func createNewWSClient(mgr *job.ActiveJobsManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		conn, err := wsUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			// Upgrade has already written the error response
+			return
+		}
+		defer conn.Close()
+
+		id := mgr.CreateClient(job.NewWSConn(conn))
+		defer mgr.DeleteClient(id)
+
+		// A hijacked connection doesn't cancel the request context, so a failed read is how we find out they left
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+
+		go func() {
+			defer cancel()
+
+			conn.SetReadLimit(wsReadLimit)
+			for {
+				var msg WSClientMessage
+				if err := conn.ReadJSON(&msg); err != nil {
+					return
+				}
+
+				if msg.Cancel == "" {
+					continue
+				}
+
+				err := errors.New("invalid video id")
+				if adapters.ValidateVideoID(msg.Cancel) {
+					err = mgr.CancelJob(msg.Cancel)
+				}
+				if err != nil {
+					jb, _ := json.Marshal(map[string]string{"video_id": msg.Cancel, "error": err.Error()})
+					mgr.SendEvent(id, "error", jb)
+				}
+			}
+		}()
+
+		keepSSEAlive(ctx, mgr.Closed(), func() { mgr.Heartbeat(id) })
+	}
+}
+
+type SummaryResponse struct {
+	NoSummaryReason string `json:"no_summary_reason"`
+	Summary         string `json:"summary"`
+
+	// Only set while the job is still running
+	PartialSummary string `json:"partial_summary,omitempty"`
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// Like writeJSON with a 200, but tags the body with an ETag and answers 304 when the client already has it
+func writeJSONWithETag(w http.ResponseWriter, r *http.Request, v any) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeWithETag(w, r, "application/json", append(body, '\n'))
+}
+
+func writeWithETag(w http.ResponseWriter, r *http.Request, contentType string, body []byte) {
+	sum := sha256.Sum256(body)
+	etag := fmt.Sprintf("%q", hex.EncodeToString(sum[:16]))
+	w.Header().Set("ETag", etag)
+
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// If-None-Match is a comma separated list of tags, possibly weak, or *
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// GET /summaries/{videoID}?format=md|html. With format=html the summary, and any partial summary, is rendered to
+// sanitized HTML. Clients that send Accept: text/html get the bare fragment instead of a SummaryResponse.
+// start_seconds and end_seconds fetch the summary of that range instead of the full one
+func createSummaryFetcher(mgr *job.ActiveJobsManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		videoID := mux.Vars(r)["videoID"]
+
+		start, end, err := parseRangeQuery(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		location := fmt.Sprintf("%s/%s.md", adapters.Paths.Summaries, videoID)
+		if start > 0 || end > 0 {
+			location = adapters.RangeSummaryPath(videoID, start, end)
+		}
+
+		format := r.URL.Query().Get("format")
+		if format != "" && format != "md" && format != "html" {
+			http.Error(w, "format must be md or html", http.StatusBadRequest)
+			return
+		}
+		asHTML := format == "html"
+		bareHTML := asHTML && strings.Contains(r.Header.Get("Accept"), "text/html")
+		if asHTML {
+			w.Header().Set("Vary", "Accept")
+		}
+
+		render := func(summary string) (string, bool) {
+			if !asHTML || summary == "" {
+				return summary, true
+			}
+			rendered, err := adapters.RenderSummaryHTML(summary)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return "", false
+			}
+			return rendered, true
+		}
+
+		// Only the summary a running job is writing is in progress, a range job leaves the full summary readable and vice
+		// versa. A job that ended, however it ended, leaves whatever is on disk to be read
+		j := mgr.GetJob(videoID)
+		if j != nil && !j.IsTerminal() && j.Options.StartSeconds == start && j.Options.EndSeconds == end {
+			partial, ok := render(j.GetProgress().InProgressSummary)
+			if !ok {
+				return
+			}
+
+			if bareHTML {
+				w.Header().Set("Content-Type", "text/html; charset=utf-8")
+				w.WriteHeader(http.StatusAccepted)
+				io.WriteString(w, partial)
+				return
+			}
+
+			writeJSONWithETag(w, r, SummaryResponse{
+				NoSummaryReason: "in_progress",
+				PartialSummary:  partial,
+			})
+			return
+		}
+
+		b, err := os.ReadFile(location)
+
+		if errors.Is(err, os.ErrNotExist) {
+			if bareHTML {
+				http.NotFound(w, r)
+				return
+			}
+			writeJSONWithETag(w, r, SummaryResponse{NoSummaryReason: "not_found"})
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		summary, ok := render(string(b))
+		if !ok {
+			return
+		}
+
+		if bareHTML {
+			writeWithETag(w, r, "text/html; charset=utf-8", []byte(summary))
+			return
+		}
+
+		writeJSONWithETag(w, r, SummaryResponse{Summary: summary})
+	}
+}
+
+// PATCH /summaries/{videoID} with {"summary": "..."}. Overwrites the summary by hand. Refused while a job for the
+// video is running, since it would write its own summary over the edit
+func constructEditSummaryHandler(mgr *job.ActiveJobsManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		videoID := mux.Vars(r)["videoID"]
+
+		var req struct {
+			Summary string `json:"summary"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid request", bodyErrorStatus(err))
+			return
+		}
+		if strings.TrimSpace(req.Summary) == "" {
+			http.Error(w, "summary must not be empty", http.StatusBadRequest)
+			return
+		}
+
+		if j := mgr.GetJob(videoID); j != nil && !j.IsTerminal() {
+			writeJSON(w, http.StatusConflict, JobConflictResponse{Error: "job is still running", Status: j.GetStatus()})
+			return
+		}
+
+		if !adapters.SummaryExists(videoID) {
+			http.NotFound(w, r)
+			return
+		}
+
+		if err := adapters.WriteSummary(videoID, req.Summary); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, SummaryResponse{Summary: req.Summary})
+	}
+}
+
+// Reads start_seconds and end_seconds, both optional and 0 when missing
+func parseRangeQuery(q url.Values) (start float64, end float64, err error) {
+	for name, v := range map[string]*float64{"start_seconds": &start, "end_seconds": &end} {
+		raw := q.Get(name)
+		if raw == "" {
+			continue
+		}
+		if *v, err = strconv.ParseFloat(raw, 64); err != nil || *v < 0 {
+			return 0, 0, fmt.Errorf("%s must be a non-negative number of seconds", name)
 		}
 	}
+	return start, end, nil
 }
 
-func constructGetJobHandler(mgr *job.ActiveJobsManager) http.HandlerFunc {
+type SummaryDiffResponse struct {
+	From int                  `json:"from"`
+	To   int                  `json:"to"`
+	Diff []adapters.DiffChunk `json:"diff"`
+}
+
+func constructSummaryDiffHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		videoID := mux.Vars(r)["videoID"]
-		job := mgr.GetJob(videoID)
 
-		if job == nil {
-			w.WriteHeader(http.StatusNotFound)
+		from, err := strconv.Atoi(r.URL.Query().Get("from"))
+		if err != nil {
+			http.Error(w, "from must be a version number", http.StatusBadRequest)
 			return
 		}
 
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
+		to, err := strconv.Atoi(r.URL.Query().Get("to"))
+		if err != nil {
+			http.Error(w, "to must be a version number", http.StatusBadRequest)
+			return
+		}
 
-		if err := json.NewEncoder(w).Encode(job); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		versions := make([]string, 0, 2)
+		for _, v := range []int{from, to} {
+			summary, err := adapters.ReadSummaryVersion(videoID, v)
+			if os.IsNotExist(err) {
+				http.Error(w, fmt.Sprintf("summary version %d not found", v), http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			versions = append(versions, summary)
 		}
+
+		writeJSON(w, http.StatusOK, SummaryDiffResponse{
+			From: from,
+			To:   to,
+			Diff: adapters.DiffSummaries(versions[0], versions[1]),
+		})
 	}
 }
 
-func createNewSSEClient(mgr *job.ActiveJobsManager) http.HandlerFunc {
+func constructGetBlurbsHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Expose-Headers", "Content-Type")
-
-		w.Header().Set("Content-Type", "text/event-stream")
-		w.Header().Set("Cache-Control", "no-cache")
-		w.Header().Set("Connection", "keep-alive")
+		videoID := mux.Vars(r)["videoID"]
 
-		id := mgr.CreateClient(w)
-		defer mgr.DeleteClient(id)
+		blurbs, err := adapters.ReadBlurbs(videoID)
+		if os.IsNotExist(err) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 
-		// Don't return: keep the connection open until the client disconnects
-		<-r.Context().Done()
+		writeJSON(w, http.StatusOK, blurbs)
 	}
 }
 
-type SummaryResponse struct {
-	NoSummaryReason string `json:"no_summary_reason"`
-	Summary         string `json:"summary"`
-}
-
-func writeJSON(w http.ResponseWriter, code int, v any) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(code)
-	_ = json.NewEncoder(w).Encode(v)
+// Sent in place of the segments when there's no transcription, with a 404 so clients of the bare array see it as missing
+type NoTranscriptResponse struct {
+	NoTranscriptReason string `json:"no_transcript_reason"`
 }
 
-func createSummaryFetcher(mgr *job.ActiveJobsManager) http.HandlerFunc {
+// Serves the transcription as json (the default), srt or vtt. JSON is the bare []Segment array, or a
+// NoTranscriptResponse saying whether one is on the way, mirroring createSummaryFetcher
+func constructGetTranscriptionHandler(mgr *job.ActiveJobsManager) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		videoID := mux.Vars(r)["videoID"]
-		location := fmt.Sprintf("%s/%s.md", adapters.SummariesPath, videoID)
 
-		if j := mgr.GetJob(videoID); j != nil && j.GetStatus() != "finished" {
-			writeJSON(w, http.StatusOK, SummaryResponse{NoSummaryReason: "in_progress"})
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = "json"
+		}
+		if format != "json" && format != "srt" && format != "vtt" {
+			http.Error(w, "format must be json, srt or vtt", http.StatusBadRequest)
 			return
 		}
 
-		if _, err := os.Stat(location); errors.Is(err, os.ErrNotExist) {
-			writeJSON(w, http.StatusOK, SummaryResponse{NoSummaryReason: "not_found"})
+		segments, err := adapters.ReadTranscription(videoID)
+		if os.IsNotExist(err) && format == "json" {
+			reason := "not_found"
+			if j := mgr.GetJob(videoID); j != nil && !j.IsTerminal() {
+				reason = "in_progress"
+			}
+			writeJSON(w, http.StatusNotFound, NoTranscriptResponse{NoTranscriptReason: reason})
+			return
+		}
+		if os.IsNotExist(err) {
+			http.NotFound(w, r)
 			return
 		}
-
-		b, err := os.ReadFile(location)
-
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		writeJSON(w, http.StatusOK, SummaryResponse{Summary: string(b)})
+		switch format {
+		case "srt":
+			w.Header().Set("Content-Type", "application/x-subrip; charset=utf-8")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", videoID+".srt"))
+			io.WriteString(w, adapters.SegmentsToSRT(segments))
+		case "vtt":
+			w.Header().Set("Content-Type", "text/vtt; charset=utf-8")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", videoID+".vtt"))
+			io.WriteString(w, adapters.SegmentsToVTT(segments))
+		default:
+			writeJSON(w, http.StatusOK, segments)
+		}
 	}
 }
 
-func getChatHistory(w http.ResponseWriter, r *http.Request) {
-	videoID := mux.Vars(r)["videoID"]
-	chatPath := fmt.Sprintf("./content/chats/%s.json", videoID)
+// Pages backwards through the history with ?limit=N&before=index. The total message count is in X-Total-Count
+func constructGetChatHistoryHandler(chatMgr *chat.ChatManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		videoID := mux.Vars(r)["videoID"]
+
+		limit, before := 0, -1
+		var err error
 
-	var data []byte
+		if raw := r.URL.Query().Get("limit"); raw != "" {
+			if limit, err = strconv.Atoi(raw); err != nil || limit < 0 {
+				http.Error(w, "limit must be a non-negative number", http.StatusBadRequest)
+				return
+			}
+		}
+		if raw := r.URL.Query().Get("before"); raw != "" {
+			if before, err = strconv.Atoi(raw); err != nil || before < 0 {
+				http.Error(w, "before must be a non-negative message index", http.StatusBadRequest)
+				return
+			}
+		}
 
-	if _, err := os.Stat(chatPath); os.IsNotExist(err) {
-		data = []byte("[]")
-	} else {
-		data, err = os.ReadFile(chatPath)
+		page, total, err := chatMgr.LoadHistoryPage(videoID, limit, before)
 		if err != nil {
 			http.Error(w, "failed to load chat history", http.StatusInternalServerError)
 			return
 		}
+
+		w.Header().Set("X-Total-Count", strconv.Itoa(total))
+		writeJSON(w, http.StatusOK, page)
 	}
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write(data)
+func constructClearChatHandler(chatMgr *chat.ChatManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		videoID := mux.Vars(r)["videoID"]
+
+		err := chatMgr.ClearHistory(videoID)
+		if errors.Is(err, chat.ErrChatBusy) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+type DeleteChatMessageResponse struct {
+	Total int `json:"total"`
+}
+
+// Deletes the question and answer the message at {index} is part of. Responds with how many messages are left
+func constructDeleteChatMessageHandler(chatMgr *chat.ChatManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+
+		index, err := strconv.Atoi(vars["index"])
+		if err != nil || index < 0 {
+			http.Error(w, "index must be a non-negative message index", http.StatusBadRequest)
+			return
+		}
+
+		total, err := chatMgr.DeleteMessage(vars["videoID"], index)
+		switch {
+		case errors.Is(err, chat.ErrChatBusy):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case errors.Is(err, chat.ErrMessageNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, DeleteChatMessageResponse{Total: total})
+	}
 }
 
 func constructGetVideoHandler(db *db.DB) http.HandlerFunc {
@@ -137,7 +1320,29 @@ func constructGetVideoHandler(db *db.DB) http.HandlerFunc {
 			http.NotFound(w, r)
 			return
 		}
-		writeJSON(w, http.StatusOK, db.Read(videoID))
+		writeJSONWithETag(w, r, db.Read(videoID))
+	}
+}
+
+// GET /videos/search?q=...&full_text=true. Matches titles and creators, and summaries with full_text, best match first
+func constructSearchVideosHandler(db *db.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := strings.TrimSpace(r.URL.Query().Get("q"))
+		if query == "" {
+			http.Error(w, "q is required", http.StatusBadRequest)
+			return
+		}
+
+		fullText := false
+		if raw := r.URL.Query().Get("full_text"); raw != "" {
+			var err error
+			if fullText, err = strconv.ParseBool(raw); err != nil {
+				http.Error(w, "full_text must be true or false", http.StatusBadRequest)
+				return
+			}
+		}
+
+		writeJSON(w, http.StatusOK, adapters.SearchVideos(db.ReadAll(), query, fullText))
 	}
 }
 
@@ -147,25 +1352,74 @@ func constructGetAllVideosHandler(db *db.DB) http.HandlerFunc {
 	}
 }
 
+func constructDeleteVideoHandler(db *db.DB, mgr *job.ActiveJobsManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		videoID := mux.Vars(r)["videoID"]
+		if !db.Exists(videoID) {
+			http.NotFound(w, r)
+			return
+		}
+
+		// Deleting files out from under a running job would just make it fail halfway through
+		if j := mgr.GetJob(videoID); j != nil {
+			if !j.IsTerminal() {
+				http.Error(w, "video has an active job", http.StatusConflict)
+				return
+			}
+			mgr.DeleteJob(videoID)
+		}
+
+		if err := adapters.DeleteVideoArtifacts(videoID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		db.Delete(videoID)
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+type ChatErrorResponse struct {
+	Error string `json:"error"`
+	Code  string `json:"code"`
+}
+
 func constructSendChatHandler(chatMgr *chat.ChatManager) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		videoID := mux.Vars(r)["videoID"]
 
 		var req struct {
 			Message string `json:"message"`
+			// Optional, overrides the chat model from settings
+			Model string `json:"model"`
 		}
 
+		r.Body = http.MaxBytesReader(w, r.Body, MaxChatMessageBytes)
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "invalid request", http.StatusBadRequest)
+			http.Error(w, "invalid request", bodyErrorStatus(err))
 			return
 		}
 
-		if err := chatMgr.SendMessage(videoID, req.Message); err != nil {
+		if req.Model != "" && !adapters.IsAllowedChatModel(req.Model) {
+			http.Error(w, fmt.Sprintf("chat model %q is not allowed", req.Model), http.StatusBadRequest)
+			return
+		}
+
+		requestID, err := chatMgr.SendMessage(videoID, req.Message, req.Model)
+		if errors.Is(err, adapters.ErrNoVideoContext) {
+			writeJSON(w, http.StatusUnprocessableEntity, ChatErrorResponse{Error: err.Error(), Code: "no_video_context"})
+			return
+		}
+		if errors.Is(err, chat.ErrQueueFull) {
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+		if err != nil {
 			http.Error(w, err.Error(), http.StatusConflict)
 			return
 		}
 
-		w.WriteHeader(http.StatusAccepted)
+		writeJSON(w, http.StatusAccepted, map[string]string{"request_id": requestID})
 	}
 }
 
@@ -173,8 +1427,7 @@ func createChatSSEClient(chatMgr *chat.ChatManager) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		videoID := mux.Vars(r)["videoID"]
 
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Expose-Headers", "Content-Type")
+		streamWithoutDeadlines(w)
 		w.Header().Set("Content-Type", "text/event-stream")
 		w.Header().Set("Cache-Control", "no-cache")
 		w.Header().Set("Connection", "keep-alive")
@@ -186,7 +1439,7 @@ func createChatSSEClient(chatMgr *chat.ChatManager) http.HandlerFunc {
 		}
 		defer chatMgr.DeleteClient(id)
 
-		<-r.Context().Done()
+		keepSSEAlive(r.Context(), chatMgr.Closed(), func() { chatMgr.Heartbeat(id) })
 	}
 }
 
@@ -209,18 +1462,218 @@ func loadRequiredEnvVars() (string, string) {
 	return ytdlpBin, groqAPIKey
 }
 
+func getEnvInt(name string, fallback int) int {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return fallback
+	}
+
+	n, err := strconv.Atoi(raw)
+	if err != nil {
+		log.Fatalf("%s must be an integer, got %q", name, raw)
+	}
+
+	return n
+}
+
+// Turns "yt-sum", "/yt-sum/" and so on into "/yt-sum". Root becomes ""
+func normalizeBasePath(raw string) string {
+	trimmed := strings.Trim(strings.TrimSpace(raw), "/")
+	if trimmed == "" {
+		return ""
+	}
+	return "/" + trimmed
+}
+
+func getEnvFloat(name string, fallback float64) float64 {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return fallback
+	}
+
+	f, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		log.Fatalf("%s must be a number, got %q", name, raw)
+	}
+
+	return f
+}
+
+// Comma separated, with blanks dropped. Unset or empty uses fallback
+func getEnvList(name string, fallback []string) []string {
+	list := make([]string, 0)
+	for _, item := range strings.Split(os.Getenv(name), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+
+	if len(list) == 0 {
+		return fallback
+	}
+	return list
+}
+
+func getEnvBool(name string, fallback bool) bool {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return fallback
+	}
+
+	b, err := strconv.ParseBool(raw)
+	if err != nil {
+		log.Fatalf("%s must be true or false, got %q", name, raw)
+	}
+
+	return b
+}
+
+func getEnvString(name string, fallback string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// Parses "model=tokens,model=tokens"
+func getEnvTokenLimits(name string) map[string]int {
+	limits := make(map[string]int)
+
+	for _, pair := range strings.Split(os.Getenv(name), ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+
+		model, raw, ok := strings.Cut(pair, "=")
+		tokens, err := strconv.Atoi(strings.TrimSpace(raw))
+		if !ok || err != nil || tokens <= 0 {
+			log.Fatalf("%s entries must look like model=tokens, got %q", name, pair)
+		}
+		limits[strings.TrimSpace(model)] = tokens
+	}
+
+	return limits
+}
+
+// Optional tuning knobs. Anything unset keeps the adapters package default
+func loadOptionalEnvVars() {
+	adapters.Paths = adapters.NewContentPaths(getEnvString("CONTENT_DIR", adapters.Paths.Root))
+	adapters.ShortVideoSeconds = getEnvInt("SHORT_VIDEO_SECONDS", adapters.ShortVideoSeconds)
+	adapters.MaxVideoSeconds = getEnvInt("MAX_VIDEO_SECONDS", adapters.MaxVideoSeconds)
+	adapters.ShortSummaryPrompt = getEnvString("SHORT_SUMMARY_PROMPT", adapters.ShortSummaryPrompt)
+	AdminToken = getEnvString("ADMIN_TOKEN", AdminToken)
+	MetricsEnabled = getEnvBool("METRICS", MetricsEnabled)
+	CleanupOnStart = getEnvBool("CLEANUP_ON_START", CleanupOnStart)
+	MaxRequestBodyBytes = int64(getEnvInt("MAX_REQUEST_BODY_BYTES", int(MaxRequestBodyBytes)))
+	ShutdownTimeout = time.Duration(getEnvInt("SHUTDOWN_TIMEOUT_SECONDS", int(ShutdownTimeout/time.Second))) * time.Second
+	job.BroadcastConcurrency = getEnvInt("BROADCAST_CONCURRENCY", job.BroadcastConcurrency)
+	job.IdempotencyTTL = time.Duration(getEnvInt("IDEMPOTENCY_TTL_SECONDS", int(job.IdempotencyTTL/time.Second))) * time.Second
+	job.JobTTL = time.Duration(getEnvInt("JOB_TTL_SECONDS", int(job.JobTTL/time.Second))) * time.Second
+	transcriber, err := adapters.NewTranscriber(getEnvString("TRANSCRIBE_PROVIDER", ""))
+	if err != nil {
+		log.Fatalf("Invalid TRANSCRIBE_PROVIDER: %s", err.Error())
+	}
+	adapters.ActiveTranscriber = transcriber
+	if url := getEnvString("DIARIZATION_URL", ""); url != "" {
+		adapters.ActiveDiarizer = adapters.HTTPDiarizer{URL: url}
+	}
+	adapters.AllowOpenChat = getEnvBool("ALLOW_OPEN_CHAT", adapters.AllowOpenChat)
+	chat.MaxQueuedMessages = getEnvInt("CHAT_MAX_QUEUED_MESSAGES", chat.MaxQueuedMessages)
+	adapters.WebhookURL = getEnvString("WEBHOOK_URL", adapters.WebhookURL)
+	adapters.WebhookAllowedHosts = getEnvList("WEBHOOK_ALLOWED_HOSTS", adapters.WebhookAllowedHosts)
+	adapters.TrimNonSpeech = getEnvBool("TRIM_NON_SPEECH", adapters.TrimNonSpeech)
+	adapters.NoSpeechThreshold = getEnvFloat("NO_SPEECH_THRESHOLD", adapters.NoSpeechThreshold)
+	adapters.SkipSilentChunks = getEnvBool("SKIP_SILENT_CHUNKS", adapters.SkipSilentChunks)
+	adapters.SilentChunkMaxDB = getEnvFloat("SILENT_CHUNK_MAX_DB", adapters.SilentChunkMaxDB)
+	adapters.SummaryCaching = getEnvBool("SUMMARY_CACHE", adapters.SummaryCaching)
+	adapters.StreamSummaries = getEnvBool("STREAM_SUMMARIES", adapters.StreamSummaries)
+	adapters.MinSummarySegments = getEnvInt("SUMMARY_MIN_SEGMENTS", adapters.MinSummarySegments)
+	adapters.MinSummaryWords = getEnvInt("SUMMARY_MIN_WORDS", adapters.MinSummaryWords)
+	adapters.MaxTranscriptionRequests = getEnvInt("TRANSCRIBE_MAX_REQUESTS", adapters.MaxTranscriptionRequests)
+	adapters.DownloadRetries = getEnvInt("DOWNLOAD_RETRIES", adapters.DownloadRetries)
+	adapters.DownloadRetryBackoff = time.Duration(getEnvInt("DOWNLOAD_RETRY_BACKOFF_SECONDS", int(adapters.DownloadRetryBackoff/time.Second))) * time.Second
+	adapters.DownloadRetryJitter = getEnvFloat("DOWNLOAD_RETRY_JITTER", adapters.DownloadRetryJitter)
+	adapters.RateLimitMaxWait = time.Duration(getEnvInt("RATE_LIMIT_MAX_WAIT_SECONDS", int(adapters.RateLimitMaxWait/time.Second))) * time.Second
+	adapters.YtdlpCookiesFile = getEnvString("YTDLP_COOKIES_FILE", adapters.YtdlpCookiesFile)
+	adapters.YtdlpProxy = getEnvString("HTTP_PROXY", adapters.YtdlpProxy)
+	adapters.TranscribeChunkWorkers = getEnvInt("TRANSCRIBE_CHUNK_WORKERS", adapters.TranscribeChunkWorkers)
+	adapters.TranscribeChunkSeconds = getEnvInt("TRANSCRIBE_CHUNK_SECONDS", adapters.TranscribeChunkSeconds)
+	if adapters.TranscribeChunkSeconds < 1 {
+		log.Fatalf("TRANSCRIBE_CHUNK_SECONDS must be at least 1, got %d", adapters.TranscribeChunkSeconds)
+	}
+	adapters.TranscribeCodec = getEnvString("TRANSCRIBE_CODEC", adapters.TranscribeCodec)
+	if _, ok := adapters.TranscribeCodecs[adapters.TranscribeCodec]; !ok {
+		log.Fatalf("Invalid TRANSCRIBE_CODEC %q, expected opus or mp3", adapters.TranscribeCodec)
+	}
+	adapters.TranscribeBitrate = getEnvString("TRANSCRIBE_BITRATE", adapters.TranscribeBitrate)
+	adapters.LiveStreamPolicy = getEnvString("LIVE_STREAM_POLICY", adapters.LiveStreamPolicy)
+	if !slices.Contains(adapters.LiveStreamPolicies, adapters.LiveStreamPolicy) {
+		log.Fatalf("Invalid LIVE_STREAM_POLICY %q, expected reject or wait", adapters.LiveStreamPolicy)
+	}
+	adapters.LiveStreamPollInterval = time.Duration(getEnvInt("LIVE_STREAM_POLL_SECONDS", int(adapters.LiveStreamPollInterval/time.Second))) * time.Second
+	if adapters.LiveStreamPollInterval <= 0 {
+		log.Fatalf("LIVE_STREAM_POLL_SECONDS must be positive")
+	}
+	adapters.LiveStreamMaxWait = time.Duration(getEnvInt("LIVE_STREAM_MAX_WAIT_SECONDS", int(adapters.LiveStreamMaxWait/time.Second))) * time.Second
+	adapters.NormalizeCaptionOverlap = getEnvBool("VTT_NORMALIZED_DEDUP", adapters.NormalizeCaptionOverlap)
+	adapters.DefaultModelTokenLimit = getEnvInt("DEFAULT_MODEL_TOKEN_LIMIT", adapters.DefaultModelTokenLimit)
+	adapters.MaxTokens = getEnvInt("SUMMARY_MAX_TOKENS", adapters.MaxTokens)
+	if adapters.MaxTokens <= 0 {
+		log.Fatalf("SUMMARY_MAX_TOKENS must be positive")
+	}
+	adapters.SummaryChunkOverlap = getEnvInt("SUMMARY_CHUNK_OVERLAP_TOKENS", adapters.SummaryChunkOverlap)
+	if adapters.SummaryChunkOverlap < 0 {
+		log.Fatalf("SUMMARY_CHUNK_OVERLAP_TOKENS can't be negative")
+	}
+	for model, tokens := range getEnvTokenLimits("MODEL_TOKEN_LIMITS") {
+		adapters.ModelTokenLimits[model] = tokens
+	}
+}
+
+// Text for local dev, or JSON for log aggregation. Plain log calls go through the same handler
+func setupLogging(format string) *slog.Logger {
+	var handler slog.Handler
+	switch format {
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, nil)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, nil)
+	default:
+		log.Fatalf("LOG_FORMAT must be text or json, got %q", format)
+	}
+
+	logger := slog.New(handler)
+	slog.SetDefault(logger)
+	adapters.Logger = logger
+
+	return logger
+}
+
+func loadPipelineOptions() pipeline.Options {
+	opts := pipeline.DefaultOptions()
+	opts.TranscribeWorkers = getEnvInt("TRANSCRIBE_WORKERS", opts.TranscribeWorkers)
+	opts.SummarizeWorkers = getEnvInt("SUMMARIZE_WORKERS", opts.SummarizeWorkers)
+
+	policy, err := pipeline.ParseSchedulingPolicy(getEnvString("SUMMARY_SCHEDULING", string(opts.SchedulingPolicy)))
+	if err != nil {
+		log.Fatalf("Invalid SUMMARY_SCHEDULING: %s", err.Error())
+	}
+	opts.SchedulingPolicy = policy
+
+	opts.StageAttempts = getEnvInt("STAGE_ATTEMPTS", opts.StageAttempts)
+	opts.StageRetryBackoff = time.Duration(getEnvInt("STAGE_RETRY_BACKOFF_SECONDS", int(opts.StageRetryBackoff/time.Second))) * time.Second
+	opts.MaxActiveJobs = getEnvInt("MAX_ACTIVE_JOBS", opts.MaxActiveJobs)
+
+	return opts
+}
+
 func constructGetModelsHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		req, err := http.NewRequest("GET", adapters.GetModelsURL(), nil)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		resp, err := adapters.ListModels(r.Context())
+		if errors.Is(err, adapters.ErrMissingAPIKey) {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
 			return
 		}
-
-		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", adapters.GetAPIKey()))
-
-		client := &http.Client{}
-		resp, err := client.Do(req)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -233,6 +1686,17 @@ func constructGetModelsHandler() http.HandlerFunc {
 	}
 }
 
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	report := adapters.CheckHealth(r.Context())
+
+	code := http.StatusOK
+	if !report.OK {
+		code = http.StatusServiceUnavailable
+	}
+
+	writeJSON(w, code, report)
+}
+
 func constructGetSettingsHandler(sm *settings.SettingsManager) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		writeJSON(w, http.StatusOK, sm.GetSettings())
@@ -243,7 +1707,7 @@ func constructUpdateSettingsHandler(sm *settings.SettingsManager) http.HandlerFu
 	return func(w http.ResponseWriter, r *http.Request) {
 		var s settings.Settings
 		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			http.Error(w, err.Error(), bodyErrorStatus(err))
 			return
 		}
 
@@ -259,9 +1723,11 @@ func constructUpdateSettingsHandler(sm *settings.SettingsManager) http.HandlerFu
 func main() {
 	log.Println("Loading environment variables")
 	ytdlpBin, groqAPIKey := loadRequiredEnvVars()
+	logger := setupLogging(getEnvString("LOG_FORMAT", "text"))
+	loadOptionalEnvVars()
 
 	log.Println("Initializing settings manager")
-	sm, err := settings.NewSettingsManager("./content/settings.json")
+	sm, err := settings.NewSettingsManager(adapters.Paths.Settings)
 	if err != nil {
 		log.Fatalf("Failed to initialize settings manager: %s", err.Error())
 	}
@@ -269,56 +1735,191 @@ func main() {
 	// Initialize adapters with environment variables and settings manager
 	adapters.Init(ytdlpBin, groqAPIKey, sm)
 
+	if err := adapters.EnsureContentDirs(); err != nil {
+		log.Fatalf("Failed to create content directories: %s", err.Error())
+	}
+
+	if err := adapters.RunMigrations(); err != nil {
+		log.Fatalf("Failed to migrate content: %s", err.Error())
+	}
+
+	if CleanupOnStart {
+		removed, err := adapters.CleanupDownloads()
+		if err != nil {
+			log.Fatalf("Failed to clean up downloads: %s", err.Error())
+		}
+		log.Printf("Removed %d leftover downloads", removed)
+	}
+
 	r := mux.NewRouter()
 
+	// Every route lives under BASE_PATH, so the server can sit behind a proxy at e.g. /yt-sum/
+	BasePath = normalizeBasePath(getEnvString("BASE_PATH", ""))
+	api := r
+	if BasePath != "" {
+		api = r.PathPrefix(BasePath).Subrouter()
+		log.Printf("Serving routes under %s", BasePath)
+	}
+	api.Use(validateVideoIDMiddleware, limitBodyMiddleware)
+
+	adapters.PublicURL = strings.TrimRight(getEnvString("PUBLIC_URL", ""), "/") + BasePath
+
+	// Browsers refuse credentials with a wildcard origin, so they're only allowed once the origins are listed
+	origins := getEnvList("CORS_ORIGINS", []string{"*"})
 	c := cors.New(cors.Options{
-		AllowedOrigins:   []string{"*"},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowedOrigins:   origins,
+		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
 		AllowedHeaders:   []string{"*"},
-		AllowCredentials: true,
+		ExposedHeaders:   []string{"X-Total-Count", "ETag"},
+		AllowCredentials: !slices.Contains(origins, "*"),
 	})
 
+	// Requests without an Origin don't come from a browser, so there's no page to protect
+	wsUpgrader.CheckOrigin = func(r *http.Request) bool {
+		return r.Header.Get("Origin") == "" || c.OriginAllowed(r)
+	}
+
 	log.Println("Setting up DB")
-	db, err := db.NewDB(DBPath)
+	db, err := db.NewDB(adapters.Paths.DB)
 
 	if err != nil {
 		log.Fatalf("Failed to initailized db: %s", err.Error())
 	}
 
 	log.Println("Creating job manager")
-	mgr := job.NewJobManager(db)
+	mgr, err := job.NewJobManager(db, adapters.Paths.Jobs, adapters.SummaryExists)
+	if err != nil {
+		log.Fatalf("Failed to restore jobs: %s", err.Error())
+	}
 
 	log.Println("Creating chat manager")
 	chatMgr := chat.NewChatManager()
 
 	log.Println("Booting up pipeline")
-	pipe := pipeline.NewSummarizerPipeline(mgr)
-	videoIdIn := pipe.Start()
-	log.Println("Defining routes")
-	r.HandleFunc("/summarize/{videoID}", constructQueueHandler(videoIdIn)).Methods("POST")
-	r.HandleFunc("/summarize/{videoID}", constructGetJobHandler(mgr)).Methods("GET")
+	pipeOpts := loadPipelineOptions()
+	pipeOpts.Logger = logger
+	pipe := pipeline.NewSummarizerPipeline(mgr, pipeOpts)
+
+	if MetricsEnabled {
+		reg := prometheus.NewRegistry()
+		reg.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+
+		for _, register := range []func(prometheus.Registerer) error{pipe.RegisterMetrics, mgr.RegisterMetrics, chatMgr.RegisterMetrics} {
+			if err := register(reg); err != nil {
+				log.Fatalf("Failed to register metrics: %s", err.Error())
+			}
+		}
 
-	r.HandleFunc("/summaries/{videoID}", createSummaryFetcher(mgr)).Methods("GET")
-	r.HandleFunc("/videos/{videoID}", constructGetVideoHandler(db)).Methods("GET")
+		api.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{})).Methods("GET")
+		log.Println("Serving metrics at /metrics")
+	}
 
-	r.HandleFunc("/videos", constructGetAllVideosHandler(db)).Methods("GET")
+	pipe.Start()
+	log.Println("Defining routes")
+	api.HandleFunc("/summarize/batch", constructBatchQueueHandler(pipe, db)).Methods("POST")
+	api.HandleFunc("/summarize/playlist/{playlistID}", constructPlaylistQueueHandler(pipe, db)).Methods("POST")
+	api.HandleFunc("/summarize", constructQueueURLHandler(pipe, mgr)).Methods("POST")
+	api.HandleFunc("/summarize/{videoID}", constructQueueHandler(pipe, mgr)).Methods("POST")
+	api.HandleFunc("/summarize/{videoID}/retry", constructRetryJobHandler(pipe, db, mgr)).Methods("POST")
+	api.HandleFunc("/summarize/{videoID}/estimate", constructEstimateHandler(mgr)).Methods("GET")
+	api.HandleFunc("/summarize/status", constructJobStatusesHandler(mgr)).Methods("GET")
+	api.HandleFunc("/summarize/jobs", constructListJobsHandler(mgr, db)).Methods("GET")
+	api.HandleFunc("/summarize/jobs/batch", constructBatchJobStatusHandler(mgr, db)).Methods("POST")
+	api.HandleFunc("/summarize/capacity", constructCapacityHandler(pipe)).Methods("GET")
+	api.HandleFunc("/summarize/{videoID}", constructGetJobHandler(mgr)).Methods("GET")
+	api.HandleFunc("/summarize/{videoID}", constructCancelJobHandler(mgr)).Methods("DELETE")
+
+	api.HandleFunc("/jobs/status-summary", constructJobStatusSummaryHandler(mgr)).Methods("GET")
+
+	api.HandleFunc("/summaries/{videoID}", createSummaryFetcher(mgr)).Methods("GET")
+	api.HandleFunc("/summaries/{videoID}", constructEditSummaryHandler(mgr)).Methods("PATCH")
+	api.HandleFunc("/summaries/{videoID}/diff", constructSummaryDiffHandler()).Methods("GET")
+	api.HandleFunc("/summaries/{videoID}/regenerate", constructRegenerateHandler(pipe, mgr)).Methods("POST")
+	api.HandleFunc("/summaries/{videoID}/blurbs", constructGetBlurbsHandler()).Methods("GET")
+	api.HandleFunc("/transcriptions/{videoID}", constructGetTranscriptionHandler(mgr)).Methods("GET")
+	api.HandleFunc("/videos/search", constructSearchVideosHandler(db)).Methods("GET")
+	api.HandleFunc("/videos/{videoID}", constructGetVideoHandler(db)).Methods("GET")
+	api.HandleFunc("/videos/{videoID}", constructDeleteVideoHandler(db, mgr)).Methods("DELETE")
+
+	api.HandleFunc("/videos", constructGetAllVideosHandler(db)).Methods("GET")
 
 	// Opens a long lived SSE stream
-	r.HandleFunc("/summarize/jobs/subscribe", createNewSSEClient(mgr)).Methods("GET")
+	api.HandleFunc("/summarize/jobs/subscribe", createNewSSEClient(mgr)).Methods("GET")
+	// Or the same over a WebSocket
+	api.HandleFunc("/summarize/jobs/ws", createNewWSClient(mgr)).Methods("GET")
 
 	// Chat endpoints
-	r.HandleFunc("/chat/{videoID}", getChatHistory).Methods("GET")
-	r.HandleFunc("/chat/{videoID}/send", constructSendChatHandler(chatMgr)).Methods("POST")
-	r.HandleFunc("/chat/{videoID}/subscribe", createChatSSEClient(chatMgr)).Methods("GET")
+	api.HandleFunc("/chat/{videoID}", constructGetChatHistoryHandler(chatMgr)).Methods("GET")
+	api.HandleFunc("/chat/{videoID}", constructClearChatHandler(chatMgr)).Methods("DELETE")
+	api.HandleFunc("/chat/{videoID}/send", constructSendChatHandler(chatMgr)).Methods("POST")
+	api.HandleFunc("/chat/{videoID}/messages/{index}", constructDeleteChatMessageHandler(chatMgr)).Methods("DELETE")
+	api.HandleFunc("/chat/{videoID}/subscribe", createChatSSEClient(chatMgr)).Methods("GET")
+
+	api.HandleFunc("/healthz", healthHandler).Methods("GET")
+
+	// Admin endpoints, gated behind ADMIN_TOKEN
+	api.HandleFunc("/admin/retry-failed", requireAdmin(constructRetryFailedHandler(pipe, db, mgr))).Methods("POST")
+	api.HandleFunc("/admin/queue", requireAdmin(constructQueueDepthsHandler(pipe))).Methods("GET")
+	api.HandleFunc("/admin/queue/flush", requireAdmin(constructFlushQueueHandler(pipe))).Methods("POST")
 
 	// Settings and models
-	r.HandleFunc("/api/models", constructGetModelsHandler()).Methods("GET")
-	r.HandleFunc("/api/settings", constructGetSettingsHandler(sm)).Methods("GET")
-	r.HandleFunc("/api/settings", constructUpdateSettingsHandler(sm)).Methods("POST")
+	api.HandleFunc("/api/models", constructGetModelsHandler()).Methods("GET")
+	api.HandleFunc("/api/settings", constructGetSettingsHandler(sm)).Methods("GET")
+	api.HandleFunc("/api/settings", constructUpdateSettingsHandler(sm)).Methods("POST")
+
+	srv := &http.Server{
+		Addr:              ":3211",
+		Handler:           c.Handler(r),
+		ReadHeaderTimeout: serverReadHeaderTimeout,
+		ReadTimeout:       serverReadTimeout,
+		WriteTimeout:      serverWriteTimeout,
+		IdleTimeout:       serverIdleTimeout,
+	}
+
+	// SSE streams never go idle on their own, so Shutdown would wait on them forever
+	srv.RegisterOnShutdown(func() {
+		mgr.CloseClients()
+		chatMgr.CloseClients()
+	})
+
+	go func() {
+		log.Println("Serving on port 3211!")
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+
+	log.Printf("Received %s, shutting down", sig)
+	shutdown(srv, pipe, mgr, db)
+}
+
+// Stops taking requests, lets the pipeline finish what it's working on, then saves the jobs and the DB
+func shutdown(srv *http.Server, pipe *pipeline.SummarizerPipeline, mgr *job.ActiveJobsManager, db *db.DB) {
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Closing connections that didn't finish in time: %s", err.Error())
+		srv.Close()
+	}
 
-	handler := c.Handler(r)
-	log.Println("Serving on port 3211!")
-	if err := http.ListenAndServe(":3211", handler); err != nil {
-		log.Fatal(err)
+	// Handlers are done submitting now, so the pipeline can close its request channel
+	stageCtx, cancelStages := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancelStages()
+
+	log.Println("Waiting for in-flight pipeline stages")
+	if err := pipe.Stop(stageCtx); err != nil {
+		log.Printf("Pipeline stages didn't finish in time, their jobs will be failed on restart: %s", err.Error())
+	}
+
+	if err := mgr.SaveCheckpoint(); err != nil {
+		log.Printf("Failed to checkpoint jobs: %s", err.Error())
 	}
+	db.SaveToFile()
+
+	log.Println("Shut down cleanly")
 }
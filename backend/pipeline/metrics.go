@@ -0,0 +1,103 @@
+package pipeline
+
+import (
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Prometheus metrics for the pipeline. A nil *stageMetrics records nothing, which is what you get until RegisterMetrics is called
+type stageMetrics struct {
+	enqueued      prometheus.Counter
+	completed     prometheus.Counter
+	failed        *prometheus.CounterVec
+	stageDuration *prometheus.HistogramVec
+}
+
+// Registers the pipeline's counters, stage duration histograms and queue depth gauges with reg.
+// Call it before Start
+func (pipe *SummarizerPipeline) RegisterMetrics(reg prometheus.Registerer) error {
+	m := &stageMetrics{
+		enqueued: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "ytsum_jobs_enqueued_total",
+			Help: "Jobs created by the pipeline.",
+		}),
+		completed: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "ytsum_jobs_completed_total",
+			Help: "Jobs that finished every stage.",
+		}),
+		failed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ytsum_jobs_failed_total",
+			Help: "Jobs that failed, by the stage they failed at.",
+		}, []string{"stage"}),
+		stageDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "ytsum_stage_duration_seconds",
+			Help: "Time a job spent in a stage, including failed attempts.",
+			// Stages take anywhere from a second for cached captions to an hour for a long transcription
+			Buckets: prometheus.ExponentialBuckets(1, 2, 13),
+		}, []string{"stage"}),
+	}
+
+	collectors := []prometheus.Collector{m.enqueued, m.completed, m.failed, m.stageDuration}
+
+	for name, depth := range pipe.queues() {
+		collectors = append(collectors, prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "ytsum_queue_depth",
+			Help:        "Jobs waiting to enter a stage.",
+			ConstLabels: prometheus.Labels{"queue": name},
+		}, func() float64 { return float64(depth()) }))
+	}
+
+	collectors = append(collectors, prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "ytsum_active_jobs",
+		Help: "Jobs holding a slot, from being submitted until they finish, fail or are cancelled. Only counted with MAX_ACTIVE_JOBS set.",
+	}, func() float64 {
+		active, _ := pipe.ActiveJobs()
+		return float64(active)
+	}))
+
+	for _, c := range collectors {
+		if err := reg.Register(c); err != nil {
+			return err
+		}
+	}
+
+	pipe.metrics = m
+	return nil
+}
+
+// Stage names as they appear in PipelineError, without the NextJob suffix
+func stageLabel(stage string) string {
+	return strings.TrimSuffix(stage, "NextJob")
+}
+
+func (m *stageMetrics) jobEnqueued() {
+	if m != nil {
+		m.enqueued.Inc()
+	}
+}
+
+func (m *stageMetrics) jobCompleted() {
+	if m != nil {
+		m.completed.Inc()
+	}
+}
+
+func (m *stageMetrics) jobFailed(stage string) {
+	if m != nil {
+		m.failed.WithLabelValues(stageLabel(stage)).Inc()
+	}
+}
+
+// Call at the start of a stage, and defer what it returns
+func (m *stageMetrics) timeStage(stage string) func() {
+	if m == nil {
+		return func() {}
+	}
+
+	start := time.Now()
+	return func() {
+		m.stageDuration.WithLabelValues(stageLabel(stage)).Observe(time.Since(start).Seconds())
+	}
+}
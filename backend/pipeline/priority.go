@@ -0,0 +1,109 @@
+package pipeline
+
+import (
+	"container/heap"
+	"fmt"
+	"sync"
+
+	"go-yt-sum/job"
+)
+
+// Order jobs leave the entry queue in. Higher goes first, and jobs of equal priority keep their arrival order
+type Priority int
+
+const (
+	PriorityLow    Priority = -1
+	PriorityNormal Priority = 0
+	PriorityHigh   Priority = 1
+)
+
+// Empty means normal
+func ParsePriority(s string) (Priority, error) {
+	switch s {
+	case "", "normal":
+		return PriorityNormal, nil
+	case "high":
+		return PriorityHigh, nil
+	case "low":
+		return PriorityLow, nil
+	}
+	return PriorityNormal, fmt.Errorf("unknown priority %q (expected low, normal or high)", s)
+}
+
+type queuedJob struct {
+	job      *job.SummaryJob
+	priority Priority
+	// Arrival order, for ties
+	seq uint64
+}
+
+// container/heap's view of the queue. Requires the pendingQueue's lock
+type jobHeap []queuedJob
+
+func (h jobHeap) Len() int { return len(h) }
+func (h jobHeap) Less(i, k int) bool {
+	if h[i].priority != h[k].priority {
+		return h[i].priority > h[k].priority
+	}
+	return h[i].seq < h[k].seq
+}
+func (h jobHeap) Swap(i, k int) { h[i], h[k] = h[k], h[i] }
+func (h *jobHeap) Push(x any)   { *h = append(*h, x.(queuedJob)) }
+func (h *jobHeap) Pop() any {
+	old := *h
+	last := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return last
+}
+
+// New jobs waiting for the download stage, highest priority first
+type pendingQueue struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	jobs jobHeap
+	seq  uint64
+}
+
+func newPendingQueue() *pendingQueue {
+	q := &pendingQueue{}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+func (q *pendingQueue) Push(j *job.SummaryJob, priority Priority) {
+	q.mu.Lock()
+	q.seq++
+	heap.Push(&q.jobs, queuedJob{job: j, priority: priority, seq: q.seq})
+	q.mu.Unlock()
+
+	q.cond.Signal()
+}
+
+// Blocks until a job is waiting, then removes and returns the one that should go next
+func (q *pendingQueue) Pop() *job.SummaryJob {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for q.jobs.Len() == 0 {
+		q.cond.Wait()
+	}
+	return heap.Pop(&q.jobs).(queuedJob).job
+}
+
+// Removes and returns every waiting job, in the order they would have gone
+func (q *pendingQueue) Drain() []*job.SummaryJob {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	drained := make([]*job.SummaryJob, 0, q.jobs.Len())
+	for q.jobs.Len() > 0 {
+		drained = append(drained, heap.Pop(&q.jobs).(queuedJob).job)
+	}
+	return drained
+}
+
+func (q *pendingQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.jobs.Len()
+}
@@ -0,0 +1,82 @@
+package pipeline
+
+import (
+	"go-yt-sum/job"
+)
+
+// How many jobs are waiting in front of each stage, keyed by the names the queue depth metrics use
+func (pipe *SummarizerPipeline) queues() map[string]func() int {
+	return map[string]func() int{
+		"requests":    func() int { return len(pipe.requestIn) },
+		"download":    func() int { return pipe.pending.Len() + len(pipe.pendingCh) },
+		"transcribe":  func() int { return len(pipe.downloadedCh) },
+		"transcribed": func() int { return len(pipe.transcribedCh) },
+		"summarize":   pipe.ready.Len,
+		"finish":      func() int { return len(pipe.summarizedCh) },
+	}
+}
+
+// A snapshot of every queue's length. They're read one after another, so jobs moving between stages
+// can be counted twice or not at all
+func (pipe *SummarizerPipeline) QueueDepths() map[string]int {
+	depths := make(map[string]int)
+	for name, depth := range pipe.queues() {
+		depths[name] = depth()
+	}
+	return depths
+}
+
+// Empties every queue in front of a stage and cancels the jobs that were in them. Jobs a stage is working on
+// are left alone, as are finished jobs waiting to be recorded. Requests that hadn't become jobs yet are dropped.
+// Returns the IDs of the cancelled jobs and how many requests were dropped
+func (pipe *SummarizerPipeline) Flush() ([]string, int) {
+	dropped := pipe.drainRequests()
+
+	waiting := pipe.pending.Drain()
+	for _, ch := range []chan *job.SummaryJob{pipe.pendingCh, pipe.downloadedCh, pipe.transcribedCh} {
+		waiting = append(waiting, drainJobs(ch)...)
+	}
+	waiting = append(waiting, pipe.ready.Drain()...)
+
+	cancelled := make([]string, 0, len(waiting))
+	for _, j := range waiting {
+		// Fails for a job that was already cancelled, which has its own reason for leaving the pipeline
+		if err := pipe.mgr.CancelJob(j.VideoID); err == nil {
+			cancelled = append(cancelled, j.VideoID)
+		}
+		pipe.releaseSlot()
+	}
+
+	pipe.opts.Logger.Info("flushed queues", "cancelled", len(cancelled), "dropped_requests", dropped)
+	return cancelled, dropped
+}
+
+// Drops the requests waiting in requestIn, freeing their slots. Returns how many there were
+func (pipe *SummarizerPipeline) drainRequests() int {
+	dropped := 0
+	for {
+		select {
+		case _, ok := <-pipe.requestIn:
+			if !ok {
+				return dropped
+			}
+			dropped++
+			pipe.releaseSlot()
+		default:
+			return dropped
+		}
+	}
+}
+
+// Takes whatever is buffered in ch without waiting for more
+func drainJobs(ch chan *job.SummaryJob) []*job.SummaryJob {
+	drained := make([]*job.SummaryJob, 0)
+	for {
+		select {
+		case j := <-ch:
+			drained = append(drained, j)
+		default:
+			return drained
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package pipeline
+
+import (
+	"fmt"
+	"math"
+	"sync"
+
+	"go-yt-sum/job"
+)
+
+// Decides which ready job the next free summarization worker picks up
+type SchedulingPolicy string
+
+const (
+	// Oldest ready job first
+	PolicyFIFO SchedulingPolicy = "fifo"
+	// Shortest video first, so clips don't wait behind lectures
+	PolicySJF SchedulingPolicy = "sjf"
+	// Round-robin across submitters, so one client's backlog can't starve everyone else
+	PolicyFair SchedulingPolicy = "fair"
+)
+
+func ParseSchedulingPolicy(s string) (SchedulingPolicy, error) {
+	switch p := SchedulingPolicy(s); p {
+	case PolicyFIFO, PolicySJF, PolicyFair:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown scheduling policy %q (expected fifo, sjf or fair)", s)
+}
+
+// Jobs waiting for a summarization worker. Unlike a channel the whole set can be inspected,
+// which is what lets the policy pick something other than the head.
+type readySet struct {
+	policy SchedulingPolicy
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// Kept in arrival order, so every policy falls back to FIFO on ties
+	jobs []*job.SummaryJob
+
+	// Submitter -> the pop count when they were last served. Only used by PolicyFair
+	lastServed map[string]int
+	pops       int
+}
+
+func newReadySet(policy SchedulingPolicy) *readySet {
+	rs := &readySet{
+		policy:     policy,
+		lastServed: make(map[string]int),
+	}
+	rs.cond = sync.NewCond(&rs.mu)
+	return rs
+}
+
+func (rs *readySet) Push(j *job.SummaryJob) {
+	rs.mu.Lock()
+	rs.jobs = append(rs.jobs, j)
+	rs.mu.Unlock()
+
+	rs.cond.Signal()
+}
+
+// Blocks until a job is ready, then removes and returns the one the policy prefers
+func (rs *readySet) Pop() *job.SummaryJob {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	for len(rs.jobs) == 0 {
+		rs.cond.Wait()
+	}
+
+	idx := rs.pickLocked()
+	next := rs.jobs[idx]
+	rs.jobs = append(rs.jobs[:idx], rs.jobs[idx+1:]...)
+
+	rs.pops++
+	rs.lastServed[next.Options.Submitter] = rs.pops
+
+	return next
+}
+
+// Removes and returns every waiting job, oldest first
+func (rs *readySet) Drain() []*job.SummaryJob {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	drained := rs.jobs
+	rs.jobs = nil
+	return drained
+}
+
+func (rs *readySet) Len() int {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return len(rs.jobs)
+}
+
+// Requires the caller to lock
+func (rs *readySet) pickLocked() int {
+	best := 0
+
+	switch rs.policy {
+	case PolicySJF:
+		bestLen := jobLength(rs.jobs[0])
+		for i, j := range rs.jobs[1:] {
+			if l := jobLength(j); l < bestLen {
+				best, bestLen = i+1, l
+			}
+		}
+
+	case PolicyFair:
+		// Submitters that have never been served have a lastServed of 0, so they go first
+		bestServed := rs.lastServed[rs.jobs[0].Options.Submitter]
+		for i, j := range rs.jobs[1:] {
+			if served := rs.lastServed[j.Options.Submitter]; served < bestServed {
+				best, bestServed = i+1, served
+			}
+		}
+	}
+
+	return best
+}
+
+// Video length in seconds. Jobs without metadata yet sort after everything that has it
+func jobLength(j *job.SummaryJob) float64 {
+	j.Lock.RLock()
+	defer j.Lock.RUnlock()
+
+	if j.Progress.VideoMeta == nil || j.Progress.VideoMeta.Length <= 0 {
+		return math.MaxFloat64
+	}
+	return j.Progress.VideoMeta.Length
+}
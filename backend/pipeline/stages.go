@@ -1,111 +1,480 @@
 package pipeline
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"sync"
+	"time"
 
 	"go-yt-sum/adapters"
 	"go-yt-sum/job"
 )
 
+var (
+	// Every slot is taken by a job that hasn't finished, failed or been cancelled yet
+	ErrPipelineFull = errors.New("too many jobs in progress, try again once some have finished")
+	// The request channel's buffer is full
+	ErrQueueFull = errors.New("queue full")
+	// Stop has been called, the server is shutting down
+	ErrPipelineStopped = errors.New("server is shutting down, try again shortly")
+)
+
 type PipelineError struct {
 	Err   error
 	Job   *job.SummaryJob
 	Stage string
 }
 
+// A request to summarize a video, as it enters the pipeline
+type Request struct {
+	VideoID string
+	Options job.JobOptions
+
+	// Start from the earliest stage whose output is missing, instead of at the download stage
+	Resume bool
+
+	// Replace the video's finished job instead of leaving it be
+	Regenerate bool
+
+	// Where the job goes in the queue for the download stage
+	Priority Priority
+}
+
+type Options struct {
+	// Number of jobs transcribed at the same time. Defaults to 1, which transcribes one video after another
+	TranscribeWorkers int
+	// Number of jobs summarized at the same time
+	SummarizeWorkers int
+	// How the summarization stage picks among jobs waiting for a worker
+	SchedulingPolicy SchedulingPolicy
+	// Times a stage is attempted before a transient HTTP error fails the job. 1 disables retries
+	StageAttempts int
+	// Wait before rerunning a stage the first time. Doubles on every attempt after that
+	StageRetryBackoff time.Duration
+	// Where the pipeline logs to. Nil uses slog.Default()
+	Logger *slog.Logger
+	// Jobs the pipeline takes on at once, counting from Submit until they finish, fail or are cancelled.
+	// Submit refuses anything past this instead of letting it pile up between stages. 0 is no limit
+	MaxActiveJobs int
+}
+
+func DefaultOptions() Options {
+	return Options{
+		TranscribeWorkers: 1,
+		SummarizeWorkers:  4,
+		SchedulingPolicy:  PolicyFIFO,
+		StageAttempts:     3,
+		StageRetryBackoff: 5 * time.Second,
+	}
+}
+
 type SummarizerPipeline struct {
-	mgr *job.ActiveJobsManager
+	mgr  *job.ActiveJobsManager
+	opts Options
 
-	videoIdIn     chan string
+	requestIn chan Request
+	// New jobs wait here rather than in pendingCh, so a higher priority job can get ahead of them
+	pending       *pendingQueue
 	pendingCh     chan *job.SummaryJob
 	downloadedCh  chan *job.SummaryJob
 	transcribedCh chan *job.SummaryJob
 	summarizedCh  chan *job.SummaryJob
 
+	// Transcribed jobs waiting for a summarization worker
+	ready *readySet
+
 	errCh chan PipelineError
+
+	// One token per job between Submit and leaving the pipeline. Nil when MaxActiveJobs is 0
+	slots chan struct{}
+
+	// Counts jobs a stage is working on. Stop waits for it, and once stopped is set no stage picks up another job
+	inFlight sync.WaitGroup
+	stopLock sync.RWMutex
+	stopped  bool
+
+	metrics *stageMetrics
 }
 
-func NewSummarizerPipeline(mgr *job.ActiveJobsManager) *SummarizerPipeline {
+func NewSummarizerPipeline(mgr *job.ActiveJobsManager, opts Options) *SummarizerPipeline {
+	if opts.TranscribeWorkers < 1 {
+		opts.TranscribeWorkers = 1
+	}
+	if opts.SummarizeWorkers < 1 {
+		opts.SummarizeWorkers = 1
+	}
+	if opts.StageAttempts < 1 {
+		opts.StageAttempts = 1
+	}
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
+
+	var slots chan struct{}
+	if opts.MaxActiveJobs > 0 {
+		slots = make(chan struct{}, opts.MaxActiveJobs)
+	}
+
 	return &SummarizerPipeline{
-		mgr: mgr,
+		mgr:  mgr,
+		opts: opts,
 
-		videoIdIn:     make(chan string, 1024),
-		pendingCh:     make(chan *job.SummaryJob, 1024),
+		requestIn: make(chan Request, 1024),
+		pending:   newPendingQueue(),
+		// Unbuffered, so jobs only leave the pending queue once the download stage is ready for them
+		pendingCh:     make(chan *job.SummaryJob),
 		downloadedCh:  make(chan *job.SummaryJob, 1024),
 		transcribedCh: make(chan *job.SummaryJob, 1024),
 		summarizedCh:  make(chan *job.SummaryJob, 1024),
 
+		ready: newReadySet(opts.SchedulingPolicy),
+
 		errCh: make(chan PipelineError, 10),
+		slots: slots,
 	}
 }
 
-func (pipe *SummarizerPipeline) Start() chan<- string {
+// Hands a request to the pipeline without blocking. Returns ErrPipelineFull if every slot is taken,
+// ErrQueueFull if the request channel is, or ErrPipelineStopped once Stop has been called
+func (pipe *SummarizerPipeline) Submit(req Request) error {
+	// Held until the request is in the channel, so Stop can't close it in between
+	pipe.stopLock.RLock()
+	defer pipe.stopLock.RUnlock()
+
+	if pipe.stopped {
+		return ErrPipelineStopped
+	}
+
+	if pipe.slots != nil {
+		select {
+		case pipe.slots <- struct{}{}:
+		default:
+			return ErrPipelineFull
+		}
+	}
+
+	select {
+	case pipe.requestIn <- req:
+		return nil
+	default:
+		pipe.releaseSlot()
+		return ErrQueueFull
+	}
+}
+
+// Frees the slot of a job that's leaving the pipeline
+func (pipe *SummarizerPipeline) releaseSlot() {
+	if pipe.slots == nil {
+		return
+	}
+	select {
+	case <-pipe.slots:
+	default:
+	}
+}
+
+// Number of jobs holding a slot, and the most that can. Max is 0 when there's no limit
+func (pipe *SummarizerPipeline) ActiveJobs() (active int, max int) {
+	return len(pipe.slots), cap(pipe.slots)
+}
+
+// Requests submitted that processNewIds hasn't turned into jobs yet
+func (pipe *SummarizerPipeline) QueuedRequests() int {
+	return len(pipe.requestIn)
+}
+
+func (pipe *SummarizerPipeline) Start() chan<- Request {
+	// Counted until requestIn is closed and drained
+	pipe.inFlight.Add(1)
 	go pipe.processNewIds()
+	go pipe.dispatchPendingJobs()
 	go pipe.downloadNextJob()
-	go pipe.transcribeNextJob()
-	go pipe.summarizeNextJob()
+	for range pipe.opts.TranscribeWorkers {
+		go pipe.transcribeNextJob()
+	}
+	go pipe.collectTranscribedJobs()
+	for range pipe.opts.SummarizeWorkers {
+		go pipe.summarizeNextJob()
+	}
 	go pipe.displayOutput()
 
 	go pipe.handleErrors()
 
-	return pipe.videoIdIn
+	return pipe.requestIn
+}
+
+// Closes the request channel, so nothing may send on it anymore, and waits for the jobs stages are working on.
+// Jobs still waiting between stages stay where they are, for the checkpoint to record.
+// Returns ctx's error if the stages haven't finished by the time it's done
+func (pipe *SummarizerPipeline) Stop(ctx context.Context) error {
+	pipe.stopLock.Lock()
+	alreadyStopped := pipe.stopped
+	pipe.stopped = true
+	pipe.stopLock.Unlock()
+
+	if !alreadyStopped {
+		close(pipe.requestIn)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		pipe.inFlight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Marks a job as being worked on. False once the pipeline is stopping, in which case the stage leaves the job alone
+func (pipe *SummarizerPipeline) begin(j *job.SummaryJob, stage string) bool {
+	pipe.stopLock.RLock()
+	defer pipe.stopLock.RUnlock()
+
+	if pipe.stopped {
+		pipe.jobLog(j, stage).Info("pipeline is stopping, leaving job where it is")
+		return false
+	}
+
+	pipe.inFlight.Add(1)
+
+	j.UpdateJob(func(j *job.SummaryJob) {
+		if j.StartedAt.IsZero() {
+			j.StartedAt = time.Now()
+		}
+	})
+	return true
 }
 
 // ---
 
 func (pipe *SummarizerPipeline) recoverStage(stageName string, failedJob *job.SummaryJob) {
 	if r := recover(); r != nil {
+		// Keep the original error around so handleErrors can inspect it
+		err, ok := r.(error)
+		if !ok {
+			err = fmt.Errorf("%v", r)
+		}
+
 		pipe.errCh <- PipelineError{
-			Err:   fmt.Errorf("%v", r),
+			Err:   err,
 			Job:   failedJob,
 			Stage: stageName,
 		}
 	}
 }
 
+// Jobs cancelled while sitting in a channel are dropped by the next stage that picks them up
+func (pipe *SummarizerPipeline) isCancelled(j *job.SummaryJob, stage string) bool {
+	if j.Context().Err() != nil {
+		pipe.jobLog(j, stage).Info("job was cancelled, dropping it")
+		pipe.releaseSlot()
+		return true
+	}
+	return false
+}
+
+// Every line about a job carries its video ID and the stage it's in, so one job can be followed through the logs
+func (pipe *SummarizerPipeline) jobLog(j *job.SummaryJob, stage string) *slog.Logger {
+	return pipe.opts.Logger.With("video_id", j.VideoID, "stage", stageLabel(stage))
+}
+
 // ---
 
 func (pipe *SummarizerPipeline) handleErrors() {
 	for pipeError := range pipe.errCh {
-		log.Printf("Job %s failed at stage %s: %s", pipeError.Job.VideoID, pipeError.Stage, pipeError.Err)
+		// Cancelling aborts the adapters mid-IO, which surfaces here. The job is already marked cancelled.
+		if errors.Is(pipeError.Err, context.Canceled) {
+			pipe.jobLog(pipeError.Job, pipeError.Stage).Info("job stopped after being cancelled")
+			pipe.releaseSlot()
+			continue
+		}
+
+		// Waiting on a stream holds the job's slot, but not the download stage
+		if errors.Is(pipeError.Err, adapters.ErrStreamNotEnded) {
+			pipe.jobLog(pipeError.Job, pipeError.Stage).Info("stream hasn't ended, checking again later", "retry_in", adapters.LiveStreamPollInterval)
+			pipe.requeue(pipeError, adapters.LiveStreamPollInterval)
+			continue
+		}
+
+		if pipe.retryStage(pipeError) {
+			continue
+		}
+
+		pipe.jobLog(pipeError.Job, pipeError.Stage).Error("job failed", "error", pipeError.Err)
+		pipe.metrics.jobFailed(pipeError.Stage)
+		pipe.releaseSlot()
+
+		// Lets the frontend explain why instead of showing a generic failure
+		status := "failed"
+		switch {
+		case errors.Is(pipeError.Err, adapters.ErrVideoTooLong):
+			status = "rejected_too_long"
+		case errors.Is(pipeError.Err, adapters.ErrStillLive):
+			status = "rejected_live"
+		}
 
 		pipeError.Job.UpdateJob(func(j *job.SummaryJob) {
-			j.Status = "failed"
+			j.Status = status
 			j.Error = pipeError.Err.Error()
+			j.FinishedAt = time.Now()
 		})
 
 		// Update database to mark job as failed
 		pipe.mgr.DB.SetJobFailed(pipeError.Job.VideoID, true, pipeError.Err.Error())
+
+		adapters.NotifyJobDone(pipeError.Job.Options, adapters.NewWebhookPayload(pipeError.Job.VideoID, status, pipeError.Err.Error()))
+	}
+}
+
+// Puts the job back into the stage that failed after a backoff, if the error was transient and it has attempts left.
+// A rate limit that outlasted the adapters' own waiting is rerun after Groq's Retry-After if it gave one, and uses up
+// an attempt like any other transient error, so a quota that stays exhausted fails the job rather than holding its slot.
+// Returns false if the job should be failed instead
+func (pipe *SummarizerPipeline) retryStage(pipeError PipelineError) bool {
+	if pipeError.Job.Context().Err() != nil {
+		return false
+	}
+
+	if !adapters.IsTransientHTTPError(pipeError.Err) {
+		return false
+	}
+
+	retries := 0
+	pipeError.Job.UpdateJob(func(j *job.SummaryJob) {
+		j.Progress.StageRetries++
+		retries = j.Progress.StageRetries
+	})
+
+	if retries >= pipe.opts.StageAttempts {
+		return false
 	}
+
+	wait := pipe.opts.StageRetryBackoff << (retries - 1)
+	var rateLimited *adapters.RateLimitError
+	if errors.As(pipeError.Err, &rateLimited) && rateLimited.RetryAfter > 0 {
+		wait = rateLimited.RetryAfter
+	}
+	pipe.jobLog(pipeError.Job, pipeError.Stage).Warn("job hit a transient error, retrying",
+		"attempt", retries, "attempts", pipe.opts.StageAttempts, "retry_in", wait, "error", pipeError.Err)
+
+	pipe.requeue(pipeError, wait)
+	return true
+}
+
+// Sends the job back to the start of the stage it failed in once wait has passed
+func (pipe *SummarizerPipeline) requeue(pipeError PipelineError, wait time.Duration) {
+	time.AfterFunc(wait, func() {
+		switch pipeError.Stage {
+		case "downloadNextJob":
+			pipe.pendingCh <- pipeError.Job
+		case "transcribeNextJob":
+			pipe.downloadedCh <- pipeError.Job
+		case "summarizeNextJob":
+			pipe.ready.Push(pipeError.Job)
+		}
+	})
 }
 
 func (pipe *SummarizerPipeline) processNewIds() {
-	for videoId := range pipe.videoIdIn {
-		exists, newJob := pipe.mgr.CreateJob(videoId)
+	defer pipe.inFlight.Done()
+
+	for req := range pipe.requestIn {
+		// A range summary sits next to the full one, so it replaces a finished job and reuses the transcript
+		if req.Options.HasRange() {
+			req.Regenerate = true
+			req.Resume = true
+		}
+
+		create := pipe.mgr.CreateJob
+		if req.Regenerate {
+			create = pipe.mgr.RegenerateJob
+		}
+
+		exists, newJob := create(req.VideoID, req.Options)
 
-		if !exists {
-			log.Printf("Added %s to queue\n", videoId)
-			pipe.pendingCh <- newJob
-		} else {
-			log.Printf("Video with id %s already has a job\n", videoId)
+		if exists {
+			pipe.jobLog(newJob, "queue").Info("video already has a job")
+			pipe.releaseSlot()
+			continue
 		}
+		pipe.metrics.jobEnqueued()
+
+		// The download stage is what normally fills in the metadata, so take it from the DB when skipping it
+		if req.Resume && adapters.TranscriptionExists(req.VideoID) {
+			pipe.jobLog(newJob, "queue").Info("resuming job at summarization")
+
+			if pipe.mgr.DB.Exists(req.VideoID) {
+				meta := pipe.mgr.DB.Read(req.VideoID)
+				newJob.UpdateJob(func(j *job.SummaryJob) {
+					j.Progress.VideoMeta = &meta
+				})
+			}
+
+			pipe.transcribed(newJob)
+			continue
+		}
+
+		// Download and transcription skip themselves when their output already exists
+		pipe.jobLog(newJob, "queue").Info("added job to queue", "priority", req.Priority)
+		pipe.pending.Push(newJob, req.Priority)
+	}
+}
+
+// Hands the download stage the highest priority pending job whenever it's ready for another
+func (pipe *SummarizerPipeline) dispatchPendingJobs() {
+	for {
+		pipe.pendingCh <- pipe.pending.Pop()
+	}
+}
+
+// Sends a job that has its transcript on to summarization, or straight to displayOutput if that's all it wanted
+func (pipe *SummarizerPipeline) transcribed(j *job.SummaryJob) {
+	if !j.Options.TranscriptOnly {
+		pipe.transcribedCh <- j
+		return
+	}
+
+	pipe.jobLog(j, "transcribeNextJob").Info("transcript only, skipping summarization")
+	// Stays in flight until displayOutput has marked it finished
+	pipe.inFlight.Add(1)
+	pipe.summarizedCh <- j
+}
+
+// Moves transcribed jobs into the ready set, where the summarization workers pick them by policy
+func (pipe *SummarizerPipeline) collectTranscribedJobs() {
+	for transcribedJob := range pipe.transcribedCh {
+		pipe.ready.Push(transcribedJob)
 	}
 }
 
 func (pipe *SummarizerPipeline) summarizeNextJob() {
-	for pendingJob := range pipe.transcribedCh {
-		// Summaries can be generated in parallel since groq doesn't rate limit
-		go func(job *job.SummaryJob) {
+	for {
+		pendingJob := pipe.ready.Pop()
+		if pipe.isCancelled(pendingJob, "summarizeNextJob") || !pipe.begin(pendingJob, "summarizeNextJob") {
+			continue
+		}
+
+		func(job *job.SummaryJob) {
+			defer pipe.inFlight.Done()
 			defer pipe.recoverStage("summarizeNextJob", job)
+			defer pipe.metrics.timeStage("summarizeNextJob")()
 
-			log.Printf("Summarizing %s\n", job.VideoID)
+			pipe.jobLog(job, "summarizeNextJob").Info("summarizing")
 			job.UpdateStatus("summarizing")
 
-			if err := adapters.SummarizeVideo(job.VideoID, job.UpdateJob); err != nil {
+			if err := adapters.SummarizeVideo(job.Context(), job.VideoID, job.Options, job.UpdateJob); err != nil {
 				panic(err)
 			}
 
+			// Stays in flight until displayOutput has marked it finished
+			pipe.inFlight.Add(1)
 			pipe.summarizedCh <- job
 		}(pendingJob)
 	}
@@ -113,16 +482,22 @@ func (pipe *SummarizerPipeline) summarizeNextJob() {
 
 func (pipe *SummarizerPipeline) transcribeNextJob() {
 	for pendingJob := range pipe.downloadedCh {
+		if pipe.isCancelled(pendingJob, "transcribeNextJob") || !pipe.begin(pendingJob, "transcribeNextJob") {
+			continue
+		}
+
 		func(job *job.SummaryJob) {
+			defer pipe.inFlight.Done()
 			defer pipe.recoverStage("transcribeNextJob", job)
+			defer pipe.metrics.timeStage("transcribeNextJob")()
 
-			err := adapters.TranscribeVideo(job.VideoID, job.UpdateJob)
+			err := adapters.TranscribeVideo(job.Context(), job.VideoID, job.Options, job.UpdateJob)
 
 			if err != nil {
 				panic(err)
 			}
 
-			pipe.transcribedCh <- pendingJob
+			pipe.transcribed(job)
 		}(pendingJob)
 	}
 }
@@ -130,15 +505,20 @@ func (pipe *SummarizerPipeline) transcribeNextJob() {
 func (pipe *SummarizerPipeline) downloadNextJob() {
 	// Read in jobs from the pipeline
 	for pendingJob := range pipe.pendingCh {
+		if pipe.isCancelled(pendingJob, "downloadNextJob") || !pipe.begin(pendingJob, "downloadNextJob") {
+			continue
+		}
 
 		// Define handler for this job which we can catch if it fails unexpectedly
 		func(j *job.SummaryJob) {
+			defer pipe.inFlight.Done()
 			defer pipe.recoverStage("downloadNextJob", j)
+			defer pipe.metrics.timeStage("downloadNextJob")()
 
-			log.Printf("Downloading %s\n", pendingJob.VideoID)
+			pipe.jobLog(j, "downloadNextJob").Info("downloading")
 
 			// Call the adapter to perform the IO
-			autoSubsWereAvailable, err := adapters.DownloadVideo(j.VideoID, pendingJob.UpdateJob)
+			autoSubsWereAvailable, err := adapters.DownloadVideo(j.Context(), j.VideoID, j.Options, pendingJob.UpdateJob)
 
 			if err != nil {
 				panic(err)
@@ -147,7 +527,7 @@ func (pipe *SummarizerPipeline) downloadNextJob() {
 			// If auto-generated subs were available, send straight to summarization stage
 			// Otherwise, manually transcribe
 			if autoSubsWereAvailable {
-				pipe.transcribedCh <- pendingJob
+				pipe.transcribed(pendingJob)
 			} else {
 				pipe.downloadedCh <- pendingJob
 			}
@@ -157,13 +537,44 @@ func (pipe *SummarizerPipeline) downloadNextJob() {
 
 func (pipe *SummarizerPipeline) displayOutput() {
 	for j := range pipe.summarizedCh {
-		log.Printf("All steps completed succesfully for job %s\n", j.VideoID)
+		pipe.finishJob(j)
+	}
+}
 
-		j.UpdateJob(func(j *job.SummaryJob) {
-			j.Status = "finished"
-		})
+func (pipe *SummarizerPipeline) finishJob(j *job.SummaryJob) {
+	defer pipe.inFlight.Done()
+
+	if pipe.isCancelled(j, "finish") {
+		return
+	}
+
+	pipe.jobLog(j, "finish").Info("all steps completed successfully")
+	pipe.metrics.jobCompleted()
+	pipe.releaseSlot()
+
+	var queued, started, finished time.Time
+	var tooSparse bool
+	j.UpdateJob(func(j *job.SummaryJob) {
+		j.Status = "finished"
+		j.FinishedAt = time.Now()
+		queued, started, finished = j.QueuedAt, j.StartedAt, j.FinishedAt
+		tooSparse = j.Progress.TooSparse
+	})
+
+	// Update database to mark job as successful
+	pipe.mgr.DB.UpdateJobSuccess(j.VideoID)
+	pipe.mgr.DB.SetJobTimes(j.VideoID, queued, started, finished)
+	if j.Options.WritesFullSummary() {
+		pipe.mgr.DB.SetTooSparse(j.VideoID, tooSparse)
+	}
 
-		// Update database to mark job as successful
-		pipe.mgr.DB.UpdateJobSuccess(j.VideoID)
+	payload := adapters.NewWebhookPayload(j.VideoID, "finished", "")
+	payload.TooSparse = tooSparse
+	if j.Options.TranscriptOnly {
+		payload.SummaryURL = ""
+		payload.TranscriptURL = adapters.TranscriptURL(j.VideoID)
+	} else if j.Options.HasRange() {
+		payload.SummaryURL = adapters.RangeSummaryURL(j.VideoID, j.Options.StartSeconds, j.Options.EndSeconds)
 	}
+	adapters.NotifyJobDone(j.Options, payload)
 }
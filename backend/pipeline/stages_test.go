@@ -0,0 +1,69 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"go-yt-sum/db"
+	"go-yt-sum/job"
+)
+
+func newTestPipeline(t *testing.T, opts Options) *SummarizerPipeline {
+	t.Helper()
+
+	database, err := db.NewDB(filepath.Join(t.TempDir(), "db.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mgr, err := job.NewJobManager(database, "", func(string) bool { return false })
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewSummarizerPipeline(mgr, opts)
+}
+
+func TestSubmitAfterStop(t *testing.T) {
+	pipe := newTestPipeline(t, DefaultOptions())
+
+	if err := pipe.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := pipe.Submit(Request{VideoID: "dQw4w9WgXcQ"}); !errors.Is(err, ErrPipelineStopped) {
+		t.Fatalf("Submit after Stop = %v, want ErrPipelineStopped", err)
+	}
+}
+
+// Handlers still running when shutdown gives up waiting on them must not send on the closed request channel
+func TestSubmitDuringStop(t *testing.T) {
+	pipe := newTestPipeline(t, DefaultOptions())
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				err := pipe.Submit(Request{VideoID: "dQw4w9WgXcQ"})
+				if err != nil && !errors.Is(err, ErrPipelineStopped) && !errors.Is(err, ErrQueueFull) {
+					t.Errorf("unexpected Submit error: %v", err)
+					return
+				}
+			}
+		}()
+	}
+
+	// Nothing reads requestIn here, so drain it to let Stop's close race with the sends
+	go func() {
+		for range pipe.requestIn {
+		}
+	}()
+
+	if err := pipe.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+}